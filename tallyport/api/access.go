@@ -0,0 +1,174 @@
+package api
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+	"tallyport/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// ipAccess restricts routes to the client addresses allowed by ip_access_config, and resolves
+// the client address of requests forwarded by trusted proxies.
+type ipAccess struct {
+	trustedProxies []netip.Prefix
+	routes         map[string]ipRule
+	refused        *prometheus.CounterVec
+	logger         zerolog.Logger
+}
+
+// ipRule holds the parsed ranges of a config.IPRule.
+type ipRule struct {
+	allow, deny []netip.Prefix
+}
+
+// loadIPAccess parses the ranges of ip_access_config.
+//
+// Parameters:
+//   - cfg: Server configuration, of which ip_access_config is used.
+//   - refused: Counter of refused requests by route.
+//   - logger: Logger for refused requests.
+//
+// Returns:
+//   - *ipAccess: The address rules.
+//   - An error naming the first range that cannot be parsed.
+func loadIPAccess(cfg config.TallyPortConfig, refused *prometheus.CounterVec, logger zerolog.Logger) (*ipAccess, error) {
+	trusted, err := config.ParsePrefixes(cfg.IPAccessConfig.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("ip_access_config.trusted_proxies: %w", err)
+	}
+	access := &ipAccess{
+		trustedProxies: trusted,
+		routes:         make(map[string]ipRule, len(cfg.IPAccessConfig.Routes)),
+		refused:        refused,
+		logger:         logger,
+	}
+	for route, rule := range cfg.IPAccessConfig.Routes {
+		var parsed ipRule
+		if parsed.allow, err = config.ParsePrefixes(rule.Allow); err != nil {
+			return nil, fmt.Errorf("ip_access_config.routes.%s.allow: %w", route, err)
+		}
+		if parsed.deny, err = config.ParsePrefixes(rule.Deny); err != nil {
+			return nil, fmt.Errorf("ip_access_config.routes.%s.deny: %w", route, err)
+		}
+		access.routes[route] = parsed
+	}
+	return access, nil
+}
+
+// realIP replaces middleware.RealIP, which believes the forwarding headers of any client. The
+// X-Forwarded-For and X-Real-IP headers are only used when the request comes from one of
+// ip_access_config.trusted_proxies; the client address is then the last X-Forwarded-For entry
+// that is not a trusted proxy itself, since earlier entries are whatever the client sent.
+// Requests from other peers keep their connection address. Like middleware.RealIP, it stores the
+// resolved address without a port in req.RemoteAddr.
+func (a *ipAccess) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		if peer, ok := remoteAddr(req); ok && a.trusted(peer) {
+			if client, ok := a.forwardedFor(req); ok {
+				req.RemoteAddr = client.String()
+			}
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// forwardedFor returns the client address named by the forwarding headers of a request from a
+// trusted proxy.
+func (a *ipAccess) forwardedFor(req *http.Request) (netip.Addr, bool) {
+	var hops []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+
+	var client netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			// Whatever precedes a malformed entry cannot be told apart from what the client sent.
+			break
+		}
+		client = addr.Unmap()
+		if !a.trusted(client) {
+			return client, true
+		}
+	}
+	if client.IsValid() {
+		// Every hop is a trusted proxy, so the request started at the first of them.
+		return client, true
+	}
+
+	if addr, err := netip.ParseAddr(strings.TrimSpace(req.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap(), true
+	}
+	return netip.Addr{}, false
+}
+
+// trusted reports whether addr belongs to a trusted proxy.
+func (a *ipAccess) trusted(addr netip.Addr) bool {
+	return contains(a.trustedProxies, addr)
+}
+
+// allow returns middleware refusing requests to route with 403 unless their client address is
+// allowed by the route's rule in ip_access_config.routes. Addresses in deny are refused, and
+// when allow is not empty every address outside it is refused as well. Routes without a rule
+// accept every address.
+//
+// Parameters:
+//   - route: Route pattern as registered, e.g. "/definitions/{name}".
+//
+// Returns:
+//   - func(http.Handler) http.Handler: The middleware.
+func (a *ipAccess) allow(route string) func(http.Handler) http.Handler {
+	rule, ok := a.routes[route]
+	return func(next http.Handler) http.Handler {
+		if !ok || len(rule.allow) == 0 && len(rule.deny) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			addr, ok := remoteAddr(req)
+			if ok && !contains(rule.deny, addr) && (len(rule.allow) == 0 || contains(rule.allow, addr)) {
+				next.ServeHTTP(res, req)
+				return
+			}
+
+			client := req.RemoteAddr
+			if ok {
+				client = addr.String()
+			}
+			a.refused.WithLabelValues(route).Inc()
+			a.logger.Warn().Str("remote", req.RemoteAddr).Str("path", req.URL.Path).Msg("request from a refused address")
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusForbidden,
+				Reason: fmt.Sprintf("address %s may not access %s", client, route),
+			})
+		})
+	}
+}
+
+// remoteAddr parses req.RemoteAddr, with or without a port.
+func remoteAddr(req *http.Request) (netip.Addr, bool) {
+	host := req.RemoteAddr
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return addr.Unmap().WithZone(""), true
+}
+
+// contains reports whether addr is in one of prefixes.
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, prefix := range prefixes {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
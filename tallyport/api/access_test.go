@@ -0,0 +1,138 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"tallyport/config"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+func newIPAccess(t *testing.T, trustedProxies []string, routes map[string]config.IPRule) (*ipAccess, *prometheus.CounterVec) {
+	t.Helper()
+	cfg := config.Default()
+	cfg.IPAccessConfig.TrustedProxies = trustedProxies
+	cfg.IPAccessConfig.Routes = routes
+	refused := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "refused_total"}, []string{"route"})
+	access, err := loadIPAccess(cfg, refused, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("loadIPAccess: %v", err)
+	}
+	return access, refused
+}
+
+func TestRealIP(t *testing.T) {
+	access, _ := newIPAccess(t, []string{"10.0.0.0/8", "::1"}, nil)
+	tests := []struct {
+		name         string
+		peer         string
+		forwardedFor []string
+		realIP       string
+		want         string
+	}{
+		{name: "untrusted peer", peer: "203.0.113.7:4321", forwardedFor: []string{"198.51.100.1"}, realIP: "198.51.100.2", want: "203.0.113.7:4321"},
+		{name: "trusted peer", peer: "10.0.0.2:4321", forwardedFor: []string{"198.51.100.1"}, want: "198.51.100.1"},
+		{name: "trusted IPv6 peer", peer: "[::1]:4321", forwardedFor: []string{"2001:db8::1"}, want: "2001:db8::1"},
+		{name: "entries sent by the client are skipped", peer: "10.0.0.2:4321", forwardedFor: []string{"192.0.2.66, 198.51.100.1, 10.0.0.3"}, want: "198.51.100.1"},
+		{name: "entries over several headers", peer: "10.0.0.2:4321", forwardedFor: []string{"192.0.2.66", "198.51.100.1", "10.0.0.3"}, want: "198.51.100.1"},
+		{name: "every hop trusted", peer: "10.0.0.2:4321", forwardedFor: []string{"10.0.0.4, 10.0.0.3"}, want: "10.0.0.4"},
+		{name: "malformed entry", peer: "10.0.0.2:4321", forwardedFor: []string{"198.51.100.1, unknown, 10.0.0.3"}, want: "10.0.0.3"},
+		{name: "malformed last entry", peer: "10.0.0.2:4321", forwardedFor: []string{"198.51.100.1, unknown"}, realIP: "198.51.100.2", want: "198.51.100.2"},
+		{name: "mapped IPv4 address", peer: "10.0.0.2:4321", forwardedFor: []string{"::ffff:198.51.100.1"}, want: "198.51.100.1"},
+		{name: "X-Real-IP", peer: "10.0.0.2:4321", realIP: "198.51.100.2", want: "198.51.100.2"},
+		{name: "X-Forwarded-For before X-Real-IP", peer: "10.0.0.2:4321", forwardedFor: []string{"198.51.100.1"}, realIP: "198.51.100.2", want: "198.51.100.1"},
+		{name: "no forwarding headers", peer: "10.0.0.2:4321", want: "10.0.0.2:4321"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/quota", nil)
+			req.RemoteAddr = tt.peer
+			for _, header := range tt.forwardedFor {
+				req.Header.Add("X-Forwarded-For", header)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+
+			var got string
+			access.realIP(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				got = req.RemoteAddr
+			})).ServeHTTP(httptest.NewRecorder(), req)
+			if got != tt.want {
+				t.Errorf("RemoteAddr = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPAccessAllow(t *testing.T) {
+	access, refused := newIPAccess(t, nil, map[string]config.IPRule{
+		"/push":  {Allow: []string{"10.0.0.0/8", "2001:db8::/32"}, Deny: []string{"10.0.0.66"}},
+		"/quota": {Deny: []string{"192.0.2.0/24"}},
+	})
+	tests := []struct {
+		name   string
+		route  string
+		remote string
+		want   int
+	}{
+		{name: "allowed range", route: "/push", remote: "10.1.2.3:4321", want: http.StatusOK},
+		{name: "allowed IPv6 range", route: "/push", remote: "[2001:db8::7]:4321", want: http.StatusOK},
+		{name: "outside allowed ranges", route: "/push", remote: "198.51.100.1:4321", want: http.StatusForbidden},
+		{name: "denied within allowed range", route: "/push", remote: "10.0.0.66:4321", want: http.StatusForbidden},
+		{name: "mapped IPv4 address", route: "/push", remote: "[::ffff:10.1.2.3]:4321", want: http.StatusOK},
+		{name: "address without port", route: "/push", remote: "10.1.2.3", want: http.StatusOK},
+		{name: "unparsable address", route: "/push", remote: "pipe", want: http.StatusForbidden},
+		{name: "denied range only", route: "/quota", remote: "192.0.2.10:4321", want: http.StatusForbidden},
+		{name: "outside denied range", route: "/quota", remote: "198.51.100.1:4321", want: http.StatusOK},
+		{name: "route without rule", route: "/init", remote: "192.0.2.10:4321", want: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := testutil.ToFloat64(refused.WithLabelValues(tt.route))
+			req := httptest.NewRequest(http.MethodGet, tt.route, nil)
+			req.RemoteAddr = tt.remote
+			res := httptest.NewRecorder()
+			access.allow(tt.route)(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+				res.WriteHeader(http.StatusOK)
+			})).ServeHTTP(res, req)
+
+			if res.Code != tt.want {
+				t.Errorf("status = %d, want %d", res.Code, tt.want)
+			}
+			wantRefused := 0.0
+			if tt.want == http.StatusForbidden {
+				wantRefused = 1
+			}
+			if got := testutil.ToFloat64(refused.WithLabelValues(tt.route)) - before; got != wantRefused {
+				t.Errorf("refused requests counted = %g, want %g", got, wantRefused)
+			}
+		})
+	}
+}
+
+func TestLoadIPAccessRefusesMalformedRanges(t *testing.T) {
+	refused := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "refused_total"}, []string{"route"})
+	tests := []struct {
+		name           string
+		trustedProxies []string
+		routes         map[string]config.IPRule
+	}{
+		{name: "trusted proxy", trustedProxies: []string{"10.0.0.0/33"}},
+		{name: "allowed range", routes: map[string]config.IPRule{"/push": {Allow: []string{"localhost"}}}},
+		{name: "denied range", routes: map[string]config.IPRule{"/push": {Deny: []string{"10.0.0.1-10.0.0.9"}}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := config.Default()
+			cfg.IPAccessConfig.TrustedProxies = tt.trustedProxies
+			cfg.IPAccessConfig.Routes = tt.routes
+			if _, err := loadIPAccess(cfg, refused, zerolog.Nop()); err == nil {
+				t.Error("loadIPAccess accepted a malformed range")
+			}
+		})
+	}
+}
@@ -0,0 +1,495 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"tallyport/auth"
+	"tallyport/config"
+	"tallyport/registry"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// apiKeyHeader carries an API key for clients that cannot set the Authorization header.
+const apiKeyHeader = "X-API-Key"
+
+// credentialSlot carries the identity of an authenticated request back out to the access log,
+// which wraps the middleware that authenticates the request.
+type credentialSlot struct {
+	identity *auth.Identity
+}
+
+type credentialSlotKey struct{}
+
+// withCredentialSlot gives every request a credentialSlot the authentication middleware can fill.
+func withCredentialSlot(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		ctx := context.WithValue(req.Context(), credentialSlotKey{}, &credentialSlot{})
+		next.ServeHTTP(res, req.WithContext(ctx))
+	})
+}
+
+// loadKeys loads the API keys configured in auth_config.
+//
+// Returns:
+//   - *auth.KeyStore: The keys, or nil when API key authentication is not configured.
+//   - An error if the keys cannot be loaded.
+func loadKeys(cfg config.TallyPortConfig) (*auth.KeyStore, error) {
+	ac := cfg.AuthConfig
+	if ac.KeysFile == "" && len(ac.Keys) == 0 {
+		return nil, nil
+	}
+	keys, err := auth.LoadKeyStore(ac.KeysFile, ac.Keys)
+	if err != nil {
+		return nil, fmt.Errorf("auth_config: %w", err)
+	}
+	return keys, nil
+}
+
+// loadStreamTokens loads the tokens stream clients authenticate with, configured in stream_config.
+//
+// Returns:
+//   - *auth.KeyStore: The tokens, or nil when none are configured.
+//   - An error if a token hash is invalid.
+func loadStreamTokens(cfg config.TallyPortConfig) (*auth.KeyStore, error) {
+	if len(cfg.StreamConfig.Tokens) == 0 {
+		return nil, nil
+	}
+	tokens, err := auth.LoadKeyStore("", cfg.StreamConfig.Tokens)
+	if err != nil {
+		return nil, fmt.Errorf("stream_config.tokens: %w", err)
+	}
+	return tokens, nil
+}
+
+// loadJWT creates the JWT validator configured in auth_config.jwt.
+//
+// Returns:
+//   - *auth.JWTValidator: The validator, or nil when JWT validation is not configured.
+//   - An error if the validator cannot be created.
+func loadJWT(cfg config.TallyPortConfig) (*auth.JWTValidator, error) {
+	jc := cfg.AuthConfig.JWT
+	if jc.JWKSFile == "" {
+		return nil, nil
+	}
+	validator, err := auth.NewJWTValidator(auth.JWTOptions{
+		JWKSFile:        jc.JWKSFile,
+		Issuer:          jc.Issuer,
+		Audiences:       jc.Audiences,
+		Algorithms:      jc.Algorithms,
+		Leeway:          time.Duration(jc.Leeway) * time.Millisecond,
+		IDClaim:         jc.IDClaim,
+		TenantClaim:     jc.TenantClaim,
+		OperationsClaim: jc.OperationsClaim,
+		LabelClaims:     jc.LabelClaims,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("auth_config.jwt: %w", err)
+	}
+	return validator, nil
+}
+
+// exportGuard protects the metrics export and, optionally, the heartbeat with the basic auth
+// users and bearer tokens of export_auth_config, which are separate from the API credentials
+// so scrapers need no API key and API keys cannot read every metric.
+type exportGuard struct {
+	users  *auth.BasicAuthUsers
+	tokens *auth.KeyStore
+	logger zerolog.Logger
+}
+
+// loadExportGuard creates the guard configured in export_auth_config.
+//
+// Returns:
+//   - *exportGuard: The guard; it lets every request through when nothing is configured.
+//   - An error if a password is not a bcrypt hash or a token hash is invalid.
+func loadExportGuard(cfg config.TallyPortConfig, logger zerolog.Logger) (*exportGuard, error) {
+	eac := cfg.ExportAuthConfig
+	guard := &exportGuard{logger: logger}
+	var err error
+	if len(eac.BasicAuthUsers) > 0 {
+		if guard.users, err = auth.NewBasicAuthUsers(eac.BasicAuthUsers); err != nil {
+			return nil, fmt.Errorf("export_auth_config.basic_auth_users: %w", err)
+		}
+	}
+	if len(eac.BearerTokens) > 0 {
+		if guard.tokens, err = auth.LoadKeyStore("", eac.BearerTokens); err != nil {
+			return nil, fmt.Errorf("export_auth_config.bearer_tokens: %w", err)
+		}
+	}
+	return guard, nil
+}
+
+// protect returns next guarded by basic auth or a bearer token. Requests without valid
+// credentials are answered with 401.
+func (g *exportGuard) protect(next http.Handler) http.Handler {
+	if g.users == nil && g.tokens == nil {
+		return next
+	}
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		identity, ok := g.authenticate(req)
+		if !ok {
+			g.logger.Warn().Str("remote", req.RemoteAddr).Str("path", req.URL.Path).Msg("export request without valid credentials refused")
+			challenge := `Bearer realm="tallyport"`
+			if g.users != nil {
+				challenge = `Basic realm="tallyport", charset="UTF-8"`
+			}
+			res.Header().Set("WWW-Authenticate", challenge)
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusUnauthorized,
+				Reason: "invalid or missing credentials",
+			})
+			return
+		}
+		if slot, ok := req.Context().Value(credentialSlotKey{}).(*credentialSlot); ok {
+			slot.identity = &identity
+		}
+		next.ServeHTTP(res, req)
+	})
+}
+
+// protectHeartbeat returns middleware that guards GET and HEAD requests to path like protect,
+// placed in front of middleware.Heartbeat, which answers them itself.
+func (g *exportGuard) protectHeartbeat(path string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		guarded := g.protect(next)
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			if (req.Method == http.MethodGet || req.Method == http.MethodHead) && strings.EqualFold(req.URL.Path, path) {
+				guarded.ServeHTTP(res, req)
+				return
+			}
+			next.ServeHTTP(res, req)
+		})
+	}
+}
+
+// authenticate identifies the scraper of an export request by its basic auth credentials or
+// bearer token.
+func (g *exportGuard) authenticate(req *http.Request) (auth.Identity, bool) {
+	if user, password, ok := req.BasicAuth(); ok {
+		if g.users == nil || !g.users.Verify(user, password) {
+			return auth.Identity{}, false
+		}
+		return auth.Identity{ID: user, Method: auth.MethodBasicAuth}, true
+	}
+	if g.tokens == nil {
+		return auth.Identity{}, false
+	}
+	token, ok := g.tokens.Lookup(requestKey(req))
+	if !ok {
+		return auth.Identity{}, false
+	}
+	return auth.Identity{ID: token.ID, Method: auth.MethodAPIKey}, true
+}
+
+// authorizer authenticates requests with API keys, request signatures or JWTs and enforces the
+// scope of their credential.
+type authorizer struct {
+	keys   *auth.KeyStore
+	denied *prometheus.CounterVec
+	logger zerolog.Logger
+
+	nonces            *auth.NonceCache
+	maxSkew           time.Duration
+	tenantHeader      string // Header whose value signed requests sign, tenant_config.header
+	signatureFailures *prometheus.CounterVec
+
+	jwt           *auth.JWTValidator
+	tokenFailures *prometheus.CounterVec
+}
+
+type authorizerKey struct{}
+
+// require returns middleware that only lets requests through whose credential allows
+// operation. API keys are read from "Authorization: Bearer <key>" or the X-API-Key header, or
+// identified by the X-Tallyport-Key-Id header of a signed request, and JWTs from
+// "Authorization: Bearer <token>". Requests without a valid credential are answered with 401,
+// and requests with a disabled key or a credential whose scope does not include operation with
+// 403. Keys with a signing secret must sign init and push requests. Every request passes when
+// neither API keys nor JWT validation are configured.
+//
+// Parameters:
+//   - operation: The auth.Operation* the route performs.
+//
+// Returns:
+//   - func(http.Handler) http.Handler: The middleware.
+func (az *authorizer) require(operation string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if az.keys == nil && az.jwt == nil {
+			return next
+		}
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			identity, refusal, err := az.authenticate(req, operation)
+			if err != nil {
+				unauthorized(res, err.Error())
+				return
+			}
+
+			if slot, ok := req.Context().Value(credentialSlotKey{}).(*credentialSlot); ok {
+				slot.identity = &identity
+			}
+			if refusal == "" && !identity.Scope.AllowsOperation(operation) {
+				refusal = fmt.Sprintf("%s may not %s metrics", credentialName(identity), operation)
+			}
+			if refusal != "" {
+				az.record(identity, operation, req, errors.New(refusal))
+				writeMetricResponse(res, MetricResponse{
+					Status: http.StatusForbidden,
+					Reason: refusal,
+				})
+				return
+			}
+
+			ctx := auth.NewContext(req.Context(), identity)
+			ctx = context.WithValue(ctx, authorizerKey{}, az)
+			next.ServeHTTP(res, req.WithContext(ctx))
+		})
+	}
+}
+
+// authenticate identifies the client of a request by its signature, JWT or API key.
+//
+// Parameters:
+//   - req: The request.
+//   - operation: The auth.Operation* the route performs.
+//
+// Returns:
+//   - auth.Identity: The client.
+//   - string: Why the client is refused despite being identified, e.g. a disabled key; empty otherwise.
+//   - An error to answer with 401 if the client cannot be identified.
+func (az *authorizer) authenticate(req *http.Request, operation string) (auth.Identity, string, error) {
+	if az.keys != nil && req.Header.Get(auth.SignatureHeader) != "" {
+		key, err := az.verifySignature(req)
+		if err != nil {
+			return auth.Identity{}, "", err
+		}
+		return keyIdentity(key, auth.MethodSignature)
+	}
+
+	credential := requestKey(req)
+	if az.jwt != nil && auth.LooksLikeJWT(credential) {
+		identity, err := az.jwt.Validate(credential, time.Now())
+		if errors.Is(err, auth.ErrNoOperations) {
+			return identity, fmt.Sprintf("%s grants no tallyport operation", credentialName(identity)), nil
+		}
+		if err != nil {
+			az.refuseToken(req, err)
+			return auth.Identity{}, "", err
+		}
+		return identity, "", nil
+	}
+
+	if az.keys == nil {
+		if credential == "" {
+			return auth.Identity{}, "", errors.New("missing bearer token")
+		}
+		return auth.Identity{}, "", errors.New("bearer token is not a JWT")
+	}
+	if credential == "" {
+		return auth.Identity{}, "", errors.New("missing API key")
+	}
+	key, ok := az.keys.Lookup(credential)
+	if !ok {
+		az.logger.Warn().Str("remote", req.RemoteAddr).Str("path", req.URL.Path).Msg("request with unknown API key refused")
+		return auth.Identity{}, "", errors.New("invalid API key")
+	}
+	if key.SigningSecret != "" && (operation == auth.OperationInit || operation == auth.OperationPush) {
+		az.refuseSignature(req, key.ID, "unsigned", errors.New("request is not signed"))
+		return auth.Identity{}, "", fmt.Errorf("API key %s must sign %s requests", key.ID, operation)
+	}
+	return keyIdentity(key, auth.MethodAPIKey)
+}
+
+// keyIdentity returns the identity of a request made with key, refusing it if key is disabled.
+func keyIdentity(key auth.Key, method string) (auth.Identity, string, error) {
+	identity := auth.Identity{ID: key.ID, Method: method, Scope: key.Scope, Tenant: key.Tenant}
+	if key.Disabled {
+		return identity, fmt.Sprintf("API key %s is disabled", key.ID), nil
+	}
+	return identity, "", nil
+}
+
+// credentialName describes the credential of identity in responses.
+func credentialName(identity auth.Identity) string {
+	if identity.Method == auth.MethodJWT {
+		return "token of " + identity.ID
+	}
+	return "API key " + identity.ID
+}
+
+// verifySignature authenticates a signed request: the signature must have been made with the
+// signing secret of the key named in the X-Tallyport-Key-Id header, the timestamp must be
+// within auth_config.signature_max_skew and the nonce must not have been used before. The body
+// is read to check the signature and put back for the handler.
+//
+// Parameters:
+//   - req: The signed request.
+//
+// Returns:
+//   - auth.Key: The key that signed the request.
+//   - An error to answer with 401 if the request cannot be authenticated.
+func (az *authorizer) verifySignature(req *http.Request) (auth.Key, error) {
+	id := req.Header.Get(auth.KeyIDHeader)
+	key, ok := az.keys.LookupID(id)
+	if !ok || key.SigningSecret == "" {
+		az.refuseSignature(req, id, "unknown_key", errors.New("unknown signing key"))
+		return auth.Key{}, fmt.Errorf("unknown signing key %q", id)
+	}
+
+	body, err := io.ReadAll(req.Body)
+	if err != nil {
+		return auth.Key{}, fmt.Errorf("failed to read request body: %w", err)
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+
+	nonce := req.Header.Get(auth.NonceHeader)
+	now := time.Now()
+	path, query := requestTarget(req)
+	var tenant string
+	if az.tenantHeader != "" {
+		tenant = req.Header.Get(az.tenantHeader)
+	}
+	signedAt, err := auth.VerifySignature(key.SigningSecret, req.Method, path, query, tenant,
+		req.Header.Get(auth.TimestampHeader), nonce, body, req.Header.Get(auth.SignatureHeader), now, az.maxSkew)
+	if err == nil {
+		err = az.nonces.Use(key.ID, nonce, signedAt, now, az.maxSkew)
+	}
+	if err != nil {
+		reason := "malformed"
+		switch {
+		case errors.Is(err, auth.ErrStaleTimestamp):
+			reason = "stale"
+		case errors.Is(err, auth.ErrReplayedNonce):
+			reason = "replayed"
+		case errors.Is(err, auth.ErrBadSignature):
+			reason = "invalid"
+		}
+		az.refuseSignature(req, key.ID, reason, err)
+		return auth.Key{}, err
+	}
+	return key, nil
+}
+
+// refuseToken counts and logs a request with a JWT that could not be validated.
+func (az *authorizer) refuseToken(req *http.Request, err error) {
+	reason := "claims"
+	switch {
+	case errors.Is(err, auth.ErrTokenMalformed):
+		reason = "malformed"
+	case errors.Is(err, auth.ErrTokenSignature):
+		reason = "signature"
+	case errors.Is(err, auth.ErrTokenExpired):
+		reason = "expired"
+	case errors.Is(err, auth.ErrTokenIssuer):
+		reason = "issuer"
+	case errors.Is(err, auth.ErrTokenAudience):
+		reason = "audience"
+	}
+	az.tokenFailures.WithLabelValues(reason).Inc()
+	az.logger.Warn().Str("remote", req.RemoteAddr).Str("path", req.URL.Path).Err(err).Msg("request with invalid token refused")
+}
+
+// refuseSignature counts and logs a signed request that could not be authenticated.
+func (az *authorizer) refuseSignature(req *http.Request, keyID, reason string, err error) {
+	az.signatureFailures.WithLabelValues(reason).Inc()
+	az.logger.Warn().Str("key_id", keyID).Str("remote", req.RemoteAddr).Str("path", req.URL.Path).
+		Err(err).Msg("signed request refused")
+}
+
+// record counts and logs a request refused for identity.
+func (az *authorizer) record(identity auth.Identity, operation string, req *http.Request, reason error) {
+	az.denied.WithLabelValues(identity.ID, operation).Inc()
+	az.logger.Warn().Str("key_id", identity.ID).Str("operation", operation).Str("path", req.URL.Path).
+		Err(reason).Msg("request outside the scope of its credential refused")
+}
+
+// authorize checks the metric a request is about to touch against the scope of its credential.
+// Requests that were not authenticated, because no keys are configured, are always allowed.
+//
+// Parameters:
+//   - req: The request, carrying the identity set by authorizer.require.
+//   - operation: The auth.Operation* being performed.
+//   - check: Check of the scope, e.g. auth.Scope.CheckSeries for a series about to be written.
+//
+// Returns:
+//   - An error to answer with 403 if the metric is outside the scope, or nil.
+func authorize(req *http.Request, operation string, check func(auth.Scope) error) error {
+	identity, ok := auth.FromContext(req.Context())
+	if !ok {
+		return nil
+	}
+	err := check(identity.Scope)
+	if err == nil {
+		return nil
+	}
+	if az, ok := req.Context().Value(authorizerKey{}).(*authorizer); ok {
+		az.record(identity, operation, req, err)
+	}
+	return fmt.Errorf("%s may not %s: %w", credentialName(identity), operation, err)
+}
+
+// scopePrefixes narrows the metric name prefixes requested by a client to the ones its
+// credential may read. The second result is false when the client may read none of them.
+func scopePrefixes(req *http.Request, requested []string) ([]string, bool) {
+	identity, ok := auth.FromContext(req.Context())
+	if !ok {
+		return requested, true
+	}
+	return identity.Scope.NarrowPrefixes(requested)
+}
+
+// seriesLabels maps the label values of a push to the label names of its metric definition.
+func seriesLabels(mc *registry.CollectorRegistry, name string, values []string) map[string]string {
+	definition, ok := mc.Definition(name)
+	if !ok {
+		return nil
+	}
+	labels := make(map[string]string, len(definition.Labels))
+	for i, label := range definition.Labels {
+		if i < len(values) {
+			labels[label] = values[i]
+		}
+	}
+	return labels
+}
+
+func forbidden(res http.ResponseWriter, err error) {
+	writeMetricResponse(res, MetricResponse{
+		Status: http.StatusForbidden,
+		Reason: err.Error(),
+	})
+}
+
+// requestTarget returns the path and raw query a client signed: those of the request target as
+// sent, whose path differs from req.URL.Path when the API is mounted under a prefix with
+// http.StripPrefix.
+func requestTarget(req *http.Request) (path, query string) {
+	if req.RequestURI == "" {
+		return req.URL.EscapedPath(), req.URL.RawQuery
+	}
+	path, query, _ = strings.Cut(req.RequestURI, "?")
+	return path, query
+}
+
+// requestKey returns the API key sent with req, or "" when there is none.
+func requestKey(req *http.Request) string {
+	if scheme, credential, ok := strings.Cut(req.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(credential)
+	}
+	return strings.TrimSpace(req.Header.Get(apiKeyHeader))
+}
+
+func unauthorized(res http.ResponseWriter, reason string) {
+	res.Header().Set("WWW-Authenticate", `Bearer realm="tallyport"`)
+	writeMetricResponse(res, MetricResponse{
+		Status: http.StatusUnauthorized,
+		Reason: reason,
+	})
+}
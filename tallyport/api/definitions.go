@@ -0,0 +1,143 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"tallyport/auth"
+	"tallyport/registry"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ListMetricDefinitions returns the definition of every registered metric, sorted by name,
+// in the same shape /init accepts, so the list can be exported and imported again. Clients
+// whose credential is limited to some metric prefixes only see the metrics they cover.
+//
+// Parameters:
+//   - mc: CollectorRegistry holding the definitions.
+//   - reg: Prometheus registry gathered to count the series of every metric.
+//
+// Returns:
+//   - http.HandlerFunc: Handler writing a MetricDefinitionsResponse.
+func ListMetricDefinitions(mc *registry.CollectorRegistry, reg *prometheus.Registry) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		series := seriesCounts(reg)
+		definitions := mc.Definitions()
+
+		response := MetricDefinitionsResponse{
+			Status:  http.StatusOK,
+			Metrics: make([]MetricDescription, 0, len(definitions)),
+		}
+		for _, definition := range definitions {
+			if identity, ok := auth.FromContext(req.Context()); ok && !identity.Scope.AllowsMetric(definition.Name) {
+				continue
+			}
+			response.Metrics = append(response.Metrics, MetricDescription{
+				MetricRequest: definition,
+				Series:        series[definition.Name],
+			})
+		}
+		writeDefinitionsResponse(res, response)
+	})
+}
+
+// DescribeMetric returns the definition of the metric named in the URL.
+//
+// Parameters:
+//   - mc: CollectorRegistry holding the definitions.
+//   - reg: Prometheus registry gathered to count the series of the metric.
+//
+// Returns:
+//   - http.HandlerFunc: Handler writing a MetricDefinitionsResponse with a single metric, or 404.
+func DescribeMetric(mc *registry.CollectorRegistry, reg *prometheus.Registry) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		name := chi.URLParam(req, "name")
+		if err := authorize(req, auth.OperationRead, func(scope auth.Scope) error {
+			return scope.CheckMetric(name)
+		}); err != nil {
+			forbidden(res, err)
+			return
+		}
+
+		definition, exists := mc.Definition(name)
+		if !exists {
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusNotFound,
+				Reason: fmt.Sprintf("metric not found: %s", name),
+			})
+			return
+		}
+
+		writeDefinitionsResponse(res, MetricDefinitionsResponse{
+			Status: http.StatusOK,
+			Metrics: []MetricDescription{{
+				MetricRequest: definition,
+				Series:        seriesCounts(reg)[name],
+			}},
+		})
+	})
+}
+
+// DeleteMetric unregisters the metric named in the URL and drops all of its series.
+// The name can be registered again with /init afterwards.
+//
+// Parameters:
+//   - mc: CollectorRegistry the metric is removed from.
+//   - reg: Prometheus registry the metric is unregistered from.
+//
+// Returns:
+//   - http.HandlerFunc: Handler deleting the metric, answering 404 for unknown metrics.
+func DeleteMetric(mc *registry.CollectorRegistry, reg *prometheus.Registry) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		name := chi.URLParam(req, "name")
+		if err := authorize(req, auth.OperationDelete, func(scope auth.Scope) error {
+			return scope.CheckMetric(name)
+		}); err != nil {
+			forbidden(res, err)
+			return
+		}
+
+		metricType, exists := mc.TypeOf(name)
+		collector, _ := mc.Collector(name)
+		if !exists || collector == nil {
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusNotFound,
+				Reason: fmt.Sprintf("metric not found: %s", name),
+			})
+			return
+		}
+
+		reg.Unregister(collector)
+		mc.Remove(metricType, name)
+
+		writeMetricResponse(res, MetricResponse{
+			Status:  http.StatusOK,
+			Message: fmt.Sprintf("Metric %s deleted successfully", name),
+		})
+	})
+}
+
+// seriesCounts gathers reg and returns the number of series of every metric family.
+func seriesCounts(reg prometheus.Gatherer) map[string]int {
+	families, _ := reg.Gather()
+	counts := make(map[string]int, len(families))
+	for _, family := range families {
+		counts[family.GetName()] = len(family.GetMetric())
+	}
+	return counts
+}
+
+func writeDefinitionsResponse(res http.ResponseWriter, response MetricDefinitionsResponse) {
+	raw, err := json.Marshal(response)
+	if err != nil {
+		http.Error(res, fmt.Sprintf("failed to marshal response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Content-Length", strconv.FormatInt(int64(len(raw)), 10))
+	res.WriteHeader(response.Status)
+	res.Write(raw)
+}
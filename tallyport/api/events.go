@@ -0,0 +1,106 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"tallyport/auth"
+	"tallyport/config"
+	"tallyport/registry"
+	"time"
+)
+
+const (
+	// eventDefaultBufferSize is used when event_config.buffer_size is not set.
+	eventDefaultBufferSize = 256
+	// eventDefaultKeepAlive is used when event_config.keep_alive is not set.
+	eventDefaultKeepAlive = 15 * time.Second
+)
+
+// StreamMetricEvents serves the Server-Sent Events feed of metric updates.
+//
+// Every update applied to the registry is sent as an "update" event whose data is a JSON
+// encoded MetricEvent. Clients narrow the feed with one or more "prefix" query parameters,
+// e.g. /events?prefix=app_&prefix=checkout_. A comment line is written every keep_alive
+// milliseconds so proxies keep idle connections open. Clients whose credential is limited to
+// some metric prefixes or label values only receive updates of the series it covers.
+//
+// Parameters:
+//   - mc: CollectorRegistry whose updates are streamed.
+//   - cfg: Server configuration, of which event_config is used.
+//
+// Returns:
+//   - http.HandlerFunc: Handler serving the event stream.
+func StreamMetricEvents(mc *registry.CollectorRegistry, cfg config.TallyPortConfig) http.HandlerFunc {
+	bufferSize := cfg.EventConfig.BufferSize
+	if bufferSize <= 0 {
+		bufferSize = eventDefaultBufferSize
+	}
+
+	keepAlive := time.Duration(cfg.EventConfig.KeepAlive * int64(time.Millisecond))
+	if keepAlive <= 0 {
+		keepAlive = eventDefaultKeepAlive
+	}
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		flusher, ok := res.(http.Flusher)
+		if !ok {
+			http.Error(res, "streaming unsupported", http.StatusInternalServerError)
+			return
+		}
+
+		var prefixes []string
+		for _, prefix := range req.URL.Query()["prefix"] {
+			if prefix = strings.TrimSpace(prefix); prefix != "" {
+				prefixes = append(prefixes, prefix)
+			}
+		}
+
+		prefixes, ok = scopePrefixes(req, prefixes)
+		if !ok {
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusForbidden,
+				Reason: "none of the requested prefixes can be read with this credential",
+			})
+			return
+		}
+
+		identity, scoped := auth.FromContext(req.Context())
+
+		subscriber := mc.Events().Subscribe(prefixes, bufferSize)
+		defer mc.Events().Unsubscribe(subscriber)
+
+		res.Header().Set("Content-Type", "text/event-stream")
+		res.Header().Set("Connection", "keep-alive")
+		res.WriteHeader(http.StatusOK)
+		flusher.Flush()
+
+		ticker := time.NewTicker(keepAlive)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case event := <-subscriber.Events():
+				if scoped && identity.Scope.CheckSeries(event.Name, event.Labels) != nil {
+					continue
+				}
+				raw, err := json.Marshal(event)
+				if err != nil {
+					continue
+				}
+				if _, err := fmt.Fprintf(res, "event: update\ndata: %s\n\n", raw); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-ticker.C:
+				if _, err := fmt.Fprint(res, ": keep-alive\n\n"); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-req.Context().Done():
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,681 @@
+// Package api serves the tallyport HTTP API on top of a registry.CollectorRegistry.
+//
+// NewHandler builds the complete API from a configuration, so tallyport can be mounted inside
+// another Go binary instead of running as a separate server:
+//
+//	handler, err := api.NewHandler(cfg, prometheus.NewRegistry(), logger)
+//	if err != nil {
+//		return err
+//	}
+//	handler.Start()
+//	defer handler.Stop()
+//	mux.Handle("/tallyport/", http.StripPrefix("/tallyport", handler))
+//
+// The middleware settings and routes can be replaced at runtime with Reload or ReloadFile
+// without losing any metrics.
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"tallyport/auth"
+	"tallyport/config"
+	"tallyport/registry"
+	"tallyport/remotewrite"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+)
+
+// Handler serves the tallyport HTTP API and owns the background workers enabled in its
+// configuration: the ingest buffer, the async push queue and the remote writer.
+type Handler struct {
+	router       atomic.Pointer[chi.Mux]
+	registry     *registry.CollectorRegistry
+	buffer       *registry.IngestBuffer
+	queue        *PushQueue
+	keyQuotas    *registry.KeyQuotas
+	remoteWriter *remotewrite.RemoteWriter
+	reg          *prometheus.Registry
+	logger       zerolog.Logger
+
+	// tenants are created on first use when tenant_config is enabled; gatherer exports reg along
+	// with every tenant.
+	tenants  tenantSet
+	gatherer prometheus.Gatherer
+
+	// reloadMu serialises reloads; cfg is the configuration the current router was built from.
+	reloadMu sync.Mutex
+	cfg      config.TallyPortConfig
+
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	denied   *prometheus.CounterVec
+	// refusedAddresses counts requests refused by ip_access_config.
+	refusedAddresses *prometheus.CounterVec
+
+	// nonces outlives reloads, so a reload cannot be used to replay a signed request.
+	nonces            *auth.NonceCache
+	signatureFailures *prometheus.CounterVec
+
+	// jwt validates bearer tokens; its JWKS file is watched by jwksWatcher while started.
+	// started is changed under both reloadMu and tenants.mu, so tenant buffers start with the rest.
+	jwt           atomic.Pointer[auth.JWTValidator]
+	jwksWatcher   *config.Watcher
+	jwksPath      string
+	started       atomic.Bool
+	tokenFailures *prometheus.CounterVec
+	jwksReloads   *prometheus.CounterVec
+
+	reloads             *prometheus.CounterVec
+	lastReloadSucceeded prometheus.Gauge
+	lastReloadSuccess   prometheus.Gauge
+}
+
+// NewHandler creates the tallyport API described by cfg. Metrics created through the API, as
+// well as tallyport's own request, buffer, queue and remote write metrics, are registered with
+// reg, which is also what the export path serves. Background workers only run between Start
+// and Stop.
+//
+// Parameters:
+//   - cfg: Server configuration.
+//   - reg: Prometheus registry for registering and exporting metrics.
+//   - logger: Logger used for access logs and by the background workers.
+//
+// Returns:
+//   - *Handler: The API, ready to be served as an http.Handler.
+//   - An error if cfg is invalid, a component cannot be configured or its metrics cannot be registered.
+func NewHandler(cfg config.TallyPortConfig, reg *prometheus.Registry, logger zerolog.Logger) (*Handler, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	h := &Handler{
+		registry: registry.NewCollectorRegistry(),
+		reg:      reg,
+		gatherer: reg,
+		logger:   logger,
+		cfg:      cfg,
+		requests: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "__tallyport__",
+				Subsystem: "pushgateway",
+				Name:      "tally_port_requests_total",
+				Help:      "Track number of metrics processed by tallyport",
+			},
+			[]string{"method", "endpoint", "status"},
+		),
+		latency: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: "__tallyport__",
+				Subsystem: "pushgateway",
+				Name:      "request_latency_seconds",
+				Help:      "Request latency in seconds",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"method", "endpoint"},
+		),
+		denied: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "__tallyport__",
+				Subsystem: "auth",
+				Name:      "denied_requests_total",
+				Help:      "Requests refused because they are outside the scope of their credential",
+			},
+			[]string{"key_id", "operation"},
+		),
+		refusedAddresses: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "__tallyport__",
+				Subsystem: "access",
+				Name:      "refused_requests_total",
+				Help:      "Requests refused because their client address is not allowed on the route",
+			},
+			[]string{"route"},
+		),
+		nonces: auth.NewNonceCache(cfg.AuthConfig.NonceCacheSize),
+		signatureFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "__tallyport__",
+				Subsystem: "auth",
+				Name:      "signature_failures_total",
+				Help:      "Signed requests refused by reason (stale, replayed, invalid, malformed, unknown_key or unsigned)",
+			},
+			[]string{"reason"},
+		),
+		tokenFailures: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "__tallyport__",
+				Subsystem: "auth",
+				Name:      "token_failures_total",
+				Help:      "Requests with a JWT refused by reason (malformed, signature, expired, issuer, audience or claims)",
+			},
+			[]string{"reason"},
+		),
+		jwksReloads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "__tallyport__",
+				Subsystem: "auth",
+				Name:      "jwks_reloads_total",
+				Help:      "Reloads of the JWKS file after it changed, by result (success or failure)",
+			},
+			[]string{"result"},
+		),
+		reloads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "__tallyport__",
+				Subsystem: "config",
+				Name:      "reloads_total",
+				Help:      "Configuration reloads by result (success or failure)",
+			},
+			[]string{"result"},
+		),
+		lastReloadSucceeded: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "config",
+			Name:      "last_reload_successful",
+			Help:      "Whether the last configuration reload attempt succeeded",
+		}),
+		lastReloadSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "config",
+			Name:      "last_reload_success_timestamp_seconds",
+			Help:      "Timestamp of the last successful configuration reload",
+		}),
+	}
+	for _, collector := range []prometheus.Collector{
+		h.requests, h.latency, h.denied, h.refusedAddresses, h.signatureFailures, h.tokenFailures, h.jwksReloads, h.reloads, h.lastReloadSucceeded, h.lastReloadSuccess,
+	} {
+		if err := reg.Register(collector); err != nil {
+			return nil, fmt.Errorf("failed to register request metric: %w", err)
+		}
+	}
+
+	if cfg.TenantConfig.Enabled {
+		h.gatherer = prometheus.Gatherers{reg, tenantGatherer{tenants: &h.tenants, label: cfg.TenantConfig.Label}}
+	}
+
+	var err error
+	if cfg.QuotaConfig.Enabled {
+		if err = h.registry.EnableQuota(quotaOf(cfg.Quota("")), reg); err != nil {
+			return nil, err
+		}
+		h.keyQuotas = registry.NewKeyQuotas(keyQuotasOf(cfg))
+		if err = reg.Register(h.keyQuotas); err != nil {
+			return nil, fmt.Errorf("failed to register key quota metric: %w", err)
+		}
+		h.registry.EnableKeyQuotas(h.keyQuotas, "")
+	}
+	if cfg.BufferConfig.Enabled {
+		if h.buffer, err = h.registry.EnableBuffer(cfg, reg); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.AsyncConfig.Enabled {
+		if h.queue, err = NewPushQueue(cfg, reg, logger); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.RemoteWriteConfig.URL != "" {
+		if h.remoteWriter, err = remotewrite.NewRemoteWriter(cfg, h.gatherer, reg, logger); err != nil {
+			return nil, err
+		}
+	}
+
+	keys, err := loadKeys(cfg)
+	if err != nil {
+		return nil, err
+	}
+	validator, err := loadJWT(cfg)
+	if err != nil {
+		return nil, err
+	}
+	guard, err := loadExportGuard(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	access, err := loadIPAccess(cfg, h.refusedAddresses, logger)
+	if err != nil {
+		return nil, err
+	}
+	streamTokens, err := loadStreamTokens(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	h.jwt.Store(validator)
+	h.router.Store(h.routes(cfg, reg, keys, validator, guard, access, streamTokens))
+	h.lastReloadSucceeded.Set(1)
+	h.lastReloadSuccess.SetToCurrentTime()
+	return h, nil
+}
+
+// ServeHTTP dispatches the request to the tallyport routes.
+func (h *Handler) ServeHTTP(res http.ResponseWriter, req *http.Request) {
+	h.router.Load().ServeHTTP(res, req)
+}
+
+// Reload validates cfg and atomically replaces the routes and their middleware settings (CORS
+// headers, request limits, throttle, rate limit and endpoint paths) with ones built from it.
+// Requests already in flight finish with the previous settings, and metrics are kept.
+//
+// The rate limit starts counting from zero again after a reload, while quota limits apply to
+// the usage counted so far and keys that get a quota start counting from zero. server_config,
+// tls_server_config, buffer_config, async_config, remote_write_config, tenant_config and
+// quota_config.enabled only take effect on restart; changes to them are logged and otherwise
+// ignored.
+//
+// Parameters:
+//   - cfg: The new server configuration.
+//
+// Returns:
+//   - An error if cfg is invalid, in which case the current settings stay in place.
+func (h *Handler) Reload(cfg config.TallyPortConfig) error {
+	h.reloadMu.Lock()
+	defer h.reloadMu.Unlock()
+
+	if err := cfg.Validate(); err != nil {
+		h.recordReload(false)
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	for _, section := range []struct {
+		key        string
+		prev, next any
+	}{
+		{"server_config", h.cfg.ServerConfig, cfg.ServerConfig},
+		{"tls_server_config", h.cfg.TLSServerConfig, cfg.TLSServerConfig},
+		{"buffer_config", h.cfg.BufferConfig, cfg.BufferConfig},
+		{"async_config", h.cfg.AsyncConfig, cfg.AsyncConfig},
+		{"remote_write_config", h.cfg.RemoteWriteConfig, cfg.RemoteWriteConfig},
+		{"tenant_config", h.cfg.TenantConfig, cfg.TenantConfig},
+	} {
+		if !reflect.DeepEqual(section.prev, section.next) {
+			h.logger.Warn().Msgf("%s changed and only takes effect after a restart", section.key)
+		}
+	}
+
+	keys, err := loadKeys(cfg)
+	if err != nil {
+		h.recordReload(false)
+		return err
+	}
+	validator, err := loadJWT(cfg)
+	if err != nil {
+		h.recordReload(false)
+		return err
+	}
+	guard, err := loadExportGuard(cfg, h.logger)
+	if err != nil {
+		h.recordReload(false)
+		return err
+	}
+	access, err := loadIPAccess(cfg, h.refusedAddresses, h.logger)
+	if err != nil {
+		h.recordReload(false)
+		return err
+	}
+	streamTokens, err := loadStreamTokens(cfg)
+	if err != nil {
+		h.recordReload(false)
+		return err
+	}
+
+	h.nonces.Resize(cfg.AuthConfig.NonceCacheSize)
+	h.jwt.Store(validator)
+	// tenant_config only takes effect on restart, so the routes keep serving the tenants.
+	cfg.TenantConfig = h.cfg.TenantConfig
+	// Quotas cannot be turned on or off for metrics already counted, only their limits change.
+	if cfg.QuotaConfig.Enabled != h.cfg.QuotaConfig.Enabled {
+		h.logger.Warn().Msg("quota_config.enabled changed and only takes effect after a restart")
+		cfg.QuotaConfig.Enabled = h.cfg.QuotaConfig.Enabled
+	}
+	h.registry.SetQuota(quotaOf(cfg.Quota("")))
+	for _, t := range h.tenants.all() {
+		t.registry.SetQuota(quotaOf(cfg.Quota(t.name)))
+	}
+	if h.keyQuotas != nil {
+		h.keyQuotas.SetLimits(keyQuotasOf(cfg))
+	}
+	h.router.Store(h.routes(cfg, h.reg, keys, validator, guard, access, streamTokens))
+	if h.started.Load() {
+		h.watchJWKS()
+	}
+	h.cfg = cfg
+	h.recordReload(true)
+	return nil
+}
+
+// ReloadFile loads the configuration file at path and applies it with Reload.
+//
+// Parameters:
+//   - path: Location of the configuration file.
+//
+// Returns:
+//   - An error if the file cannot be loaded or is invalid, in which case the current settings stay in place.
+func (h *Handler) ReloadFile(path string) error {
+	cfg, err := config.Load(path)
+	if err != nil {
+		h.recordReload(false)
+		return err
+	}
+	return h.Reload(cfg)
+}
+
+func (h *Handler) recordReload(succeeded bool) {
+	if !succeeded {
+		h.reloads.WithLabelValues("failure").Inc()
+		h.lastReloadSucceeded.Set(0)
+		return
+	}
+	h.reloads.WithLabelValues("success").Inc()
+	h.lastReloadSucceeded.Set(1)
+	h.lastReloadSuccess.SetToCurrentTime()
+}
+
+// Registry returns the CollectorRegistry the API writes to.
+func (h *Handler) Registry() *registry.CollectorRegistry {
+	return h.registry
+}
+
+// Start launches the configured background workers and watches the JWKS file.
+func (h *Handler) Start() {
+	h.reloadMu.Lock()
+	h.tenants.mu.Lock()
+	h.started.Store(true)
+	for _, t := range h.tenants.tenants {
+		if t.buffer != nil {
+			t.buffer.Start()
+		}
+	}
+	h.tenants.mu.Unlock()
+	h.watchJWKS()
+	h.reloadMu.Unlock()
+
+	if h.buffer != nil {
+		h.buffer.Start()
+	}
+	if h.queue != nil {
+		h.queue.Start()
+	}
+	if h.remoteWriter != nil {
+		h.remoteWriter.Start()
+	}
+}
+
+// Stop stops the background workers once the handler no longer receives requests.
+func (h *Handler) Stop() {
+	h.reloadMu.Lock()
+	h.tenants.mu.Lock()
+	h.started.Store(false)
+	h.tenants.mu.Unlock()
+	h.watchJWKS()
+	h.reloadMu.Unlock()
+
+	// Drain queued pushes before the buffers' final flush so none of them are lost.
+	if h.queue != nil {
+		h.queue.Stop()
+	}
+	if h.buffer != nil {
+		h.buffer.Stop()
+	}
+	for _, t := range h.tenants.all() {
+		if t.buffer != nil {
+			t.buffer.Stop()
+		}
+	}
+	if h.remoteWriter != nil {
+		h.remoteWriter.Stop()
+	}
+}
+
+// watchJWKS watches the JWKS file of the current JWT validator while the handler is started,
+// replacing the watcher of a previous file. Callers hold reloadMu.
+func (h *Handler) watchJWKS() {
+	var path string
+	if validator := h.jwt.Load(); validator != nil && h.started.Load() {
+		path = validator.JWKSFile()
+	}
+	if path == h.jwksPath {
+		return
+	}
+	if h.jwksWatcher != nil {
+		h.jwksWatcher.Stop()
+		h.jwksWatcher = nil
+	}
+	h.jwksPath = path
+	if path == "" {
+		return
+	}
+
+	watcher, err := config.NewWatcher(path, h.reloadJWKS, h.logger)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("failed to watch the JWKS file, it is only re-read on configuration reloads")
+		return
+	}
+	watcher.Start()
+	h.jwksWatcher = watcher
+}
+
+// reloadJWKS re-reads the JWKS file after it changed, keeping the current keys if it is invalid.
+func (h *Handler) reloadJWKS() {
+	validator := h.jwt.Load()
+	if validator == nil {
+		return
+	}
+	if err := validator.Reload(); err != nil {
+		h.jwksReloads.WithLabelValues("failure").Inc()
+		h.logger.Error().Err(err).Msg("JWKS reload failed, keeping the current keys")
+		return
+	}
+	h.jwksReloads.WithLabelValues("success").Inc()
+	h.logger.Info().Msgf("JWKS reloaded from %s", validator.JWKSFile())
+}
+
+// routes configures and returns a chi router for handling Prometheus metric operations.
+// It sets up middleware for request handling, metrics collection, and endpoints for initializing and pushing metrics.
+// The router includes:
+// - /metrics: Exposes Prometheus metrics for scraping.
+// - /init: Initializes a new metric (counter, gauge, histogram, or summary).
+// - /push: Updates an existing metric with new values or observations, or queues the update when async_config is enabled.
+// - /definitions: Lists, describes (/definitions/{name}) and deletes (DELETE /definitions/{name}) registered metrics.
+// - /quota: Reports the quotas of the tenant of the request and their remaining budget (when configured).
+// - stream_config.path: WebSocket endpoint streaming pushes over a single connection (when configured).
+// - remote_write_receiver_path: Prometheus remote write receiver (when configured).
+// - ingest_config.path: Prometheus text and OpenMetrics exposition ingestion (when configured).
+// - event_config.path: Server-Sent Events feed of metric updates (when configured).
+// - tenant_config.export_path_prefix/{tenant}/metrics: Metrics of a single tenant (when configured).
+//
+// When tenant_config is enabled, every endpoint serves the tenant of the request, and the export
+// path serves the metrics of every tenant, each series labelled with the tenant it belongs to.
+//
+// When API keys or JWT validation are configured, every endpoint except the export and heartbeat
+// paths requires a credential whose scope allows the operation of the endpoint: init, push,
+// delete or read. Stream connections authenticate their upgrade request and each pushed frame
+// is checked against the scope of its credential; stream_config.tokens additionally requires
+// the authentication frame to carry one of the stream tokens. Keys with a signing secret sign their init and push requests instead of sending the key.
+// The export paths, and the heartbeat if export_auth_config.heart_beat is set, are protected by the
+// basic auth users and bearer tokens of export_auth_config instead. Each route limits the
+// requests of every client, identified after authentication, to its rate limit, and every
+// address is limited to rate_limit_config.address_per_minute before authentication. Routes with a
+// rule in ip_access_config.routes refuse client addresses outside it before authentication.
+//
+// Parameters:
+//   - cfg: Server configuration
+//   - reg: Prometheus registry for registering metrics.
+//   - keys: API keys accepted by the endpoints, or nil.
+//   - validator: JWT validator for bearer tokens, or nil; the endpoints are open when both are nil.
+//   - guard: Credentials required by the export paths.
+//   - access: Client addresses allowed on each route.
+//   - streamTokens: Tokens accepted in the authentication frame of stream connections, or nil.
+//
+// Returns:
+//   - *chi.Mux: Configured chi router instance.
+func (h *Handler) routes(cfg config.TallyPortConfig, reg *prometheus.Registry, keys *auth.KeyStore, validator *auth.JWTValidator, guard *exportGuard, access *ipAccess, streamTokens *auth.KeyStore) *chi.Mux {
+	az := &authorizer{
+		keys:              keys,
+		denied:            h.denied,
+		logger:            h.logger,
+		nonces:            h.nonces,
+		maxSkew:           time.Duration(cfg.AuthConfig.SignatureMaxSkew) * time.Millisecond,
+		tenantHeader:      cfg.TenantConfig.Header,
+		signatureFailures: h.signatureFailures,
+		jwt:               validator,
+		tokenFailures:     h.tokenFailures,
+	}
+
+	limits := newRateLimiter(cfg)
+
+	r := chi.NewRouter()
+	r.Use(middleware.RequestID)
+	r.Use(access.realIP)
+	r.Use(middleware.NoCache)
+	r.Use(withCredentialSlot)
+	r.Use(middleware.RequestLogger(accessLogFormatter{logger: h.logger}))
+	r.Use(middleware.Recoverer)
+	r.Use(corsMiddleware(cfg))
+	// The heartbeat has no route, so it must answer before unknown paths are refused.
+	if cfg.ExportAuthConfig.HeartBeat {
+		r.Use(guard.protectHeartbeat(cfg.HeartBeatPath))
+	}
+	r.Use(middleware.Heartbeat(cfg.HeartBeatPath))
+	r.Use(middleware.SupressNotFound(r))
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.RequestSize(cfg.RequestConfig.Size))
+		r.Use(middleware.Timeout(time.Duration(cfg.RequestConfig.Timeout) * time.Millisecond))
+		r.Use(middleware.ThrottleWithOpts(middleware.ThrottleOpts{
+			Limit:          cfg.ThrottleConfig.LimitSize,
+			BacklogLimit:   cfg.ThrottleConfig.BacklogLimit,
+			StatusCode:     cfg.ThrottleConfig.StatusCode,
+			BacklogTimeout: cfg.ThrottleConfig.BacklogTimeout,
+		}))
+		r.Use(h.trackRequestMetric)
+		r.Use(limits.byAddress())
+
+		// TODO:  Work on metric removal with access time idea
+		r.With(access.allow(cfg.MetricExportPath)).Handle(cfg.MetricExportPath, guard.protect(limits.limit(cfg.MetricExportPath)(
+			promhttp.HandlerFor(h.gatherer, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}))))
+
+		if route := cfg.TenantExportRoute(); route != "" {
+			r.With(access.allow(route)).Get(route, guard.protect(limits.limit(route)(http.HandlerFunc(h.exportTenant))).ServeHTTP)
+		}
+
+		r.Group(func(r chi.Router) {
+			r.Use(middleware.AllowContentType("application/json"))
+			r.With(access.allow("/push"), az.require(auth.OperationPush), limits.limit("/push")).Post("/push", h.tenanted(cfg, true, func(t *tenant) http.Handler {
+				return PushStatRestMetric(t.registry, t.reg, h.queue)
+			}).ServeHTTP)
+			r.With(access.allow("/init"), az.require(auth.OperationInit), limits.limit("/init")).Post("/init", h.tenanted(cfg, true, func(t *tenant) http.Handler {
+				return RegisterRestMetric(t.registry, t.reg)
+			}).ServeHTTP)
+		})
+
+		r.With(access.allow("/definitions"), az.require(auth.OperationRead), limits.limit("/definitions")).Get("/definitions", h.tenanted(cfg, false, func(t *tenant) http.Handler {
+			return ListMetricDefinitions(t.registry, t.reg)
+		}).ServeHTTP)
+		r.With(access.allow("/definitions/{name}"), az.require(auth.OperationRead), limits.limit("/definitions/{name}")).Get("/definitions/{name}", h.tenanted(cfg, false, func(t *tenant) http.Handler {
+			return DescribeMetric(t.registry, t.reg)
+		}).ServeHTTP)
+		r.With(access.allow("/quota"), az.require(auth.OperationRead), limits.limit("/quota")).Get("/quota", h.tenanted(cfg, false, func(t *tenant) http.Handler {
+			return ReadQuota(t.registry, t.name, h.keyQuotas)
+		}).ServeHTTP)
+		r.With(access.allow("/definitions/{name}"), az.require(auth.OperationDelete), limits.limit("/definitions/{name}")).Delete("/definitions/{name}", h.tenanted(cfg, false, func(t *tenant) http.Handler {
+			return DeleteMetric(t.registry, t.reg)
+		}).ServeHTTP)
+
+		if cfg.RemoteWriteReceiverPath != "" {
+			r.With(access.allow(cfg.RemoteWriteReceiverPath), middleware.AllowContentType("application/x-protobuf"), az.require(auth.OperationPush),
+				limits.limit(cfg.RemoteWriteReceiverPath)).
+				Post(cfg.RemoteWriteReceiverPath, h.tenanted(cfg, true, func(t *tenant) http.Handler {
+					return ReceiveRemoteWrite(t.registry, t.reg)
+				}).ServeHTTP)
+		}
+
+		if cfg.IngestConfig.Path != "" {
+			r.With(access.allow(cfg.IngestConfig.Path), middleware.AllowContentType(
+				"text/plain", "application/openmetrics-text", "application/vnd.google.protobuf"), az.require(auth.OperationPush),
+				limits.limit(cfg.IngestConfig.Path)).
+				Post(cfg.IngestConfig.Path, h.tenanted(cfg, true, func(t *tenant) http.Handler {
+					return IngestExposition(t.registry, t.reg, cfg)
+				}).ServeHTTP)
+		}
+	})
+
+	// Stream connections are long-lived, so they bypass the request timeout, the throttle
+	// and the route rate limit. Each connection is rate limited on its own instead.
+	if cfg.StreamConfig.Path != "" {
+		r.Group(func(r chi.Router) {
+			r.Use(h.trackRequestMetric)
+			r.Use(limits.byAddress())
+			r.Use(access.allow(cfg.StreamConfig.Path))
+			r.Use(az.require(auth.OperationPush))
+			r.Get(cfg.StreamConfig.Path, h.tenanted(cfg, true, func(t *tenant) http.Handler {
+				return StreamRestMetric(t.registry, cfg, streamTokens, h.requests)
+			}).ServeHTTP)
+		})
+	}
+
+	// The event feed is long-lived as well and only ever written to by the server.
+	if cfg.EventConfig.Path != "" {
+		r.Group(func(r chi.Router) {
+			r.Use(h.trackRequestMetric)
+			r.Use(limits.byAddress())
+			r.Use(access.allow(cfg.EventConfig.Path))
+			r.Use(az.require(auth.OperationRead))
+			r.Get(cfg.EventConfig.Path, h.tenanted(cfg, false, func(t *tenant) http.Handler {
+				return StreamMetricEvents(t.registry, cfg)
+			}).ServeHTTP)
+		})
+	}
+
+	return r
+}
+
+func corsMiddleware(cfg config.TallyPortConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, header := range cfg.CorsConfig.Headers {
+				w.Header().Set(header.Key, header.Value)
+			}
+
+			if r.Method == "OPTIONS" {
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// trackRequestMetric counts requests and their latency by method, route and status. Requests
+// are labelled with the route pattern, e.g. /definitions/{name}, rather than their path, so
+// clients cannot create a series for every metric or tenant name they send.
+func (h *Handler) trackRequestMetric(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		method := req.Method
+		ww := middleware.NewWrapResponseWriter(res, req.ProtoMajor)
+		next.ServeHTTP(ww, req)
+		status := fmt.Sprintf("%d", ww.Status())
+		// Routes are only known once the request has been routed. Every route is registered on
+		// the root router, so the last pattern is the whole one; SupressNotFound matches the
+		// request once more, which repeats it.
+		endpoint := "unmatched"
+		if patterns := chi.RouteContext(req.Context()).RoutePatterns; len(patterns) > 0 {
+			endpoint = patterns[len(patterns)-1]
+		}
+
+		h.requests.WithLabelValues(method, endpoint, status).Inc()
+		h.latency.WithLabelValues(method, endpoint).Observe(time.Since(start).Seconds())
+
+	})
+}
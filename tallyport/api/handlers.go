@@ -1,19 +1,23 @@
-package main
+package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strconv"
+	"tallyport/auth"
+	"tallyport/registry"
+	"tallyport/validation"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-func RegisterRestMetric(mc *CollectorRegistry, reg *prometheus.Registry) http.HandlerFunc {
+func RegisterRestMetric(mc *registry.CollectorRegistry, reg *prometheus.Registry) http.HandlerFunc {
 	return http.HandlerFunc(
 		func(res http.ResponseWriter, req *http.Request) {
-			var metricReq MetricRequest
+			var metricReq registry.MetricRequest
 
 			err := parseRequestBody(req, &metricReq)
 			if err != nil {
@@ -33,11 +37,11 @@ func RegisterRestMetric(mc *CollectorRegistry, reg *prometheus.Registry) http.Ha
 				return
 			}
 
-			validator := NewValidator(metricReq)
+			validator := validation.NewValidator(metricReq)
 			validationErr := validator.
-				ValidateField("Name", IsEmpty).
-				ValidateField("Type", IsEmpty,
-					IsSupported(_COUNTER_, _GAUGE_, _HISTOGRAM_, _SUMMARY_)).
+				ValidateField("Name", validation.IsEmpty).
+				ValidateField("Type", validation.IsEmpty,
+					validation.IsSupported(registry.TypeCounter, registry.TypeGauge, registry.TypeHistogram, registry.TypeSummary)).
 				Errors()
 
 			if validationErr != nil {
@@ -62,10 +66,24 @@ func RegisterRestMetric(mc *CollectorRegistry, reg *prometheus.Registry) http.Ha
 				return
 			}
 
-			collector, err := mc.register(metricReq)
+			if err := authorize(req, auth.OperationInit, func(scope auth.Scope) error {
+				return scope.CheckDefinition(metricReq.Name, metricReq.Labels)
+			}); err != nil {
+				forbidden(res, err)
+				return
+			}
+
+			collector, err := mc.RegisterAs(quotaKey(req), metricReq)
 			if err != nil {
+				if quotaExceeded(res, err) {
+					return
+				}
+				status := http.StatusBadRequest
+				if errors.Is(err, registry.ErrMetricExists) {
+					status = http.StatusConflict
+				}
 				response := MetricResponse{
-					Status: http.StatusBadRequest,
+					Status: status,
 					Reason: err.Error(),
 				}
 				raw, err := response.ToJSON()
@@ -73,7 +91,7 @@ func RegisterRestMetric(mc *CollectorRegistry, reg *prometheus.Registry) http.Ha
 					http.Error(res, fmt.Sprintf("failed to marshal error response: %v", err), http.StatusInternalServerError)
 					return
 				}
-				res.WriteHeader(http.StatusBadRequest)
+				res.WriteHeader(status)
 				res.Header().Set("Content-Type", "application/json")
 				res.Header().Set("Content-Length", strconv.FormatInt(int64(len(raw)), 10))
 				res.Write(raw)
@@ -81,6 +99,7 @@ func RegisterRestMetric(mc *CollectorRegistry, reg *prometheus.Registry) http.Ha
 			}
 
 			if err = reg.Register(collector); err != nil {
+				mc.Remove(metricReq.Type, metricReq.Name)
 				response := MetricResponse{
 					Status: http.StatusInternalServerError,
 					Reason: fmt.Sprintf("failed to register metric: %v", err),
@@ -113,9 +132,9 @@ func RegisterRestMetric(mc *CollectorRegistry, reg *prometheus.Registry) http.Ha
 		})
 }
 
-func PushStatRestMetric(mc *CollectorRegistry, reg *prometheus.Registry) http.HandlerFunc {
+func PushStatRestMetric(mc *registry.CollectorRegistry, reg *prometheus.Registry, queue *PushQueue) http.HandlerFunc {
 	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
-		var metricReq MetricRequest
+		var metricReq registry.MetricRequest
 
 		err := parseRequestBody(req, &metricReq)
 		if err != nil {
@@ -135,12 +154,7 @@ func PushStatRestMetric(mc *CollectorRegistry, reg *prometheus.Registry) http.Ha
 			return
 		}
 
-		validator := NewValidator(metricReq)
-		validationErr := validator.
-			ValidateField("Type", IsEmpty).
-			ValidateField("Name", IsEmpty).Errors()
-
-		if validationErr != nil {
+		if validationErr := validatePushRequest(metricReq); validationErr != nil {
 			raw, err := validationErr.ToJSON()
 			if err != nil {
 				http.Error(res, err.Error(), http.StatusBadRequest)
@@ -162,9 +176,60 @@ func PushStatRestMetric(mc *CollectorRegistry, reg *prometheus.Registry) http.Ha
 			return
 		}
 
-		if err = mc.update(metricReq); err != nil {
+		if err := authorize(req, auth.OperationPush, func(scope auth.Scope) error {
+			return scope.CheckSeries(metricReq.Name, seriesLabels(mc, metricReq.Name, metricReq.Labels))
+		}); err != nil {
+			forbidden(res, err)
+			return
+		}
+
+		// In async mode only the checks that do not touch the metric vectors are done inline;
+		// label errors surface in the worker logs and __tallyport___async_failed_pushes_total.
+		if queue != nil {
+			if metricType, exists := mc.TypeOf(metricReq.Name); !exists || metricType != metricReq.Type {
+				writeMetricResponse(res, MetricResponse{
+					Status: http.StatusNotFound,
+					Reason: fmt.Sprintf("%s %v: {%s}", metricReq.Type, registry.ErrMetricNotFound, metricReq.Name),
+				})
+				return
+			}
+			if _, err := mc.CheckValue(metricReq); err != nil {
+				writeMetricResponse(res, MetricResponse{
+					Status: http.StatusBadRequest,
+					Reason: err.Error(),
+				})
+				return
+			}
+			// The worker charges the quotas; pushes racing for the last of a budget are only
+			// refused there.
+			if err := mc.CheckQuota(quotaKey(req), metricReq); quotaExceeded(res, err) {
+				return
+			}
+			if err := queue.enqueue(mc, quotaKey(req), metricReq); err != nil {
+				res.Header().Set("Retry-After", "1")
+				writeMetricResponse(res, MetricResponse{
+					Status: http.StatusServiceUnavailable,
+					Reason: err.Error(),
+				})
+				return
+			}
+			writeMetricResponse(res, MetricResponse{
+				Status:  http.StatusAccepted,
+				Message: fmt.Sprintf("Metric %s update accepted", metricReq.Name),
+			})
+			return
+		}
+
+		if err = mc.UpdateAs(quotaKey(req), metricReq); err != nil {
+			if quotaExceeded(res, err) {
+				return
+			}
+			status := http.StatusBadRequest
+			if errors.Is(err, registry.ErrMetricNotFound) {
+				status = http.StatusNotFound
+			}
 			response := MetricResponse{
-				Status: http.StatusBadRequest,
+				Status: status,
 				Reason: err.Error(),
 			}
 			raw, err := response.ToJSON()
@@ -172,7 +237,7 @@ func PushStatRestMetric(mc *CollectorRegistry, reg *prometheus.Registry) http.Ha
 				http.Error(res, fmt.Sprintf("failed to marshal error response: %v", err), http.StatusInternalServerError)
 				return
 			}
-			res.WriteHeader(http.StatusBadRequest)
+			res.WriteHeader(status)
 			res.Header().Set("Content-Type", "application/json")
 			res.Header().Set("Content-Length", strconv.FormatInt(int64(len(raw)), 10))
 			res.Write(raw)
@@ -195,7 +260,27 @@ func PushStatRestMetric(mc *CollectorRegistry, reg *prometheus.Registry) http.Ha
 	})
 }
 
-func parseRequestBody(req *http.Request, metricReq *MetricRequest) error {
+// writeMetricResponse writes response as JSON with its status code.
+func writeMetricResponse(res http.ResponseWriter, response MetricResponse) {
+	raw, err := response.ToJSON()
+	if err != nil {
+		http.Error(res, fmt.Sprintf("failed to marshal response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	res.Header().Set("Content-Type", "application/json")
+	res.Header().Set("Content-Length", strconv.FormatInt(int64(len(raw)), 10))
+	res.WriteHeader(response.Status)
+	res.Write(raw)
+}
+
+// validatePushRequest checks the fields every metric update must carry before it reaches the registry.
+func validatePushRequest(metricReq registry.MetricRequest) validation.ValidationError {
+	return validation.NewValidator(metricReq).
+		ValidateField("Type", validation.IsEmpty).
+		ValidateField("Name", validation.IsEmpty).Errors()
+}
+
+func parseRequestBody(req *http.Request, metricReq *registry.MetricRequest) error {
 	data, err := io.ReadAll(req.Body)
 	if err != nil {
 		return fmt.Errorf("failed to read request body: (%s)", err)
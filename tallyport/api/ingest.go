@@ -0,0 +1,243 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"tallyport/config"
+	"tallyport/prompb"
+	"tallyport/registry"
+	"tallyport/remotewrite"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+// IngestExposition accepts rendered /metrics output so existing Prometheus client code can
+// report through tallyport.
+//
+// The body is decoded according to its Content-Type: the Prometheus text format (text/plain),
+// OpenMetrics (application/openmetrics-text) or delimited protobuf (application/vnd.google.protobuf).
+// Families are merged like remote write series: unknown families are registered with their
+// # TYPE and # HELP, counters move forward to the exposed total, gauges and untyped samples are
+// set, and histograms and summaries are stored as their _bucket, _sum, _count and quantile series.
+//
+// When ingest_config.inject_instance is enabled every series gets an instance label taken from
+// the "instance" query parameter, or from the client address when the parameter is missing.
+// An instance label already present on a series is kept.
+//
+// Parameters:
+//   - mc: CollectorRegistry the ingested series are written to.
+//   - reg: Prometheus registry new metrics are registered with.
+//   - cfg: Server configuration, of which ingest_config is used.
+//
+// Returns:
+//   - http.HandlerFunc: Handler parsing and merging the exposition.
+func IngestExposition(mc *registry.CollectorRegistry, reg *prometheus.Registry, cfg config.TallyPortConfig) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		families, err := decodeExposition(req)
+		if err != nil {
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusBadRequest,
+				Reason: fmt.Sprintf("failed to parse exposition: (%s)", err),
+			})
+			return
+		}
+
+		var labels []prompb.Label
+		if cfg.IngestConfig.InjectInstance {
+			instance := strings.TrimSpace(req.URL.Query().Get("instance"))
+			if instance == "" {
+				instance = req.RemoteAddr
+				if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+					instance = host
+				}
+			}
+			labels = append(labels, prompb.Label{Name: "instance", Value: instance})
+		}
+
+		timestamp := time.Now().UnixMilli()
+		metadata := make(map[string]prompb.MetricMetadata, len(families))
+		var batch []prompb.TimeSeries
+		for _, family := range families {
+			metadata[family.GetName()] = remotewrite.FamilyMetadata(family)
+			batch = append(batch, remotewrite.FamilySeries(family, timestamp, labels)...)
+		}
+
+		receiveSeriesBatch(res, req, mc, reg, batch, metadata)
+	})
+}
+
+// decodeExposition reads the request body into metric families according to its Content-Type.
+func decodeExposition(req *http.Request) ([]*dto.MetricFamily, error) {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if err != nil {
+		mediaType = "text/plain"
+	}
+
+	if mediaType == "application/vnd.google.protobuf" {
+		var families []*dto.MetricFamily
+		decoder := expfmt.NewDecoder(req.Body, expfmt.NewFormat(expfmt.TypeProtoDelim))
+		for {
+			family := &dto.MetricFamily{}
+			if err := decoder.Decode(family); err != nil {
+				if errors.Is(err, io.EOF) {
+					return families, nil
+				}
+				return nil, err
+			}
+			families = append(families, family)
+		}
+	}
+
+	raw, err := io.ReadAll(req.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read request body: %v", err)
+	}
+	if mediaType == expfmt.OpenMetricsType {
+		raw = openMetricsToText(raw)
+	}
+
+	var parser expfmt.TextParser
+	byName, err := parser.TextToMetricFamilies(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(byName))
+	for _, family := range byName {
+		families = append(families, family)
+	}
+	return families, nil
+}
+
+// openMetricsToText rewrites an OpenMetrics exposition into the Prometheus text format understood
+// by expfmt.TextParser. Counter and info families are renamed to their _total and _info sample
+// names, OpenMetrics-only types are mapped to their closest text format type, gauge histogram
+// _gcount and _gsum samples become _count and _sum, and # UNIT, # EOF, _created samples,
+// exemplars and timestamps are dropped.
+func openMetricsToText(raw []byte) []byte {
+	types := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(raw)+1)
+	for scanner.Scan() {
+		if fields := strings.Fields(scanner.Text()); len(fields) == 4 && fields[0] == "#" && fields[1] == "TYPE" {
+			types[fields[2]] = fields[3]
+		}
+	}
+
+	// familyName maps an OpenMetrics family name to the sample name used in the text format.
+	familyName := func(name string) string {
+		switch types[name] {
+		case "counter":
+			if !strings.HasSuffix(name, "_total") {
+				return name + "_total"
+			}
+		case "info":
+			return name + "_info"
+		}
+		return name
+	}
+
+	var out bytes.Buffer
+	scanner = bufio.NewScanner(bytes.NewReader(raw))
+	scanner.Buffer(make([]byte, 0, 64*1024), len(raw)+1)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "#") {
+			fields := strings.SplitN(line, " ", 4)
+			if len(fields) < 3 {
+				continue
+			}
+			switch fields[1] {
+			case "TYPE":
+				textType := map[string]string{
+					"counter":        "counter",
+					"gauge":          "gauge",
+					"histogram":      "histogram",
+					"gaugehistogram": "histogram",
+					"summary":        "summary",
+					"info":           "gauge",
+					"stateset":       "gauge",
+				}[strings.TrimSpace(fields[len(fields)-1])]
+				if textType == "" {
+					textType = "untyped"
+				}
+				fmt.Fprintf(&out, "# TYPE %s %s\n", familyName(fields[2]), textType)
+			case "HELP":
+				help := ""
+				if len(fields) == 4 {
+					help = fields[3]
+				}
+				fmt.Fprintf(&out, "# HELP %s %s\n", familyName(fields[2]), help)
+			}
+			continue
+		}
+
+		name, rest := splitSampleName(line)
+		if strings.HasSuffix(name, "_created") {
+			switch types[strings.TrimSuffix(name, "_created")] {
+			case "counter", "histogram", "gaugehistogram", "summary":
+				continue
+			}
+		}
+		if base, ok := strings.CutSuffix(name, "_gcount"); ok && types[base] == "gaugehistogram" {
+			name = base + "_count"
+		}
+		if base, ok := strings.CutSuffix(name, "_gsum"); ok && types[base] == "gaugehistogram" {
+			name = base + "_sum"
+		}
+
+		labels, value := splitSampleLabels(rest)
+		// Keep only the value: exemplars follow a " # " and OpenMetrics timestamps are
+		// seconds, which the text format would read as milliseconds.
+		if fields := strings.Fields(value); len(fields) > 0 {
+			value = fields[0]
+		}
+		fmt.Fprintf(&out, "%s%s %s\n", name, labels, value)
+	}
+	return out.Bytes()
+}
+
+// splitSampleName splits a sample line after its metric name.
+func splitSampleName(line string) (string, string) {
+	end := strings.IndexAny(line, "{ \t")
+	if end < 0 {
+		return line, ""
+	}
+	return line[:end], line[end:]
+}
+
+// splitSampleLabels splits the remainder of a sample line into its label set, including the
+// braces, and everything after it. Quoted label values may contain braces and spaces.
+func splitSampleLabels(rest string) (string, string) {
+	if !strings.HasPrefix(rest, "{") {
+		return "", rest
+	}
+	quoted, escaped := false, false
+	for i, c := range rest {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			quoted = !quoted
+		case c == '}' && !quoted:
+			return rest[:i+1], rest[i+1:]
+		}
+	}
+	return rest, ""
+}
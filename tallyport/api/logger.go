@@ -0,0 +1,50 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/rs/zerolog"
+)
+
+// accessLogFormatter writes one log line per request, including the credential of
+// authenticated requests, in the same format as the rest of tallyport's logs.
+type accessLogFormatter struct {
+	logger zerolog.Logger
+}
+
+// NewLogEntry implements middleware.LogFormatter.
+func (f accessLogFormatter) NewLogEntry(req *http.Request) middleware.LogEntry {
+	return &accessLogEntry{logger: f.logger, req: req}
+}
+
+type accessLogEntry struct {
+	logger zerolog.Logger
+	req    *http.Request
+}
+
+// Write logs the completed request.
+func (e *accessLogEntry) Write(status, bytes int, _ http.Header, elapsed time.Duration, _ interface{}) {
+	event := e.logger.Info().
+		Str("request_id", middleware.GetReqID(e.req.Context())).
+		Str("method", e.req.Method).
+		Str("path", e.req.URL.Path).
+		Str("remote", e.req.RemoteAddr).
+		Int("status", status).
+		Int("bytes", bytes).
+		Dur("elapsed", elapsed)
+	if slot, ok := e.req.Context().Value(credentialSlotKey{}).(*credentialSlot); ok && slot.identity != nil {
+		event = event.Str("key_id", slot.identity.ID)
+	}
+	event.Msg("request")
+}
+
+// Panic logs a panic recovered while serving the request.
+func (e *accessLogEntry) Panic(v interface{}, stack []byte) {
+	e.logger.Error().
+		Str("request_id", middleware.GetReqID(e.req.Context())).
+		Interface("panic", v).
+		Bytes("stack", stack).
+		Msg("request panicked")
+}
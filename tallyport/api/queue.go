@@ -0,0 +1,189 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"tallyport/config"
+	"tallyport/registry"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// Overflow policies accepted by async_config.overflow.
+const (
+	overflowReject     = "reject"
+	overflowDropOldest = "drop_oldest"
+)
+
+// Defaults used when the matching async_config field is not set.
+const (
+	asyncDefaultWorkers   = 4
+	asyncDefaultQueueSize = 10000
+)
+
+// errQueueFull is returned by PushQueue.enqueue when the reject policy turns a push away.
+var errQueueFull = errors.New("push queue is full")
+
+// queuedPush is a validated push waiting for a worker, stamped with the time it was accepted.
+type queuedPush struct {
+	mc       *registry.CollectorRegistry
+	keyID    string // API key the push is charged to, if any
+	metric   registry.MetricRequest
+	enqueued time.Time
+}
+
+// PushQueue applies validated pushes on a bounded pool of workers so /push can acknowledge
+// them with 202 Accepted instead of waiting for the update. When the queue is full the
+// overflow policy either rejects the new push or evicts the oldest queued one to make room.
+// Failed updates can no longer be reported to the client; they are logged and counted.
+type PushQueue struct {
+	logger   zerolog.Logger
+	overflow string
+	workers  int
+	pushes   chan queuedPush
+	// closed guards pushes against sends after Stop closed it.
+	closed bool
+	mu     sync.RWMutex
+	wg     sync.WaitGroup
+
+	depth   prometheus.Gauge
+	latency prometheus.Histogram
+	dropped *prometheus.CounterVec
+	failed  prometheus.Counter
+}
+
+// NewPushQueue creates a PushQueue from async_config and registers its own metrics with reg.
+// Pushes are only queued; nothing is applied until Start is called.
+//
+// Parameters:
+//   - cfg: Server configuration, of which async_config is used.
+//   - reg: Prometheus registry receiving the queue metrics.
+//   - logger: Logger used to report failed updates.
+//
+// Returns:
+//   - *PushQueue: The configured queue.
+//   - An error if the overflow policy is unknown or the queue metrics cannot be registered.
+func NewPushQueue(cfg config.TallyPortConfig, reg *prometheus.Registry, logger zerolog.Logger) (*PushQueue, error) {
+	ac := cfg.AsyncConfig
+
+	overflow := ac.Overflow
+	if overflow == "" {
+		overflow = overflowReject
+	}
+	if overflow != overflowReject && overflow != overflowDropOldest {
+		return nil, fmt.Errorf("unknown async_config.overflow %q, expected %q or %q",
+			ac.Overflow, overflowReject, overflowDropOldest)
+	}
+
+	workers := ac.Workers
+	if workers <= 0 {
+		workers = asyncDefaultWorkers
+	}
+	queueSize := ac.QueueSize
+	if queueSize <= 0 {
+		queueSize = asyncDefaultQueueSize
+	}
+
+	pq := &PushQueue{
+		logger:   logger,
+		overflow: overflow,
+		workers:  workers,
+		pushes:   make(chan queuedPush, queueSize),
+		depth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "async",
+			Name:      "queue_depth",
+			Help:      "Pushes waiting in the async queue",
+		}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "async",
+			Name:      "queue_latency_seconds",
+			Help:      "Time between accepting a push and applying it in seconds",
+			Buckets:   prometheus.DefBuckets,
+		}),
+		dropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "async",
+			Name:      "dropped_pushes_total",
+			Help:      "Pushes not applied because the async queue was full, by overflow policy",
+		}, []string{"policy"}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "async",
+			Name:      "failed_pushes_total",
+			Help:      "Queued pushes whose update failed",
+		}),
+	}
+
+	for _, collector := range []prometheus.Collector{pq.depth, pq.latency, pq.dropped, pq.failed} {
+		if err := reg.Register(collector); err != nil {
+			return nil, fmt.Errorf("failed to register async queue metric: %w", err)
+		}
+	}
+
+	return pq, nil
+}
+
+// Start launches the workers.
+func (pq *PushQueue) Start() {
+	for i := 0; i < pq.workers; i++ {
+		pq.wg.Add(1)
+		go func() {
+			defer pq.wg.Done()
+			for push := range pq.pushes {
+				pq.depth.Set(float64(len(pq.pushes)))
+				if err := push.mc.UpdateAs(push.keyID, push.metric); err != nil {
+					pq.failed.Inc()
+					pq.logger.Warn().Err(err).Str("metric", push.metric.Name).Msg("async push failed")
+				}
+				pq.latency.Observe(time.Since(push.enqueued).Seconds())
+			}
+		}()
+	}
+}
+
+// Stop stops accepting pushes and waits for the workers to apply everything already queued.
+func (pq *PushQueue) Stop() {
+	pq.mu.Lock()
+	pq.closed = true
+	close(pq.pushes)
+	pq.mu.Unlock()
+	pq.wg.Wait()
+}
+
+// enqueue hands a validated push for mc, made with the API key called keyID, to the workers.
+// It never blocks: with the reject policy a full queue returns errQueueFull, with the
+// drop_oldest policy the oldest queued push is discarded.
+func (pq *PushQueue) enqueue(mc *registry.CollectorRegistry, keyID string, metric registry.MetricRequest) error {
+	pq.mu.RLock()
+	defer pq.mu.RUnlock()
+	if pq.closed {
+		return errQueueFull
+	}
+
+	push := queuedPush{mc: mc, keyID: keyID, metric: metric, enqueued: time.Now()}
+	for {
+		select {
+		case pq.pushes <- push:
+			pq.depth.Set(float64(len(pq.pushes)))
+			return nil
+		default:
+		}
+
+		if pq.overflow == overflowReject {
+			pq.dropped.WithLabelValues(overflowReject).Inc()
+			return errQueueFull
+		}
+
+		// Workers may drain the queue concurrently, so evicting is best effort and the send is retried.
+		select {
+		case <-pq.pushes:
+			pq.dropped.WithLabelValues(overflowDropOldest).Inc()
+		default:
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"tallyport/auth"
+	"tallyport/config"
+	"tallyport/registry"
+)
+
+// quotaOf converts the quota_config limits of a tenant to the quota enforced by its registry.
+func quotaOf(limits config.QuotaLimits) registry.Quota {
+	return registry.Quota{
+		MaxMetrics:          limits.MaxMetrics,
+		MaxSeries:           limits.MaxSeries,
+		MaxSamplesPerMinute: limits.MaxSamplesPerMinute,
+	}
+}
+
+// keyQuotasOf converts the quota_config limits of API keys to the quotas enforced for them.
+func keyQuotasOf(cfg config.TallyPortConfig) map[string]registry.Quota {
+	quotas := make(map[string]registry.Quota, len(cfg.QuotaConfig.Keys))
+	for id, limits := range cfg.QuotaConfig.Keys {
+		quotas[id] = quotaOf(limits)
+	}
+	return quotas
+}
+
+// quotaKey returns the id of the API key the writes of a request are charged to, or "" when the
+// request carries no API key. JWTs are not charged, so a token whose id claim matches the id of
+// a key cannot use up the budget of that key.
+func quotaKey(req *http.Request) string {
+	identity, ok := auth.FromContext(req.Context())
+	if !ok || identity.Method == auth.MethodJWT {
+		return ""
+	}
+	return identity.ID
+}
+
+// quotaExceeded answers requests refused by a quota and reports whether err was such a refusal.
+// Exceeding samples_per_minute frees up by itself and is answered with 429 and a Retry-After
+// header; exceeding max_metrics or max_series only frees up once metrics are deleted, so it is
+// answered with 403.
+func quotaExceeded(res http.ResponseWriter, err error) bool {
+	var quotaErr *registry.QuotaError
+	if !errors.As(err, &quotaErr) {
+		return false
+	}
+	if quotaErr.RetryAfter > 0 {
+		res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(quotaErr.RetryAfter.Seconds()))))
+	}
+	writeMetricResponse(res, MetricResponse{
+		Status: quotaStatus(quotaErr),
+		Reason: err.Error(),
+	})
+	return true
+}
+
+// quotaStatus returns the status code a refusal by a quota is answered with.
+func quotaStatus(quotaErr *registry.QuotaError) int {
+	if quotaErr.RetryAfter > 0 {
+		return http.StatusTooManyRequests
+	}
+	return http.StatusForbidden
+}
+
+// ReadQuota returns the quotas of a tenant together with their usage and remaining budget, and
+// those of the API key of the request when it has quotas of its own.
+//
+// Parameters:
+//   - mc: CollectorRegistry of the tenant.
+//   - tenant: Name of the tenant, empty for the default tenant.
+//   - keys: Quotas of API keys, nil when quota_config is disabled.
+//
+// Returns:
+//   - http.HandlerFunc: Handler writing a QuotaResponse, or 404 when quota_config is disabled.
+func ReadQuota(mc *registry.CollectorRegistry, tenant string, keys *registry.KeyQuotas) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		usage, enabled := mc.QuotaUsage()
+		if !enabled {
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusNotFound,
+				Reason: "quotas are not enabled",
+			})
+			return
+		}
+
+		response := QuotaResponse{
+			Status: http.StatusOK,
+			Tenant: tenant,
+			Quotas: quotaStatuses(usage),
+		}
+		if id := quotaKey(req); id != "" && keys != nil {
+			if keyUsage, ok := keys.Usage(id); ok {
+				response.Key, response.KeyQuotas = id, quotaStatuses(keyUsage)
+			}
+		}
+
+		raw, err := json.Marshal(response)
+		if err != nil {
+			http.Error(res, fmt.Sprintf("failed to marshal response: %v", err), http.StatusInternalServerError)
+			return
+		}
+		res.Header().Set("Content-Type", "application/json")
+		res.Header().Set("Content-Length", strconv.FormatInt(int64(len(raw)), 10))
+		res.WriteHeader(response.Status)
+		res.Write(raw)
+	})
+}
+
+// quotaStatuses reports the usage of quotas with their remaining budget.
+func quotaStatuses(usage []registry.QuotaUsage) []QuotaStatus {
+	statuses := make([]QuotaStatus, 0, len(usage))
+	for _, u := range usage {
+		status := QuotaStatus{Quota: u.Quota, Used: u.Used}
+		if u.Limit > 0 {
+			limit, remaining := u.Limit, max(0, u.Limit-u.Used)
+			status.Limit, status.Remaining = &limit, &remaining
+		}
+		if !u.Reset.IsZero() {
+			status.Reset = u.Reset.Unix()
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
@@ -0,0 +1,167 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"tallyport/config"
+	"time"
+
+	"github.com/go-chi/httprate"
+)
+
+// rateLimiter limits the requests of every client to a route per minute. Clients are told
+// apart by rate_limit_config.key_by, so clients sharing an address, e.g. behind a carrier NAT,
+// do not use up each other's limit. Every address is additionally held to
+// rate_limit_config.address_per_minute across all routes before it is authenticated, so
+// credentials cannot be guessed faster than that.
+type rateLimiter struct {
+	keyBy            string
+	clientIDHeader   string
+	perMinute        int
+	routes           map[string]int
+	addressPerMinute int
+	// limiters holds the counter of each route pattern, shared by every method it serves.
+	limiters map[string]*httprate.RateLimiter
+}
+
+// newRateLimiter creates the rate limiter configured by rate_limit_size_per_minute and
+// rate_limit_config.
+func newRateLimiter(cfg config.TallyPortConfig) *rateLimiter {
+	return &rateLimiter{
+		keyBy:            cfg.RateLimitConfig.KeyBy,
+		clientIDHeader:   cfg.RateLimitConfig.ClientIDHeader,
+		perMinute:        cfg.RateLimitSizePerMinute,
+		routes:           cfg.RateLimitConfig.Routes,
+		addressPerMinute: cfg.RateLimitConfig.AddressPerMinute,
+		limiters:         make(map[string]*httprate.RateLimiter),
+	}
+}
+
+// byAddress returns middleware limiting the requests of every address to
+// rate_limit_config.address_per_minute across all routes. It runs before authentication, so
+// requests with invalid credentials are counted too; an address_per_minute of 0 disables it.
+func (rl *rateLimiter) byAddress() func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if rl.addressPerMinute == 0 {
+			return next
+		}
+		limiter := httprate.NewRateLimiter(rl.addressPerMinute, time.Minute)
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			ip, _ := httprate.KeyByIP(req)
+			serveLimited(res, req, limiter, rl.addressPerMinute, "ip:"+ip, next)
+		})
+	}
+}
+
+// limit returns middleware limiting the requests of every client to route, with a counter of
+// its own. The limit is the one of the route in rate_limit_config.routes, or else
+// rate_limit_size_per_minute; routes limited to 0 are not limited.
+//
+// The middleware must run after authentication, so requests are counted against their
+// credential rather than a credential they merely claim to have. Every response carries the
+// X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers, and refused requests
+// are answered with 429 and a Retry-After header.
+//
+// Routes registered for several methods share one counter, so a client gets the limit of the
+// route once however it mixes the methods.
+//
+// Parameters:
+//   - route: Route pattern as registered, e.g. "/definitions/{name}".
+//
+// Returns:
+//   - func(http.Handler) http.Handler: The middleware.
+func (rl *rateLimiter) limit(route string) func(http.Handler) http.Handler {
+	perMinute, ok := rl.routes[route]
+	if !ok {
+		perMinute = rl.perMinute
+	}
+	return func(next http.Handler) http.Handler {
+		if perMinute == 0 {
+			return next
+		}
+		limiter, ok := rl.limiters[route]
+		if !ok {
+			limiter = httprate.NewRateLimiter(perMinute, time.Minute)
+			rl.limiters[route] = limiter
+		}
+		return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+			serveLimited(res, req, limiter, perMinute, rl.clientKey(req), next)
+		})
+	}
+}
+
+// serveLimited passes the request to next unless the client called key is over the limit of
+// limiter, in which case it is answered with 429 and a Retry-After header.
+func serveLimited(res http.ResponseWriter, req *http.Request, limiter *httprate.RateLimiter, perMinute int, key string, next http.Handler) {
+	if !limiter.OnLimit(res, req, key) {
+		next.ServeHTTP(res, req)
+		return
+	}
+
+	// httprate suggests waiting a whole window; wait until its sliding window lets the
+	// request through instead.
+	now := time.Now().UTC()
+	window := now.Truncate(time.Minute)
+	current, previous, err := limiter.Counter().Get(key, window, window.Add(-time.Minute))
+	if err == nil {
+		wait := retryAfter(perMinute, current, previous, now.Sub(window), time.Minute)
+		res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	}
+	writeMetricResponse(res, MetricResponse{
+		Status: http.StatusTooManyRequests,
+		Reason: fmt.Sprintf("rate limit of %d requests per minute exceeded, retry in %s seconds",
+			perMinute, res.Header().Get("Retry-After")),
+	})
+}
+
+// clientKey identifies the client a request is counted against: the credential it was
+// authenticated with, the client id header or the address it came from, depending on key_by.
+// Requests without a credential or client id fall back to their address.
+func (rl *rateLimiter) clientKey(req *http.Request) string {
+	switch rl.keyBy {
+	case "api_key":
+		if slot, ok := req.Context().Value(credentialSlotKey{}).(*credentialSlot); ok && slot.identity != nil {
+			return slot.identity.Method + ":" + slot.identity.ID
+		}
+	case "client_id":
+		if id := strings.TrimSpace(req.Header.Get(rl.clientIDHeader)); id != "" {
+			return "client:" + id
+		}
+	}
+	ip, _ := httprate.KeyByIP(req)
+	return "ip:" + ip
+}
+
+// retryAfter returns how long a client has to wait before httprate's sliding window lets its
+// next request through. The window counts the requests of the previous window in proportion
+// to how much of it still overlaps the last window length.
+//
+// Parameters:
+//   - limit: Requests allowed per window.
+//   - current, previous: Requests counted in the current and the previous window.
+//   - elapsed: Time since the current window started.
+//   - window: Window length.
+//
+// Returns:
+//   - time.Duration: The wait, at least a second.
+func retryAfter(limit, current, previous int, elapsed, window time.Duration) time.Duration {
+	allowed := float64(limit - 1)
+	overlap := func(count int) time.Duration {
+		if count == 0 || float64(count) <= allowed {
+			return 0
+		}
+		return time.Duration(float64(window) * (1 - allowed/float64(count)))
+	}
+
+	// Within the current window, the previous one fades out until the request fits.
+	if float64(current) <= allowed && previous > 0 {
+		if at := window - time.Duration(float64(window)*(allowed-float64(current))/float64(previous)); at < window {
+			return max(time.Second, at-elapsed)
+		}
+	}
+	// Otherwise the current window has to fade out after it ends.
+	return max(time.Second, window-elapsed+overlap(current))
+}
@@ -0,0 +1,270 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"tallyport/auth"
+	"tallyport/prompb"
+	"tallyport/registry"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// remoteWriteMaxReasons caps the number of rejection reasons echoed back to a sender.
+const remoteWriteMaxReasons = 10
+
+// ReceiveRemoteWrite accepts Prometheus remote write requests so other agents can write into tallyport.
+//
+// Every series is applied with its latest sample. Series of unknown metrics are registered on
+// the fly as counters or gauges, taking the type from the request metadata when present and
+// defaulting to gauge otherwise. Series are rejected when they conflict with an existing
+// definition: a different type, different label names, or a histogram or summary, which cannot
+// be set to absolute values. Accepted series are applied even when others in the same request
+// are rejected; the sender then receives a 400 listing the rejections so it does not retry.
+//
+// Parameters:
+//   - mc: CollectorRegistry the received series are written to.
+//   - reg: Prometheus registry new metrics are registered with.
+//
+// Returns:
+//   - http.HandlerFunc: Handler decoding snappy-compressed protobuf WriteRequests.
+func ReceiveRemoteWrite(mc *registry.CollectorRegistry, reg *prometheus.Registry) http.HandlerFunc {
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		compressed, err := io.ReadAll(req.Body)
+		if err != nil {
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusBadRequest,
+				Reason: fmt.Sprintf("failed to read request body: (%s)", err),
+			})
+			return
+		}
+
+		raw, err := snappy.Decode(nil, compressed)
+		if err != nil {
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusBadRequest,
+				Reason: fmt.Sprintf("failed to decompress snappy body: (%s)", err),
+			})
+			return
+		}
+
+		var writeReq prompb.WriteRequest
+		if err := writeReq.Unmarshal(raw); err != nil {
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusBadRequest,
+				Reason: fmt.Sprintf("invalid protobuf write request: (%s)", err),
+			})
+			return
+		}
+
+		metadata := make(map[string]prompb.MetricMetadata, len(writeReq.Metadata))
+		for _, md := range writeReq.Metadata {
+			metadata[md.MetricFamilyName] = md
+		}
+
+		receiveSeriesBatch(res, req, mc, reg, writeReq.Timeseries, metadata)
+	})
+}
+
+// receiveSeriesBatch applies every series of a request and writes the response: 204 when all
+// series were accepted, 400 listing the first rejections otherwise. Accepted series stay applied
+// either way, so senders must not retry a 400. Series outside the scope of the request's
+// credential are rejected as well. When series were refused for exceeding
+// max_samples_per_minute, the response is a 429 with a Retry-After header instead; since
+// series are set to absolute values, applying them again on retry is harmless.
+func receiveSeriesBatch(res http.ResponseWriter, req *http.Request, mc *registry.CollectorRegistry, reg *prometheus.Registry, batch []prompb.TimeSeries, metadata map[string]prompb.MetricMetadata) {
+	var reasons []string
+	var retryAfter time.Duration
+	rejected := 0
+	derived := &derivedSeries{gatherer: reg}
+	for _, series := range batch {
+		if err := receiveSeries(req, mc, reg, derived, series, metadata); err != nil {
+			var quotaErr *registry.QuotaError
+			if errors.As(err, &quotaErr) {
+				retryAfter = max(retryAfter, quotaErr.RetryAfter)
+			}
+			rejected++
+			if len(reasons) < remoteWriteMaxReasons {
+				reasons = append(reasons, err.Error())
+			}
+		}
+	}
+
+	if rejected > 0 {
+		status := http.StatusBadRequest
+		if retryAfter > 0 {
+			status = http.StatusTooManyRequests
+			res.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		}
+		writeMetricResponse(res, MetricResponse{
+			Status: status,
+			Reason: fmt.Sprintf("rejected %d of %d series: %s",
+				rejected, len(batch), strings.Join(reasons, "; ")),
+		})
+		return
+	}
+
+	res.WriteHeader(http.StatusNoContent)
+}
+
+// receiveSeries applies the latest sample of a single remote write series to the registry.
+// New metrics are checked against derived, which is shared by every series of the request.
+func receiveSeries(req *http.Request, mc *registry.CollectorRegistry, reg *prometheus.Registry, derived *derivedSeries, series prompb.TimeSeries, metadata map[string]prompb.MetricMetadata) error {
+	var name string
+	labels := prometheus.Labels{}
+	labelNames := make([]string, 0, len(series.Labels))
+	for _, label := range series.Labels {
+		if label.Name == "__name__" {
+			name = label.Value
+			continue
+		}
+		labels[label.Name] = label.Value
+		labelNames = append(labelNames, label.Name)
+	}
+
+	if name == "" {
+		return fmt.Errorf("series without a metric name")
+	}
+	if strings.HasPrefix(name, "__") {
+		return fmt.Errorf("metric %s uses a reserved name", name)
+	}
+	if err := authorize(req, auth.OperationPush, func(scope auth.Scope) error {
+		return scope.CheckSeries(name, labels)
+	}); err != nil {
+		return err
+	}
+
+	// Stale markers are NaN and signal the end of a series, not a value to store.
+	var latest *prompb.Sample
+	for i, sample := range series.Samples {
+		if math.IsNaN(sample.Value) {
+			continue
+		}
+		if latest == nil || sample.Timestamp >= latest.Timestamp {
+			latest = &series.Samples[i]
+		}
+	}
+	if latest == nil {
+		return nil
+	}
+
+	declared, help := remoteWriteType(name, metadata)
+	metricType, exists := mc.TypeOf(name)
+	if exists {
+		if metricType != registry.TypeCounter && metricType != registry.TypeGauge {
+			return fmt.Errorf("metric %s is a %s and cannot be remote written", name, metricType)
+		}
+		if declared != "" && declared != metricType {
+			return fmt.Errorf("metric %s is a %s, not a %s", name, metricType, declared)
+		}
+	} else {
+		metricType = declared
+		if metricType == "" {
+			metricType = registry.TypeGauge
+		}
+
+		if err := authorize(req, auth.OperationInit, func(scope auth.Scope) error {
+			if !scope.AllowsOperation(auth.OperationInit) {
+				return fmt.Errorf("metric %s does not exist and creating metrics is not allowed", name)
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		if err := derived.collision(name); err != nil {
+			return err
+		}
+
+		sort.Strings(labelNames)
+		collector, err := mc.RegisterAs(quotaKey(req), registry.MetricRequest{
+			Type:        metricType,
+			Name:        name,
+			Description: help,
+			Labels:      labelNames,
+		})
+		if err != nil {
+			return err
+		}
+		if err := reg.Register(collector); err != nil {
+			mc.Remove(metricType, name)
+			return fmt.Errorf("failed to register metric %s: %v", name, err)
+		}
+	}
+
+	return mc.SetAs(quotaKey(req), metricType, name, labels, latest.Value)
+}
+
+// derivedSeries holds the _bucket, _sum and _count series names of the histograms and
+// summaries exposed by a registry, mapped to their family. The registry is gathered at most
+// once per request, when the first series needs a new metric. Remote write only creates
+// counters and gauges, so metrics created later in the request cannot add to the names.
+type derivedSeries struct {
+	gatherer prometheus.Gatherer
+	families map[string]*dto.MetricFamily
+}
+
+// collision reports whether a new metric name clashes with the series of a histogram or
+// summary. The registry only detects such clashes while gathering, which would break the
+// whole export endpoint.
+func (ds *derivedSeries) collision(name string) error {
+	if ds.families == nil {
+		ds.families = make(map[string]*dto.MetricFamily)
+		families, _ := ds.gatherer.Gather()
+		for _, family := range families {
+			switch family.GetType() {
+			case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM, dto.MetricType_SUMMARY:
+			default:
+				continue
+			}
+			for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+				ds.families[family.GetName()+suffix] = family
+			}
+		}
+	}
+
+	if family, ok := ds.families[name]; ok {
+		return fmt.Errorf("metric %s collides with %s %s",
+			name, strings.ToLower(family.GetType().String()), family.GetName())
+	}
+	return nil
+}
+
+// remoteWriteType resolves the tallyport type of a series from the request metadata, together
+// with the help text of its family. Histogram and summary families are sent as separate
+// _bucket, _sum and _count series, which are monotonic and therefore stored as counters,
+// while summary quantiles are stored as gauges. An empty type means the metadata does not say.
+func remoteWriteType(name string, metadata map[string]prompb.MetricMetadata) (string, string) {
+	if md, ok := metadata[name]; ok {
+		switch md.Type {
+		case prompb.MetricTypeCounter:
+			return registry.TypeCounter, md.Help
+		case prompb.MetricTypeGauge, prompb.MetricTypeSummary, prompb.MetricTypeInfo, prompb.MetricTypeStateset:
+			return registry.TypeGauge, md.Help
+		}
+		return "", md.Help
+	}
+
+	for _, suffix := range []string{"_bucket", "_sum", "_count"} {
+		md, ok := metadata[strings.TrimSuffix(name, suffix)]
+		if !ok || !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		switch md.Type {
+		case prompb.MetricTypeHistogram, prompb.MetricTypeSummary:
+			return registry.TypeCounter, md.Help
+		case prompb.MetricTypeGaugeHistogram:
+			return registry.TypeGauge, md.Help
+		}
+	}
+
+	return "", ""
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"tallyport/auth"
+	"tallyport/config"
+	"tallyport/registry"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// streamWriteWait is the time allowed to write a single frame to the client.
+	streamWriteWait = 10 * time.Second
+	// streamPongWait is the time allowed between two frames (or pongs) from the client.
+	streamPongWait = 60 * time.Second
+	// streamPingPeriod is how often pings are sent; it must be shorter than streamPongWait.
+	streamPingPeriod = (streamPongWait * 9) / 10
+	// streamDefaultAuthTimeout is used when stream_config.auth_timeout is not set.
+	streamDefaultAuthTimeout = 5 * time.Second
+	// streamDefaultQueueSize is used when stream_config.queue_size is not set.
+	streamDefaultQueueSize = 64
+)
+
+// streamSession holds the state of a single authenticated WebSocket connection.
+type streamSession struct {
+	conn     *websocket.Conn
+	req      *http.Request // Upgrade request, carrying the identity frames are authorized against
+	mc       *registry.CollectorRegistry
+	requests *prometheus.CounterVec
+	limiter  *rate.Limiter
+	acks     chan StreamAck
+	tokens   *auth.KeyStore
+	endpoint string
+	timeout  time.Duration
+}
+
+// StreamRestMetric upgrades the request to a WebSocket connection for long-lived clients.
+//
+// The first frame must be a StreamAuthRequest. Once it is accepted, every following frame is
+// a registry.MetricRequest applied exactly like a /push body, within the scope of the credential
+// the upgrade request was authenticated with, and each one is answered with a StreamAck
+// carrying its sequence number. Frames are read one at a time: the per-connection rate limiter
+// and the bounded acknowledgement queue both pause reading, which pushes back on the client
+// through the socket instead of dropping its metrics.
+//
+// Parameters:
+//   - mc: CollectorRegistry the streamed metrics are applied to.
+//   - cfg: Server configuration, of which stream_config is used.
+//   - tokens: Stream tokens the authentication frame must carry one of, or nil to accept any client id.
+//   - requests: Request counter every acknowledgement is recorded in.
+//
+// Returns:
+//   - http.HandlerFunc: Handler performing the upgrade and serving the connection.
+func StreamRestMetric(mc *registry.CollectorRegistry, cfg config.TallyPortConfig, tokens *auth.KeyStore, requests *prometheus.CounterVec) http.HandlerFunc {
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(req *http.Request) bool {
+			origin := req.Header.Get("Origin")
+			if origin == "" || len(cfg.StreamConfig.AllowedOrigins) == 0 {
+				return true
+			}
+			return slices.Contains(cfg.StreamConfig.AllowedOrigins, origin)
+		},
+	}
+
+	limit := rate.Inf
+	if cfg.StreamConfig.RatePerSecond > 0 {
+		limit = rate.Limit(cfg.StreamConfig.RatePerSecond)
+	}
+	burst := max(cfg.StreamConfig.Burst, 1)
+
+	queueSize := cfg.StreamConfig.QueueSize
+	if queueSize <= 0 {
+		queueSize = streamDefaultQueueSize
+	}
+
+	timeout := time.Duration(cfg.StreamConfig.AuthTimeout * int64(time.Millisecond))
+	if timeout <= 0 {
+		timeout = streamDefaultAuthTimeout
+	}
+
+	maxMessageSize := cfg.StreamConfig.MaxMessageSize
+	if maxMessageSize <= 0 {
+		maxMessageSize = cfg.RequestConfig.Size
+	}
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		conn, err := upgrader.Upgrade(res, req, nil)
+		if err != nil {
+			// The upgrader has already replied with an HTTP error.
+			return
+		}
+		if maxMessageSize > 0 {
+			conn.SetReadLimit(maxMessageSize)
+		}
+
+		session := &streamSession{
+			conn:     conn,
+			req:      req,
+			mc:       mc,
+			requests: requests,
+			limiter:  rate.NewLimiter(limit, burst),
+			acks:     make(chan StreamAck, queueSize),
+			tokens:   tokens,
+			endpoint: req.URL.Path,
+			timeout:  timeout,
+		}
+		session.serve()
+	})
+}
+
+// serve runs the session until the client disconnects or a protocol error occurs.
+// Reading happens on the calling goroutine while acknowledgements and pings are written
+// by a dedicated writer, since a WebSocket connection supports only one concurrent writer.
+func (s *streamSession) serve() {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.writeLoop(ctx, cancel)
+	}()
+
+	s.readLoop(ctx)
+	close(s.acks)
+	<-done
+	s.conn.Close()
+}
+
+func (s *streamSession) readLoop(ctx context.Context) {
+	s.conn.SetReadDeadline(time.Now().Add(s.timeout))
+
+	data, err := s.readFrame()
+	if err != nil {
+		return
+	}
+
+	var frame StreamAuthRequest
+	if err := json.Unmarshal(data, &frame); err != nil {
+		s.reply(ctx, 0, http.StatusBadRequest, "", fmt.Sprintf("invalid authentication frame: (%s)", err))
+		return
+	}
+	if !s.authenticate(frame) {
+		s.reply(ctx, 0, http.StatusUnauthorized, "", "invalid stream credentials")
+		return
+	}
+	s.reply(ctx, 0, http.StatusOK, fmt.Sprintf("Client %s authenticated", frame.ClientID), "")
+
+	s.conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	s.conn.SetPongHandler(func(string) error {
+		return s.conn.SetReadDeadline(time.Now().Add(streamPongWait))
+	})
+
+	for seq := uint64(1); ; seq++ {
+		data, err := s.readFrame()
+		if err != nil {
+			return
+		}
+		s.conn.SetReadDeadline(time.Now().Add(streamPongWait))
+
+		if err := s.limiter.Wait(ctx); err != nil {
+			return
+		}
+
+		var metricReq registry.MetricRequest
+		if err := json.Unmarshal(data, &metricReq); err != nil {
+			s.reply(ctx, seq, http.StatusBadRequest, "", fmt.Sprintf("invalid JSON format: (%s)", err))
+			continue
+		}
+
+		if validationErr := validatePushRequest(metricReq); validationErr != nil {
+			raw, err := validationErr.ToJSON()
+			if err != nil {
+				s.reply(ctx, seq, http.StatusInternalServerError, "", err.Error())
+				continue
+			}
+			s.reply(ctx, seq, http.StatusBadRequest, "", string(raw))
+			continue
+		}
+
+		if err := authorize(s.req, auth.OperationPush, func(scope auth.Scope) error {
+			return scope.CheckSeries(metricReq.Name, seriesLabels(s.mc, metricReq.Name, metricReq.Labels))
+		}); err != nil {
+			s.reply(ctx, seq, http.StatusForbidden, "", err.Error())
+			continue
+		}
+
+		if err := s.mc.UpdateAs(quotaKey(s.req), metricReq); err != nil {
+			status := http.StatusBadRequest
+			var quotaErr *registry.QuotaError
+			if errors.As(err, &quotaErr) {
+				status = quotaStatus(quotaErr)
+			}
+			s.reply(ctx, seq, status, "", err.Error())
+			continue
+		}
+
+		s.reply(ctx, seq, http.StatusOK, fmt.Sprintf("Metric %s updated successfully", metricReq.Name), "")
+	}
+}
+
+// readFrame reads the next data frame from the client.
+// Any error means the connection can no longer be used.
+func (s *streamSession) readFrame() ([]byte, error) {
+	_, reader, err := s.conn.NextReader()
+	if err != nil {
+		return nil, err
+	}
+	return io.ReadAll(reader)
+}
+
+// authenticate accepts any client when no stream tokens are configured, which leaves
+// authentication to the API credentials of the upgrade request, and otherwise requires the
+// frame to carry one of them.
+func (s *streamSession) authenticate(frame StreamAuthRequest) bool {
+	if strings.TrimSpace(frame.ClientID) == "" {
+		return false
+	}
+	if s.tokens == nil {
+		return true
+	}
+	_, ok := s.tokens.Lookup(frame.Token)
+	return ok
+}
+
+// reply queues an acknowledgement and records it in the tallyport request counter.
+// It blocks while the queue is full, which stops the read loop from taking more frames.
+func (s *streamSession) reply(ctx context.Context, seq uint64, status int, message, reason string) {
+	s.requests.WithLabelValues("STREAM", s.endpoint, strconv.Itoa(status)).Inc()
+
+	ack := StreamAck{
+		Seq: seq,
+		MetricResponse: MetricResponse{
+			Status:  status,
+			Message: message,
+			Reason:  reason,
+		},
+	}
+	select {
+	case s.acks <- ack:
+	case <-ctx.Done():
+	}
+}
+
+// writeLoop writes queued acknowledgements and periodic pings until the queue is closed.
+// On a write failure it cancels the session so the read loop stops.
+func (s *streamSession) writeLoop(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(streamPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ack, ok := <-s.acks:
+			s.conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if !ok {
+				s.conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+				return
+			}
+			if err := s.conn.WriteJSON(ack); err != nil {
+				cancel()
+				s.conn.Close()
+				return
+			}
+		case <-ticker.C:
+			s.conn.SetWriteDeadline(time.Now().Add(streamWriteWait))
+			if err := s.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				cancel()
+				s.conn.Close()
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"tallyport/auth"
+	"tallyport/config"
+	"tallyport/registry"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"google.golang.org/protobuf/proto"
+)
+
+// tenantName matches the names a tenant can be given in the tenant header.
+var tenantName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+// errTenantLimit is returned when a request would create more tenants than tenant_config.max_tenants.
+var errTenantLimit = errors.New("tenant limit reached")
+
+// tenant is an isolated set of metrics: definitions, vectors, events and the Prometheus
+// registry they are exported from. Metrics of one tenant never collide with another's.
+type tenant struct {
+	name     string
+	registry *registry.CollectorRegistry
+	reg      *prometheus.Registry
+	buffer   *registry.IngestBuffer
+}
+
+// tenantSet holds the tenants created so far. The default tenant, used by requests that name no
+// tenant, is the handler's own registry and is not part of the set.
+type tenantSet struct {
+	mu      sync.RWMutex
+	tenants map[string]*tenant
+}
+
+// lookup returns the tenant called name, if it was created.
+func (ts *tenantSet) lookup(name string) (*tenant, bool) {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	t, ok := ts.tenants[name]
+	return t, ok
+}
+
+// all returns every tenant, sorted by name.
+func (ts *tenantSet) all() []*tenant {
+	ts.mu.RLock()
+	tenants := make([]*tenant, 0, len(ts.tenants))
+	for _, t := range ts.tenants {
+		tenants = append(tenants, t)
+	}
+	ts.mu.RUnlock()
+	sort.Slice(tenants, func(i, j int) bool { return tenants[i].name < tenants[j].name })
+	return tenants
+}
+
+// tenant returns the tenant called name, creating it if there are fewer than
+// tenant_config.max_tenants. New tenants buffer pushes like the default one when
+// buffer_config is enabled, and export the buffer metrics along with their own.
+func (h *Handler) tenant(cfg config.TallyPortConfig, name string) (*tenant, error) {
+	if t, ok := h.tenants.lookup(name); ok {
+		return t, nil
+	}
+
+	h.tenants.mu.Lock()
+	defer h.tenants.mu.Unlock()
+	if t, ok := h.tenants.tenants[name]; ok {
+		return t, nil
+	}
+	if limit := cfg.TenantConfig.MaxTenants; len(h.tenants.tenants) >= limit {
+		return nil, fmt.Errorf("%w: %d tenants exist", errTenantLimit, limit)
+	}
+
+	t, err := newTenant(cfg, name, h.keyQuotas)
+	if err != nil {
+		return nil, err
+	}
+	if h.buffer != nil {
+		if t.buffer, err = t.registry.EnableBuffer(cfg, t.reg); err != nil {
+			return nil, err
+		}
+		if h.started.Load() {
+			t.buffer.Start()
+		}
+	}
+	if h.tenants.tenants == nil {
+		h.tenants.tenants = make(map[string]*tenant)
+	}
+	h.tenants.tenants[name] = t
+	h.logger.Info().Str("tenant", name).Msg("tenant created")
+	return t, nil
+}
+
+// newTenant creates an empty tenant, enforcing its quota from quota_config when enabled and
+// charging writes to keys, which are nil without quota_config.
+func newTenant(cfg config.TallyPortConfig, name string, keys *registry.KeyQuotas) (*tenant, error) {
+	t := &tenant{name: name, registry: registry.NewCollectorRegistry(), reg: prometheus.NewRegistry()}
+	if cfg.QuotaConfig.Enabled {
+		if err := t.registry.EnableQuota(quotaOf(cfg.Quota(name)), t.reg); err != nil {
+			return nil, err
+		}
+	}
+	if keys != nil {
+		t.registry.EnableKeyQuotas(keys, name)
+	}
+	return t, nil
+}
+
+// tenanted returns a handler that serves every request with the metrics of its tenant. Without
+// tenant_config, or for requests that name no tenant, that is the default tenant.
+//
+// The tenant is the one the credential of the request is bound to, or else the one named in the
+// tenant header. A header naming another tenant than the credential is refused with 403.
+//
+// Parameters:
+//   - cfg: Server configuration, of which tenant_config is used.
+//   - create: Whether a tenant that does not exist yet is created; reads of unknown tenants
+//     are served from an empty tenant instead.
+//   - serve: Builds the handler serving a tenant.
+//
+// Returns:
+//   - http.Handler: The handler.
+func (h *Handler) tenanted(cfg config.TallyPortConfig, create bool, serve func(t *tenant) http.Handler) http.Handler {
+	defaultTenant := &tenant{registry: h.registry, reg: h.reg, buffer: h.buffer}
+	if !cfg.TenantConfig.Enabled {
+		return serve(defaultTenant)
+	}
+	tc := cfg.TenantConfig
+
+	return http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		name := req.Header.Get(tc.Header)
+		if identity, ok := auth.FromContext(req.Context()); ok && identity.Tenant != "" {
+			if name != "" && name != identity.Tenant {
+				forbidden(res, fmt.Errorf("%s is bound to tenant %s", credentialName(identity), identity.Tenant))
+				return
+			}
+			name = identity.Tenant
+		}
+
+		switch {
+		case name == "" && tc.Required:
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusBadRequest,
+				Reason: fmt.Sprintf("missing %s header", tc.Header),
+			})
+			return
+		case name == "":
+			serve(defaultTenant).ServeHTTP(res, req)
+			return
+		case !tenantName.MatchString(name):
+			writeMetricResponse(res, MetricResponse{
+				Status: http.StatusBadRequest,
+				Reason: fmt.Sprintf("invalid tenant %q", name),
+			})
+			return
+		}
+
+		t, ok := h.tenants.lookup(name)
+		if !ok {
+			var err error
+			if create {
+				t, err = h.tenant(cfg, name)
+			} else {
+				t, err = newTenant(cfg, name, h.keyQuotas)
+			}
+			if err != nil {
+				writeMetricResponse(res, MetricResponse{
+					Status: http.StatusForbidden,
+					Reason: fmt.Sprintf("cannot create tenant %s: %v", name, err),
+				})
+				return
+			}
+		}
+		serve(t).ServeHTTP(res, req)
+	})
+}
+
+// exportTenant serves the metrics of the tenant named in the path, without the tenant label.
+// Unknown tenants get 404.
+func (h *Handler) exportTenant(res http.ResponseWriter, req *http.Request) {
+	t, ok := h.tenants.lookup(chi.URLParam(req, "tenant"))
+	if !ok {
+		writeMetricResponse(res, MetricResponse{
+			Status: http.StatusNotFound,
+			Reason: fmt.Sprintf("unknown tenant %q", chi.URLParam(req, "tenant")),
+		})
+		return
+	}
+	promhttp.HandlerFor(t.reg, promhttp.HandlerOpts{}).ServeHTTP(res, req)
+}
+
+// tenantGatherer gathers the metrics of every tenant, adding a label with the tenant name to
+// each series that does not already carry it, so all tenants can be scraped from one endpoint.
+type tenantGatherer struct {
+	tenants *tenantSet
+	label   string
+}
+
+// Gather implements prometheus.Gatherer. Families of the same name are merged across tenants;
+// a family whose type or help differs from an earlier tenant's is left out and reported.
+func (tg tenantGatherer) Gather() ([]*dto.MetricFamily, error) {
+	var errs []error
+	byName := make(map[string]*dto.MetricFamily)
+
+	for _, t := range tg.tenants.all() {
+		families, err := t.reg.Gather()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("tenant %s: %w", t.name, err))
+		}
+		for _, family := range families {
+			merged, exists := byName[family.GetName()]
+			if !exists {
+				merged = &dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type}
+				byName[family.GetName()] = merged
+			} else if merged.GetType() != family.GetType() || merged.GetHelp() != family.GetHelp() {
+				errs = append(errs, fmt.Errorf("tenant %s: metric %s differs in type or help from another tenant's", t.name, family.GetName()))
+				continue
+			}
+			for _, metric := range family.Metric {
+				merged.Metric = append(merged.Metric, tg.withTenant(metric, t.name))
+			}
+		}
+	}
+
+	families := make([]*dto.MetricFamily, 0, len(byName))
+	for _, family := range byName {
+		families = append(families, family)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].GetName() < families[j].GetName() })
+	return families, errors.Join(errs...)
+}
+
+// withTenant returns a copy of metric carrying the tenant label.
+func (tg tenantGatherer) withTenant(metric *dto.Metric, name string) *dto.Metric {
+	for _, pair := range metric.Label {
+		if pair.GetName() == tg.label {
+			return metric
+		}
+	}
+	labeled := proto.Clone(metric).(*dto.Metric)
+	labeled.Label = append(labeled.Label, &dto.LabelPair{Name: proto.String(tg.label), Value: proto.String(name)})
+	slices.SortFunc(labeled.Label, func(a, b *dto.LabelPair) int {
+		return strings.Compare(a.GetName(), b.GetName())
+	})
+	return labeled
+}
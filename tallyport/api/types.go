@@ -0,0 +1,70 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"tallyport/registry"
+)
+
+// MetricResponse defines the JSON response structure for metric operations.
+// It contains a message describing the result of the operations
+type MetricResponse struct {
+	Status  int    `json:"status"`
+	Message string `json:"message,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func (mr MetricResponse) ToJSON() ([]byte, error) {
+	data, err := json.Marshal(mr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal MetricResponse to JSON: %v", err)
+	}
+	return data, nil
+}
+
+// StreamAuthRequest is the first frame a stream client sends after the WebSocket upgrade.
+// It identifies the client and carries the token checked against the configured stream tokens.
+type StreamAuthRequest struct {
+	ClientID string `json:"client_id"`       // Identifier of the client, used in logs.
+	Token    string `json:"token,omitempty"` // Shared token, required when stream tokens are configured.
+}
+
+// StreamAck acknowledges a single frame received on a stream connection.
+// Seq is the per-connection sequence number of the acknowledged frame: 0 for the
+// authentication frame and counting up from 1 for every pushed metric.
+type StreamAck struct {
+	Seq uint64 `json:"seq"`
+	MetricResponse
+}
+
+// MetricDescription is a registered metric definition together with the number of series it
+// currently exports.
+type MetricDescription struct {
+	registry.MetricRequest
+	Series int `json:"series"`
+}
+
+// MetricDefinitionsResponse defines the JSON response listing metric definitions.
+type MetricDefinitionsResponse struct {
+	Status  int                 `json:"status"`
+	Metrics []MetricDescription `json:"metrics"`
+}
+
+// QuotaStatus reports a quota of a tenant and how much of it is left. Limit and Remaining are
+// omitted for unlimited quotas.
+type QuotaStatus struct {
+	Quota     string `json:"quota"`
+	Limit     *int   `json:"limit,omitempty"`
+	Used      int    `json:"used"`
+	Remaining *int   `json:"remaining,omitempty"`
+	Reset     int64  `json:"reset,omitempty"` // Unix time at which samples_per_minute starts from zero again
+}
+
+// QuotaResponse defines the JSON response listing the quotas of a tenant.
+type QuotaResponse struct {
+	Status    int           `json:"status"`
+	Tenant    string        `json:"tenant,omitempty"`
+	Quotas    []QuotaStatus `json:"quotas"`
+	Key       string        `json:"key,omitempty"`
+	KeyQuotas []QuotaStatus `json:"key_quotas,omitempty"`
+}
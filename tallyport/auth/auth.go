@@ -0,0 +1,26 @@
+// Package auth authenticates tallyport clients and carries their identity through request
+// contexts, so handlers and logs can tell which credential a request was made with.
+package auth
+
+import "context"
+
+// Identity is the authenticated client of a request.
+type Identity struct {
+	ID     string // Identifier of the credential, e.g. the id of an API key
+	Method string // How the client authenticated, e.g. "api_key"
+	Scope  Scope  // What the client may do
+	Tenant string // Tenant the client is bound to; empty when it may choose one
+}
+
+type contextKey struct{}
+
+// NewContext returns a copy of ctx carrying identity.
+func NewContext(ctx context.Context, identity Identity) context.Context {
+	return context.WithValue(ctx, contextKey{}, identity)
+}
+
+// FromContext returns the identity stored in ctx, if the request was authenticated.
+func FromContext(ctx context.Context) (Identity, bool) {
+	identity, ok := ctx.Value(contextKey{}).(Identity)
+	return identity, ok
+}
@@ -0,0 +1,93 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"slices"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// MethodBasicAuth identifies clients authenticated with a username and password.
+const MethodBasicAuth = "basic_auth"
+
+// maxVerifiedPasswords bounds the passwords a BasicAuthUsers remembers as verified.
+const maxVerifiedPasswords = 1024
+
+// dummyHash is compared against for unknown users, so a response does not reveal whether a
+// username exists by how fast it arrives.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("tallyport"), bcrypt.DefaultCost)
+	return hash
+})
+
+// BasicAuthUsers verifies usernames and passwords against bcrypt hashes, in the format of the
+// basic_auth_users section of a Prometheus web configuration file.
+//
+// Since bcrypt is deliberately slow and scrapers send the same password every time, passwords
+// that were verified once are remembered by their SHA-256 hash. It is safe for concurrent use.
+type BasicAuthUsers struct {
+	hashes map[string][]byte
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+// NewBasicAuthUsers creates a BasicAuthUsers from bcrypt hashes by username.
+//
+// Parameters:
+//   - users: Bcrypt hash of the password of every user, e.g. from `htpasswd -nBC 10 "" | tr -d ':\n'`.
+//
+// Returns:
+//   - *BasicAuthUsers: The users.
+//   - An error naming the first user, in alphabetical order, whose hash is not a bcrypt hash.
+func NewBasicAuthUsers(users map[string]string) (*BasicAuthUsers, error) {
+	names := make([]string, 0, len(users))
+	for name := range users {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	u := &BasicAuthUsers{
+		hashes:   make(map[string][]byte, len(users)),
+		verified: make(map[[sha256.Size]byte]bool),
+	}
+	for _, name := range names {
+		hash := []byte(users[name])
+		if _, err := bcrypt.Cost(hash); err != nil {
+			return nil, fmt.Errorf("user %q: password must be a bcrypt hash: %w", name, err)
+		}
+		u.hashes[name] = hash
+	}
+	return u, nil
+}
+
+// Verify reports whether password is the password of user.
+func (u *BasicAuthUsers) Verify(user, password string) bool {
+	hash, known := u.hashes[user]
+	digest := sha256.Sum256([]byte(user + "\x00" + password))
+
+	u.mu.Lock()
+	remembered := u.verified[digest]
+	u.mu.Unlock()
+	if remembered {
+		return true
+	}
+
+	if !known {
+		bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+
+	u.mu.Lock()
+	if len(u.verified) >= maxVerifiedPasswords {
+		clear(u.verified)
+	}
+	u.verified[digest] = true
+	u.mu.Unlock()
+	return true
+}
@@ -0,0 +1,232 @@
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// MethodJWT identifies clients authenticated with a JSON Web Token.
+const MethodJWT = "jwt"
+
+// jwtAlgorithms are the signature algorithms a JWTValidator can be configured with. Symmetric
+// algorithms are left out, since their keys could not be published in a JWKS file.
+var jwtAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+	jose.EdDSA,
+}
+
+// Reasons a token is refused.
+var (
+	ErrTokenMalformed = errors.New("token is malformed or uses an algorithm that is not accepted")
+	ErrTokenSignature = errors.New("token signature does not match any key in the JWKS file")
+	ErrTokenExpired   = errors.New("token is expired or not valid yet")
+	ErrTokenIssuer    = errors.New("token was issued by another issuer")
+	ErrTokenAudience  = errors.New("token is meant for another audience")
+	ErrTokenClaims    = errors.New("token lacks a required claim")
+	ErrNoOperations   = errors.New("token grants no tallyport operation")
+)
+
+// JWTOptions configures a JWTValidator.
+type JWTOptions struct {
+	JWKSFile        string            // JSON Web Key Set the tokens are verified against
+	Issuer          string            // Required "iss" claim
+	Audiences       []string          // The "aud" claim must contain one of these
+	Algorithms      []string          // Accepted signature algorithms, e.g. "RS256"
+	Leeway          time.Duration     // Clock skew tolerated when checking "exp", "nbf" and "iat"
+	IDClaim         string            // Claim identifying the client in logs and metrics
+	TenantClaim     string            // Claim naming the tenant the token is bound to; unbound when empty
+	OperationsClaim string            // Claim listing the allowed operations; every operation when empty
+	LabelClaims     map[string]string // Claims mapped to the label whose value they fix on pushed series
+}
+
+// JWTValidator verifies bearer tokens against a JWKS file and turns their claims into an
+// Identity. The key set can be replaced at runtime with Reload.
+type JWTValidator struct {
+	opts       JWTOptions
+	algorithms []jose.SignatureAlgorithm
+	keys       atomic.Pointer[jose.JSONWebKeySet]
+}
+
+// NewJWTValidator loads the JWKS file and creates a JWTValidator.
+//
+// Parameters:
+//   - opts: Validator options; JWKSFile, Issuer, Audiences and IDClaim are required.
+//
+// Returns:
+//   - *JWTValidator: The validator.
+//   - An error if an algorithm is not supported or the JWKS file cannot be loaded.
+func NewJWTValidator(opts JWTOptions) (*JWTValidator, error) {
+	v := &JWTValidator{opts: opts}
+	for _, name := range opts.Algorithms {
+		algorithm := jose.SignatureAlgorithm(name)
+		if !slices.Contains(jwtAlgorithms, algorithm) {
+			return nil, fmt.Errorf("unsupported JWT algorithm %q", name)
+		}
+		v.algorithms = append(v.algorithms, algorithm)
+	}
+	if err := v.Reload(); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// Reload reads the JWKS file again. The previous keys stay in use when it fails.
+//
+// Returns:
+//   - An error if the file cannot be read, is not a JWKS document or holds no usable key.
+func (v *JWTValidator) Reload() error {
+	raw, err := os.ReadFile(filepath.Clean(v.opts.JWKSFile))
+	if err != nil {
+		return fmt.Errorf("failed to read JWKS file: %w", err)
+	}
+	var set jose.JSONWebKeySet
+	if err := json.Unmarshal(raw, &set); err != nil {
+		return fmt.Errorf("failed to parse JWKS file %s: %w", v.opts.JWKSFile, err)
+	}
+
+	public := &jose.JSONWebKeySet{}
+	for _, key := range set.Keys {
+		if key.Use != "" && key.Use != "sig" {
+			continue
+		}
+		key = key.Public()
+		if !key.Valid() {
+			continue
+		}
+		public.Keys = append(public.Keys, key)
+	}
+	if len(public.Keys) == 0 {
+		return fmt.Errorf("JWKS file %s holds no public signing key", v.opts.JWKSFile)
+	}
+	v.keys.Store(public)
+	return nil
+}
+
+// JWKSFile returns the path of the JWKS file the validator reads.
+func (v *JWTValidator) JWKSFile() string {
+	return v.opts.JWKSFile
+}
+
+// Validate verifies token and maps its claims to an Identity. Claims configured in
+// LabelClaims become label constraints of the scope, so series pushed with the token must carry
+// them, and OperationsClaim, a space separated string or a list, limits its operations.
+//
+// Parameters:
+//   - token: Compact serialised JWT.
+//   - now: Current time.
+//
+// Returns:
+//   - Identity: The client of the token.
+//   - One of the ErrToken* errors, or ErrNoOperations along with the identity, or nil.
+func (v *JWTValidator) Validate(token string, now time.Time) (Identity, error) {
+	parsed, err := jwt.ParseSigned(token, v.algorithms)
+	if err != nil {
+		return Identity{}, ErrTokenMalformed
+	}
+
+	var kid string
+	if len(parsed.Headers) > 0 {
+		kid = parsed.Headers[0].KeyID
+	}
+	set := v.keys.Load()
+	candidates := set.Keys
+	if kid != "" {
+		candidates = set.Key(kid)
+	}
+
+	var claims jwt.Claims
+	var extra map[string]any
+	verified := false
+	for _, key := range candidates {
+		if parsed.Claims(key, &claims, &extra) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return Identity{}, ErrTokenSignature
+	}
+
+	expected := jwt.Expected{Issuer: v.opts.Issuer, AnyAudience: v.opts.Audiences, Time: now}
+	switch err := claims.ValidateWithLeeway(expected, v.opts.Leeway); {
+	case errors.Is(err, jwt.ErrInvalidIssuer):
+		return Identity{}, ErrTokenIssuer
+	case errors.Is(err, jwt.ErrInvalidAudience):
+		return Identity{}, ErrTokenAudience
+	case err != nil:
+		return Identity{}, ErrTokenExpired
+	}
+	if claims.Expiry == nil {
+		return Identity{}, fmt.Errorf("%w: exp", ErrTokenClaims)
+	}
+
+	id, _ := extra[v.opts.IDClaim].(string)
+	if id == "" {
+		return Identity{}, fmt.Errorf("%w: %s", ErrTokenClaims, v.opts.IDClaim)
+	}
+	identity := Identity{ID: id, Method: MethodJWT}
+	if v.opts.TenantClaim != "" {
+		if identity.Tenant, _ = extra[v.opts.TenantClaim].(string); identity.Tenant == "" {
+			return Identity{}, fmt.Errorf("%w: %s", ErrTokenClaims, v.opts.TenantClaim)
+		}
+	}
+
+	for claim, label := range v.opts.LabelClaims {
+		value, _ := extra[claim].(string)
+		if value == "" {
+			return Identity{}, fmt.Errorf("%w: %s", ErrTokenClaims, claim)
+		}
+		if identity.Scope.Labels == nil {
+			identity.Scope.Labels = make(map[string][]string, len(v.opts.LabelClaims))
+		}
+		identity.Scope.Labels[label] = []string{value}
+	}
+
+	if v.opts.OperationsClaim != "" {
+		for _, granted := range claimValues(extra[v.opts.OperationsClaim]) {
+			if slices.Contains(Operations, granted) && !slices.Contains(identity.Scope.Operations, granted) {
+				identity.Scope.Operations = append(identity.Scope.Operations, granted)
+			}
+		}
+		if len(identity.Scope.Operations) == 0 {
+			return identity, ErrNoOperations
+		}
+	}
+	return identity, nil
+}
+
+// claimValues reads a claim holding either a space separated string, like the OAuth "scope"
+// claim, or a list of strings.
+func claimValues(claim any) []string {
+	switch value := claim.(type) {
+	case string:
+		return strings.Fields(value)
+	case []any:
+		values := make([]string, 0, len(value))
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// LooksLikeJWT reports whether a bearer credential is a compact serialised JWT rather than an
+// API key.
+func LooksLikeJWT(credential string) bool {
+	return strings.Count(credential, ".") == 2 && !strings.HasPrefix(credential, keyPrefix)
+}
@@ -0,0 +1,265 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+const testIssuer = "https://issuer.test"
+
+// newSigningKey generates an ES256 key called kid.
+func newSigningKey(t *testing.T, kid string) jose.JSONWebKey {
+	t.Helper()
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jose.JSONWebKey{Key: private, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+}
+
+// writeJWKS writes the public part of keys to a JWKS file and returns its path.
+func writeJWKS(t *testing.T, keys ...jose.JSONWebKey) string {
+	t.Helper()
+	set := jose.JSONWebKeySet{}
+	for _, key := range keys {
+		set.Keys = append(set.Keys, key.Public())
+	}
+	raw, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := os.WriteFile(path, raw, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// signToken signs claims with key.
+func signToken(t *testing.T, key jose.JSONWebKey, algorithm jose.SignatureAlgorithm, claims map[string]any) string {
+	t.Helper()
+	signer, err := jose.NewSigner(jose.SigningKey{Algorithm: algorithm, Key: key}, (&jose.SignerOptions{}).WithType("JWT"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Signed(signer).Claims(claims).Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestJWTValidator(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	key := newSigningKey(t, "k1")
+	validator, err := NewJWTValidator(JWTOptions{
+		JWKSFile:        writeJWKS(t, key),
+		Issuer:          testIssuer,
+		Audiences:       []string{"tallyport", "metrics"},
+		Algorithms:      []string{"ES256"},
+		Leeway:          time.Minute,
+		IDClaim:         "sub",
+		TenantClaim:     "org",
+		OperationsClaim: "scope",
+		LabelClaims:     map[string]string{"app_id": "app"},
+	})
+	if err != nil {
+		t.Fatalf("NewJWTValidator: %v", err)
+	}
+
+	claims := func(change func(c map[string]any)) map[string]any {
+		c := map[string]any{
+			"iss":    testIssuer,
+			"aud":    []string{"metrics"},
+			"exp":    jwt.NewNumericDate(now.Add(time.Hour)),
+			"sub":    "mobile-app",
+			"org":    "acme",
+			"app_id": "ios",
+			"scope":  "openid push read",
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+	otherKey := newSigningKey(t, "k1")
+
+	tests := []struct {
+		name  string
+		token string
+		want  Identity
+		err   error
+	}{
+		{
+			name:  "valid",
+			token: signToken(t, key, jose.ES256, claims(nil)),
+			want: Identity{ID: "mobile-app", Method: MethodJWT, Tenant: "acme", Scope: Scope{
+				Operations: []string{OperationPush, OperationRead},
+				Labels:     map[string][]string{"app": {"ios"}},
+			}},
+		},
+		{
+			name:  "operations listed",
+			token: signToken(t, key, jose.ES256, claims(func(c map[string]any) { c["scope"] = []string{"init", "init", "admin"} })),
+			want: Identity{ID: "mobile-app", Method: MethodJWT, Tenant: "acme", Scope: Scope{
+				Operations: []string{OperationInit},
+				Labels:     map[string][]string{"app": {"ios"}},
+			}},
+		},
+		{
+			name:  "expired within leeway",
+			token: signToken(t, key, jose.ES256, claims(func(c map[string]any) { c["exp"] = jwt.NewNumericDate(now.Add(-30 * time.Second)) })),
+			want: Identity{ID: "mobile-app", Method: MethodJWT, Tenant: "acme", Scope: Scope{
+				Operations: []string{OperationPush, OperationRead},
+				Labels:     map[string][]string{"app": {"ios"}},
+			}},
+		},
+		{
+			name:  "expired",
+			token: signToken(t, key, jose.ES256, claims(func(c map[string]any) { c["exp"] = jwt.NewNumericDate(now.Add(-time.Hour)) })),
+			err:   ErrTokenExpired,
+		},
+		{
+			name:  "not valid yet",
+			token: signToken(t, key, jose.ES256, claims(func(c map[string]any) { c["nbf"] = jwt.NewNumericDate(now.Add(time.Hour)) })),
+			err:   ErrTokenExpired,
+		},
+		{
+			name:  "no expiry",
+			token: signToken(t, key, jose.ES256, claims(func(c map[string]any) { delete(c, "exp") })),
+			err:   ErrTokenClaims,
+		},
+		{
+			name:  "other issuer",
+			token: signToken(t, key, jose.ES256, claims(func(c map[string]any) { c["iss"] = "https://other.test" })),
+			err:   ErrTokenIssuer,
+		},
+		{
+			name:  "other audience",
+			token: signToken(t, key, jose.ES256, claims(func(c map[string]any) { c["aud"] = "billing" })),
+			err:   ErrTokenAudience,
+		},
+		{
+			name:  "no id",
+			token: signToken(t, key, jose.ES256, claims(func(c map[string]any) { delete(c, "sub") })),
+			err:   ErrTokenClaims,
+		},
+		{
+			name:  "no tenant",
+			token: signToken(t, key, jose.ES256, claims(func(c map[string]any) { c["org"] = 42 })),
+			err:   ErrTokenClaims,
+		},
+		{
+			name:  "no label claim",
+			token: signToken(t, key, jose.ES256, claims(func(c map[string]any) { delete(c, "app_id") })),
+			err:   ErrTokenClaims,
+		},
+		{
+			name:  "no tallyport operation",
+			token: signToken(t, key, jose.ES256, claims(func(c map[string]any) { c["scope"] = "openid profile" })),
+			want: Identity{ID: "mobile-app", Method: MethodJWT, Tenant: "acme", Scope: Scope{
+				Labels: map[string][]string{"app": {"ios"}},
+			}},
+			err: ErrNoOperations,
+		},
+		{
+			name:  "signed by another key",
+			token: signToken(t, otherKey, jose.ES256, claims(nil)),
+			err:   ErrTokenSignature,
+		},
+		{
+			name:  "unknown key id",
+			token: signToken(t, newSigningKey(t, "k2"), jose.ES256, claims(nil)),
+			err:   ErrTokenSignature,
+		},
+		{
+			name:  "algorithm not accepted",
+			token: signToken(t, jose.JSONWebKey{Key: []byte("0123456789abcdef0123456789abcdef"), KeyID: "k1"}, jose.HS256, claims(nil)),
+			err:   ErrTokenMalformed,
+		},
+		{
+			name:  "not a token",
+			token: "a.b.c",
+			err:   ErrTokenMalformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := validator.Validate(tt.token, now)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Validate() error = %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(identity, tt.want) {
+				t.Errorf("Validate() = %+v, want %+v", identity, tt.want)
+			}
+		})
+	}
+}
+
+func TestJWTValidatorReload(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	oldKey, newKey := newSigningKey(t, "old"), newSigningKey(t, "new")
+	path := writeJWKS(t, oldKey)
+	validator, err := NewJWTValidator(JWTOptions{
+		JWKSFile:   path,
+		Issuer:     testIssuer,
+		Audiences:  []string{"tallyport"},
+		Algorithms: []string{"ES256"},
+		IDClaim:    "sub",
+	})
+	if err != nil {
+		t.Fatalf("NewJWTValidator: %v", err)
+	}
+	claims := map[string]any{"iss": testIssuer, "aud": "tallyport", "sub": "app", "exp": jwt.NewNumericDate(now.Add(time.Hour))}
+	oldToken, newToken := signToken(t, oldKey, jose.ES256, claims), signToken(t, newKey, jose.ES256, claims)
+
+	replace := func(keys ...jose.JSONWebKey) {
+		t.Helper()
+		if err := os.Rename(writeJWKS(t, keys...), path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	replace(newKey)
+	if err := validator.Reload(); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if _, err := validator.Validate(oldToken, now); !errors.Is(err, ErrTokenSignature) {
+		t.Errorf("token of a rotated out key: error = %v, want %v", err, ErrTokenSignature)
+	}
+	if _, err := validator.Validate(newToken, now); err != nil {
+		t.Errorf("token of the new key: %v", err)
+	}
+
+	// A key set without signing keys is refused and the previous keys stay in use.
+	encryption := newKey
+	encryption.Use = "enc"
+	replace(encryption)
+	if err := validator.Reload(); err == nil {
+		t.Error("Reload accepted a JWKS file without signing keys")
+	}
+	if _, err := validator.Validate(newToken, now); err != nil {
+		t.Errorf("token of the kept key: %v", err)
+	}
+}
+
+func TestNewJWTValidatorRefusesSymmetricAlgorithms(t *testing.T) {
+	_, err := NewJWTValidator(JWTOptions{
+		JWKSFile:   writeJWKS(t, newSigningKey(t, "k1")),
+		Algorithms: []string{"ES256", "HS256"},
+	})
+	if err == nil {
+		t.Fatal("NewJWTValidator accepted HS256")
+	}
+}
@@ -0,0 +1,146 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v2"
+)
+
+// MethodAPIKey identifies clients authenticated with an API key.
+const MethodAPIKey = "api_key"
+
+// keyPrefix starts every generated API key, which makes leaked keys easy to search for.
+const keyPrefix = "tp_"
+
+// Key is an API key as stored at rest: only the SHA-256 hash of the secret is kept, along with
+// the signing secret of keys that sign their requests.
+type Key struct {
+	ID       string           `yaml:"id"`       // Identifier of the key, used in logs and metrics
+	SHA256   string           `yaml:"sha256"`   // Hex encoded SHA-256 hash of the secret
+	Disabled bool             `yaml:"disabled"` // Disabled keys are recognised but refused
+	Tenant   string           `yaml:"tenant"`   // Tenant the key is bound to; empty when it may choose one
+	Scope    `yaml:",inline"` // What the key may do; unlimited when empty
+
+	// SigningSecret, when set, is the HMAC secret the key signs its requests with. Requests
+	// that create or update metrics must then be signed instead of carrying the key.
+	SigningSecret string `yaml:"signing_secret"`
+}
+
+// keyFile is the YAML layout of an API key file.
+type keyFile struct {
+	Keys []Key `yaml:"keys"`
+}
+
+// KeyStore looks up API keys by the hash of their secret or, for signed requests, by id.
+type KeyStore struct {
+	keys map[[sha256.Size]byte]Key
+	byID map[string]Key
+}
+
+// GenerateKey creates a random API key.
+//
+// Returns:
+//   - string: The secret, to be handed to the client.
+//   - string: Its hash, to be stored in the key file or configuration.
+//   - An error if no randomness is available.
+func GenerateKey() (string, string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", "", fmt.Errorf("failed to generate key: %w", err)
+	}
+	secret := keyPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	return secret, HashKey(secret), nil
+}
+
+// HashKey returns the hex encoded SHA-256 hash under which secret is stored.
+func HashKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// LoadKeyStore builds a KeyStore from a key file and keys given inline as id to hash. Inline
+// keys are not limited by a scope.
+//
+// Parameters:
+//   - file: YAML file with a list of keys; ignored when empty.
+//   - inline: Additional keys mapped from id to hex encoded SHA-256 hash.
+//
+// Returns:
+//   - *KeyStore: The keys.
+//   - An error if the file cannot be read, or a key has no id, an invalid hash or scope, or a
+//     duplicate id or hash.
+func LoadKeyStore(file string, inline map[string]string) (*KeyStore, error) {
+	var keys []Key
+	if file != "" {
+		raw, err := os.ReadFile(filepath.Clean(file))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %w", err)
+		}
+		var parsed keyFile
+		if err := yaml.UnmarshalStrict(raw, &parsed); err != nil {
+			return nil, fmt.Errorf("failed to parse key file %s: %w", file, err)
+		}
+		keys = parsed.Keys
+	}
+
+	ids := make([]string, 0, len(inline))
+	for id := range inline {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	for _, id := range ids {
+		keys = append(keys, Key{ID: id, SHA256: inline[id]})
+	}
+
+	ks := &KeyStore{
+		keys: make(map[[sha256.Size]byte]Key, len(keys)),
+		byID: make(map[string]Key, len(keys)),
+	}
+	for _, key := range keys {
+		if key.ID == "" {
+			return nil, fmt.Errorf("key with hash %.8s... has no id", key.SHA256)
+		}
+		if _, ok := ks.byID[key.ID]; ok {
+			return nil, fmt.Errorf("duplicate key id %q", key.ID)
+		}
+
+		raw, err := hex.DecodeString(key.SHA256)
+		if err != nil || len(raw) != sha256.Size {
+			return nil, fmt.Errorf("key %q: sha256 must be %d hex characters", key.ID, 2*sha256.Size)
+		}
+		hash := [sha256.Size]byte(raw)
+		if other, ok := ks.keys[hash]; ok {
+			return nil, fmt.Errorf("keys %q and %q share the same secret", other.ID, key.ID)
+		}
+		if err := key.Scope.Validate(); err != nil {
+			return nil, fmt.Errorf("key %q: %w", key.ID, err)
+		}
+		ks.keys[hash] = key
+		ks.byID[key.ID] = key
+	}
+	return ks, nil
+}
+
+// Lookup returns the key whose secret is secret.
+func (ks *KeyStore) Lookup(secret string) (Key, bool) {
+	key, ok := ks.keys[sha256.Sum256([]byte(secret))]
+	return key, ok
+}
+
+// LookupID returns the key called id.
+func (ks *KeyStore) LookupID(id string) (Key, bool) {
+	key, ok := ks.byID[id]
+	return key, ok
+}
+
+// Len returns the number of keys in the store.
+func (ks *KeyStore) Len() int {
+	return len(ks.keys)
+}
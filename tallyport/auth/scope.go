@@ -0,0 +1,154 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Operations a credential can be limited to.
+const (
+	OperationInit   = "init"   // Create metrics
+	OperationPush   = "push"   // Update metrics
+	OperationDelete = "delete" // Delete metrics
+	OperationRead   = "read"   // List, describe and follow metrics
+)
+
+// Operations lists every operation a scope can allow.
+var Operations = []string{OperationInit, OperationPush, OperationDelete, OperationRead}
+
+// Scope limits what a credential may do. Empty fields do not limit anything, so the zero
+// Scope allows every operation on every metric.
+type Scope struct {
+	Operations     []string            `yaml:"operations"`      // Allowed operations
+	MetricPrefixes []string            `yaml:"metric_prefixes"` // Metric names must start with one of these
+	Labels         map[string][]string `yaml:"labels"`          // Labels every series must carry, with their allowed values
+}
+
+// Validate reports unknown operations and label constraints without allowed values.
+func (s Scope) Validate() error {
+	for _, operation := range s.Operations {
+		if !slices.Contains(Operations, operation) {
+			return fmt.Errorf("unknown operation %q, expected one of %s", operation, strings.Join(Operations, ", "))
+		}
+	}
+	for label, values := range s.Labels {
+		if len(values) == 0 {
+			return fmt.Errorf("label %s lists no allowed values", label)
+		}
+	}
+	return nil
+}
+
+// AllowsOperation reports whether the scope allows operation.
+func (s Scope) AllowsOperation(operation string) bool {
+	return len(s.Operations) == 0 || slices.Contains(s.Operations, operation)
+}
+
+// AllowsMetric reports whether the scope covers the metric called name.
+func (s Scope) AllowsMetric(name string) bool {
+	if len(s.MetricPrefixes) == 0 {
+		return true
+	}
+	for _, prefix := range s.MetricPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckMetric checks that the metric called name is covered by the scope.
+func (s Scope) CheckMetric(name string) error {
+	if !s.AllowsMetric(name) {
+		return fmt.Errorf("metric %s does not start with %s", name, strings.Join(s.MetricPrefixes, " or "))
+	}
+	return nil
+}
+
+// CheckDefinition checks a metric about to be created: its name must be covered by the scope
+// and it must declare every constrained label, since the credential could not push to it otherwise.
+//
+// Parameters:
+//   - name: Name of the metric.
+//   - labelNames: Label names the metric declares.
+//
+// Returns:
+//   - An error describing why the metric is outside the scope, or nil.
+func (s Scope) CheckDefinition(name string, labelNames []string) error {
+	if err := s.CheckMetric(name); err != nil {
+		return err
+	}
+	for _, label := range s.constrainedLabels() {
+		if !slices.Contains(labelNames, label) {
+			return fmt.Errorf("metric %s must declare label %s", name, label)
+		}
+	}
+	return nil
+}
+
+// CheckSeries checks a series about to be written: its metric must be covered by the scope and
+// every constrained label must carry one of its allowed values.
+//
+// Parameters:
+//   - name: Name of the metric.
+//   - labels: Label values of the series by label name.
+//
+// Returns:
+//   - An error describing why the series is outside the scope, or nil.
+func (s Scope) CheckSeries(name string, labels map[string]string) error {
+	if !s.AllowsMetric(name) {
+		return fmt.Errorf("metric %s does not start with %s", name, strings.Join(s.MetricPrefixes, " or "))
+	}
+	for _, label := range s.constrainedLabels() {
+		value, ok := labels[label]
+		if !ok {
+			return fmt.Errorf("series of %s has no %s label", name, label)
+		}
+		if !slices.Contains(s.Labels[label], value) {
+			return fmt.Errorf("%s=%q is not allowed, expected one of %s", label, value, strings.Join(s.Labels[label], ", "))
+		}
+	}
+	return nil
+}
+
+// NarrowPrefixes limits the metric name prefixes a client asked for to the ones the scope covers.
+// Without a request, the scope's own prefixes are used.
+//
+// Parameters:
+//   - requested: Prefixes asked for; empty for every metric.
+//
+// Returns:
+//   - []string: Prefixes to filter by; empty for every metric.
+//   - bool: False when none of the requested prefixes can match a covered metric.
+func (s Scope) NarrowPrefixes(requested []string) ([]string, bool) {
+	if len(s.MetricPrefixes) == 0 {
+		return requested, true
+	}
+	if len(requested) == 0 {
+		return s.MetricPrefixes, true
+	}
+
+	var narrowed []string
+	for _, want := range requested {
+		for _, allowed := range s.MetricPrefixes {
+			switch {
+			case strings.HasPrefix(want, allowed):
+				narrowed = append(narrowed, want)
+			case strings.HasPrefix(allowed, want):
+				narrowed = append(narrowed, allowed)
+			}
+		}
+	}
+	return narrowed, len(narrowed) > 0
+}
+
+// constrainedLabels returns the names of the constrained labels in a stable order.
+func (s Scope) constrainedLabels() []string {
+	labels := make([]string, 0, len(s.Labels))
+	for label := range s.Labels {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+	return labels
+}
@@ -0,0 +1,238 @@
+package auth
+
+import (
+	"container/heap"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MethodSignature identifies clients authenticated with an HMAC request signature.
+const MethodSignature = "signature"
+
+// Headers of a signed request.
+const (
+	KeyIDHeader     = "X-Tallyport-Key-Id"    // Id of the key whose signing secret signed the request
+	TimestampHeader = "X-Tallyport-Timestamp" // Unix time in seconds the request was signed at
+	NonceHeader     = "X-Tallyport-Nonce"     // Random value never sent twice by the same key
+	SignatureHeader = "X-Tallyport-Signature" // Hex encoded HMAC-SHA256 of the request, see Sign
+)
+
+// DefaultTenantHeader is the header naming the tenant of a request unless tenant_config.header
+// names another one. Its value is signed, so a signed request cannot be moved to another tenant.
+const DefaultTenantHeader = "X-Tallyport-Tenant"
+
+// maxNonceLength bounds the nonces kept in a NonceCache.
+const maxNonceLength = 128
+
+// Reasons a signed request is refused.
+var (
+	ErrStaleTimestamp = errors.New("request timestamp is outside the accepted window")
+	ErrReplayedNonce  = errors.New("request nonce was already used")
+	ErrBadSignature   = errors.New("request signature does not match")
+)
+
+// GenerateSigningSecret creates a random secret for signing requests.
+func GenerateSigningSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", fmt.Errorf("failed to generate signing secret: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// Sign computes the signature of a request: the hex encoded HMAC-SHA256, keyed with secret, of
+//
+//	METHOD "\n" PATH "\n" QUERY "\n" TENANT "\n" TIMESTAMP "\n" NONCE "\n" hex(SHA-256(BODY))
+//
+// Parameters:
+//   - secret: Signing secret of the key.
+//   - method: HTTP method of the request, e.g. "POST".
+//   - path: Path of the request URL, without query.
+//   - query: Raw query of the request URL, without "?"; empty when there is none.
+//   - tenant: Value of the tenant header; empty when there is none.
+//   - timestamp: Value of the X-Tallyport-Timestamp header.
+//   - nonce: Value of the X-Tallyport-Nonce header.
+//   - body: Request body.
+//
+// Returns:
+//   - string: Value of the X-Tallyport-Signature header.
+func Sign(secret, method, path, query, tenant, timestamp, nonce string, body []byte) string {
+	digest := sha256.Sum256(body)
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n%s\n%s", method, path, query, tenant, timestamp, nonce, hex.EncodeToString(digest[:]))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// SignRequest signs req for the key called keyID, setting the signature headers with the
+// current time and a random nonce. The query and tenant header must be set before, and a
+// request must be signed again before it is retried.
+//
+// Parameters:
+//   - req: Request to sign; its body must be body.
+//   - keyID: Id of the key.
+//   - secret: Signing secret of the key.
+//   - tenantHeader: Header naming the tenant, tenant_config.header of the server, e.g.
+//     DefaultTenantHeader.
+//   - body: Request body.
+//
+// Returns:
+//   - An error if no randomness is available for the nonce.
+func SignRequest(req *http.Request, keyID, secret, tenantHeader string, body []byte) error {
+	raw := make([]byte, 16)
+	if _, err := rand.Read(raw); err != nil {
+		return fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	nonce := hex.EncodeToString(raw)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	path, query, _ := strings.Cut(req.URL.RequestURI(), "?")
+	var tenant string
+	if tenantHeader != "" {
+		tenant = req.Header.Get(tenantHeader)
+	}
+
+	req.Header.Set(KeyIDHeader, keyID)
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(NonceHeader, nonce)
+	req.Header.Set(SignatureHeader, Sign(secret, req.Method, path, query, tenant, timestamp, nonce, body))
+	return nil
+}
+
+// VerifySignature checks the signature of a request signed with secret. The timestamp must be
+// within maxSkew of now; the nonce is checked separately with a NonceCache.
+//
+// Parameters:
+//   - secret: Signing secret of the key named by the request.
+//   - method, path, query, tenant, timestamp, nonce, body: Parts of the request, as for Sign.
+//   - signature: Value of the X-Tallyport-Signature header.
+//   - now: Current time.
+//   - maxSkew: Largest accepted difference between the timestamp and now.
+//
+// Returns:
+//   - time.Time: The time the request was signed at.
+//   - ErrStaleTimestamp, ErrBadSignature or an error describing a malformed header, or nil.
+func VerifySignature(secret, method, path, query, tenant, timestamp, nonce string, body []byte, signature string, now time.Time, maxSkew time.Duration) (time.Time, error) {
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s must be a Unix time in seconds", TimestampHeader)
+	}
+	if nonce == "" || len(nonce) > maxNonceLength {
+		return time.Time{}, fmt.Errorf("%s must be between 1 and %d characters", NonceHeader, maxNonceLength)
+	}
+	signedAt := time.Unix(seconds, 0)
+	if now.Sub(signedAt).Abs() > maxSkew {
+		return time.Time{}, ErrStaleTimestamp
+	}
+
+	want := Sign(secret, method, path, query, tenant, timestamp, nonce, body)
+	if !hmac.Equal([]byte(want), []byte(signature)) {
+		return time.Time{}, ErrBadSignature
+	}
+	return signedAt, nil
+}
+
+// NonceCache remembers the nonces of signed requests for as long as their timestamp is
+// accepted, so a captured request cannot be sent again.
+//
+// The cache holds at most capacity nonces. When it is full, the nonce with the oldest
+// timestamp is forgotten and requests signed at or before that timestamp are refused from then
+// on, which keeps replays impossible at the cost of refusing late requests under heavy load.
+// It is safe for concurrent use.
+type NonceCache struct {
+	mu       sync.Mutex
+	capacity int
+	seen     map[string]bool
+	order    nonceHeap
+	floor    int64 // Requests signed at or before this Unix time are refused
+}
+
+type nonceEntry struct {
+	key      string
+	signedAt int64
+}
+
+// nonceHeap orders nonces by the time they were signed at, oldest first.
+type nonceHeap []nonceEntry
+
+func (h nonceHeap) Len() int           { return len(h) }
+func (h nonceHeap) Less(i, j int) bool { return h[i].signedAt < h[j].signedAt }
+func (h nonceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *nonceHeap) Push(x any)        { *h = append(*h, x.(nonceEntry)) }
+func (h *nonceHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// NewNonceCache creates a NonceCache holding at most capacity nonces.
+func NewNonceCache(capacity int) *NonceCache {
+	return &NonceCache{
+		capacity: max(capacity, 1),
+		seen:     make(map[string]bool),
+	}
+}
+
+// Resize changes the number of nonces the cache holds, forgetting the oldest ones if needed.
+func (nc *NonceCache) Resize(capacity int) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	nc.capacity = max(capacity, 1)
+	for nc.order.Len() > nc.capacity {
+		nc.evict()
+	}
+}
+
+// Use records the nonce of a request signed by keyID at signedAt.
+//
+// Parameters:
+//   - keyID: Id of the key that signed the request; nonces are only unique per key.
+//   - nonce: Nonce of the request.
+//   - signedAt: Time the request was signed at, as returned by VerifySignature.
+//   - now: Current time.
+//   - maxSkew: Largest accepted difference between signedAt and now.
+//
+// Returns:
+//   - ErrReplayedNonce if the nonce was already used, ErrStaleTimestamp if the request is
+//     older than the nonces still remembered, or nil.
+func (nc *NonceCache) Use(keyID, nonce string, signedAt, now time.Time, maxSkew time.Duration) error {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	// Nonces whose timestamp is no longer accepted cannot be replayed anyway.
+	expired := now.Add(-maxSkew).Unix()
+	for nc.order.Len() > 0 && nc.order[0].signedAt < expired {
+		delete(nc.seen, heap.Pop(&nc.order).(nonceEntry).key)
+	}
+
+	key := keyID + "\x00" + nonce
+	if nc.seen[key] {
+		return ErrReplayedNonce
+	}
+	if nc.order.Len() >= nc.capacity {
+		nc.evict()
+	}
+	if signedAt.Unix() <= nc.floor {
+		return ErrStaleTimestamp
+	}
+
+	nc.seen[key] = true
+	heap.Push(&nc.order, nonceEntry{key: key, signedAt: signedAt.Unix()})
+	return nil
+}
+
+// evict forgets the oldest nonce and refuses requests signed before it from then on.
+func (nc *NonceCache) evict() {
+	entry := heap.Pop(&nc.order).(nonceEntry)
+	delete(nc.seen, entry.key)
+	nc.floor = max(nc.floor, entry.signedAt)
+}
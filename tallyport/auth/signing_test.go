@@ -0,0 +1,202 @@
+package auth
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testSecret = "9duo1r4gS2RbJz_EnD-CZ0dkO1iBJBmKlhtkzw5olfc"
+
+func TestVerifySignature(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	body := []byte(`{"type":"counter","name":"app_requests_total"}`)
+	timestamp := "1760000000"
+	signature := Sign(testSecret, "POST", "/ingest", "instance=a", "acme", timestamp, "n-1", body)
+
+	type request struct {
+		method, path, query, tenant, timestamp, nonce string
+		body                                          []byte
+		signature                                     string
+	}
+	signed := request{"POST", "/ingest", "instance=a", "acme", timestamp, "n-1", body, signature}
+
+	tests := []struct {
+		name   string
+		change func(r *request)
+		want   error
+	}{
+		{name: "valid", change: func(r *request) {}},
+		{name: "other method", change: func(r *request) { r.method = "PUT" }, want: ErrBadSignature},
+		{name: "other path", change: func(r *request) { r.path = "/push" }, want: ErrBadSignature},
+		{name: "other query", change: func(r *request) { r.query = "instance=b" }, want: ErrBadSignature},
+		{name: "query dropped", change: func(r *request) { r.query = "" }, want: ErrBadSignature},
+		{name: "other tenant", change: func(r *request) { r.tenant = "globex" }, want: ErrBadSignature},
+		{name: "tenant dropped", change: func(r *request) { r.tenant = "" }, want: ErrBadSignature},
+		{name: "other nonce", change: func(r *request) { r.nonce = "n-2" }, want: ErrBadSignature},
+		{name: "other body", change: func(r *request) { r.body = []byte(`{}`) }, want: ErrBadSignature},
+		{name: "other secret", change: func(r *request) {
+			r.signature = Sign("other", r.method, r.path, r.query, r.tenant, r.timestamp, r.nonce, r.body)
+		}, want: ErrBadSignature},
+		{name: "signed too early", change: func(r *request) {
+			r.timestamp = "1759999000"
+			r.signature = Sign(testSecret, r.method, r.path, r.query, r.tenant, r.timestamp, r.nonce, r.body)
+		}, want: ErrStaleTimestamp},
+		{name: "signed in the future", change: func(r *request) {
+			r.timestamp = "1760001000"
+			r.signature = Sign(testSecret, r.method, r.path, r.query, r.tenant, r.timestamp, r.nonce, r.body)
+		}, want: ErrStaleTimestamp},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := signed
+			tt.change(&r)
+			signedAt, err := VerifySignature(testSecret, r.method, r.path, r.query, r.tenant, r.timestamp, r.nonce,
+				r.body, r.signature, now, 5*time.Minute)
+			if !errors.Is(err, tt.want) {
+				t.Fatalf("VerifySignature() error = %v, want %v", err, tt.want)
+			}
+			if err == nil && !signedAt.Equal(now) {
+				t.Errorf("signed at %s, want %s", signedAt, now)
+			}
+		})
+	}
+}
+
+func TestVerifySignatureRefusesMalformedHeaders(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	tests := []struct {
+		name, timestamp, nonce, want string
+	}{
+		{name: "timestamp not a number", timestamp: "yesterday", nonce: "n-1", want: TimestampHeader},
+		{name: "timestamp in milliseconds", timestamp: "1760000000.5", nonce: "n-1", want: TimestampHeader},
+		{name: "empty nonce", timestamp: "1760000000", nonce: "", want: NonceHeader},
+		{name: "nonce too long", timestamp: "1760000000", nonce: strings.Repeat("n", maxNonceLength+1), want: NonceHeader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signature := Sign(testSecret, "POST", "/push", "", "", tt.timestamp, tt.nonce, nil)
+			_, err := VerifySignature(testSecret, "POST", "/push", "", "", tt.timestamp, tt.nonce, nil, signature, now, time.Minute)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("VerifySignature() error = %v, want one naming %s", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestSignRequestCoversQueryAndTenant(t *testing.T) {
+	body := []byte(`app_requests_total 1`)
+	req, err := http.NewRequest(http.MethodPost, "http://tallyport.test/ingest?instance=a&job=app", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set(DefaultTenantHeader, "acme")
+	if err := SignRequest(req, "mobile-app", testSecret, DefaultTenantHeader, body); err != nil {
+		t.Fatalf("SignRequest: %v", err)
+	}
+	if got := req.Header.Get(KeyIDHeader); got != "mobile-app" {
+		t.Errorf("%s = %q, want mobile-app", KeyIDHeader, got)
+	}
+
+	verify := func(query, tenant string) error {
+		_, err := VerifySignature(testSecret, req.Method, "/ingest", query, tenant, req.Header.Get(TimestampHeader),
+			req.Header.Get(NonceHeader), body, req.Header.Get(SignatureHeader), time.Now(), time.Minute)
+		return err
+	}
+	if err := verify("instance=a&job=app", "acme"); err != nil {
+		t.Errorf("signed request does not verify: %v", err)
+	}
+	if err := verify("instance=b&job=app", "acme"); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("request moved to another instance: error = %v, want %v", err, ErrBadSignature)
+	}
+	if err := verify("instance=a&job=app", "globex"); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("request moved to another tenant: error = %v, want %v", err, ErrBadSignature)
+	}
+}
+
+func TestNonceCache(t *testing.T) {
+	const skew = time.Minute
+	now := time.Unix(1760000000, 0)
+	ago := func(seconds int) time.Time { return now.Add(-time.Duration(seconds) * time.Second) }
+
+	type use struct {
+		key, nonce string
+		signedAt   time.Time
+		want       error
+	}
+	tests := []struct {
+		name     string
+		capacity int
+		uses     []use
+	}{
+		{
+			name:     "replayed nonce",
+			capacity: 10,
+			uses: []use{
+				{"app", "n-1", ago(5), nil},
+				{"app", "n-2", ago(5), nil},
+				{"app", "n-1", ago(5), ErrReplayedNonce},
+			},
+		},
+		{
+			name:     "nonces are only unique per key",
+			capacity: 10,
+			uses: []use{
+				{"app", "n-1", ago(5), nil},
+				{"web", "n-1", ago(5), nil},
+			},
+		},
+		{
+			name:     "full cache refuses requests signed before the evicted nonce",
+			capacity: 2,
+			uses: []use{
+				{"app", "n-1", ago(30), nil},
+				{"app", "n-2", ago(20), nil},
+				{"app", "n-3", ago(10), nil}, // Evicts n-1, signed 30s ago.
+				{"app", "n-1", ago(30), ErrStaleTimestamp},
+				{"app", "n-4", ago(40), ErrStaleTimestamp},
+				{"app", "n-5", ago(5), nil},
+			},
+		},
+		{
+			name:     "expired nonces free up room without raising the floor",
+			capacity: 1,
+			uses: []use{
+				{"app", "n-1", ago(90), nil}, // Only accepted by a larger skew, expires right away.
+				{"app", "n-2", ago(50), nil},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nc := NewNonceCache(tt.capacity)
+			for i, u := range tt.uses {
+				if err := nc.Use(u.key, u.nonce, u.signedAt, now, skew); !errors.Is(err, u.want) {
+					t.Fatalf("use %d (%s %s): error = %v, want %v", i, u.key, u.nonce, err, u.want)
+				}
+			}
+		})
+	}
+}
+
+func TestNonceCacheResizeEvictsOldest(t *testing.T) {
+	now := time.Unix(1760000000, 0)
+	nc := NewNonceCache(3)
+	for i, nonce := range []string{"n-1", "n-2", "n-3"} {
+		if err := nc.Use("app", nonce, now.Add(time.Duration(i-3)*time.Second), now, time.Minute); err != nil {
+			t.Fatalf("Use(%s): %v", nonce, err)
+		}
+	}
+
+	nc.Resize(1)
+
+	if err := nc.Use("app", "n-3", now.Add(-time.Second), now, time.Minute); !errors.Is(err, ErrReplayedNonce) {
+		t.Errorf("replay of a kept nonce: error = %v, want %v", err, ErrReplayedNonce)
+	}
+	// n-1 and n-2 were forgotten, so requests signed at or before n-2 are refused.
+	if err := nc.Use("app", "n-1", now.Add(-3*time.Second), now, time.Minute); !errors.Is(err, ErrStaleTimestamp) {
+		t.Errorf("replay of an evicted nonce: error = %v, want %v", err, ErrStaleTimestamp)
+	}
+}
@@ -0,0 +1,400 @@
+// Package client is the Go SDK for pushing metrics to a tallyport server.
+//
+// Metrics are declared once as typed handles and used like Prometheus metrics:
+//
+//	c, err := client.New(client.Options{BaseURL: "http://localhost:8080"})
+//	if err != nil {
+//		return err
+//	}
+//	defer c.Close()
+//
+//	requests := c.Counter("checkout_requests_total", "Checkout requests", "method")
+//	requests.Inc("POST")
+//
+// Every metric is initialised on the server the first time it is pushed. Pushes are queued in
+// memory and sent in the background, retrying 429, 5xx and the server's throttle status code
+// with backoff. When the server stays unreachable, pushes are written to an optional spool file
+// and replayed once it is back.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"tallyport/api"
+	"tallyport/auth"
+	"tallyport/registry"
+	"time"
+)
+
+// Defaults used when the matching Options field is not set.
+const (
+	defaultTimeout       = 10 * time.Second
+	defaultFlushInterval = time.Second
+	defaultBatchSize     = 500
+	defaultMaxQueueSize  = 10000
+	defaultMaxRetries    = 5
+	defaultMinBackoff    = 100 * time.Millisecond
+	defaultMaxBackoff    = 10 * time.Second
+)
+
+// Options configures a Client. Only BaseURL is required.
+type Options struct {
+	BaseURL            string        // Address of the tallyport server, e.g. "http://localhost:8080".
+	HTTPClient         *http.Client  // Client used for requests; a client with a 10s timeout by default.
+	Headers            http.Header   // Extra headers sent with every request, e.g. credentials.
+	SigningKeyID       string        // Id of the API key whose SigningSecret signs every request.
+	SigningSecret      string        // Signing secret of the key; requests are not signed when empty.
+	TenantHeader       string        // Header naming the tenant (tenant_config.header), signed with the request; auth.DefaultTenantHeader by default.
+	FlushInterval      time.Duration // Interval between background flushes of the queue.
+	BatchSize          int           // Queued pushes that trigger a flush before the interval.
+	MaxQueueSize       int           // Queued pushes kept in memory before they are spooled or dropped.
+	MaxRetries         int           // Retries of a request after a recoverable error.
+	MinBackoff         time.Duration // Initial retry backoff, doubled after every retry.
+	MaxBackoff         time.Duration // Upper bound of the retry backoff.
+	ThrottleStatusCode int           // Status the server throttles with (throttle_config.status_code), retried like 429.
+	SpoolPath          string        // File pushes are spooled to while the server is unreachable; disabled when empty.
+	OnError            func(error)   // Called for pushes that are rejected or lost; errors are ignored when nil.
+}
+
+// queuedPush is a push waiting to be sent, together with the definition used to initialise its metric.
+type queuedPush struct {
+	Init registry.MetricRequest `json:"init"`
+	Push registry.MetricRequest `json:"push"`
+}
+
+// statusError is a request answered with a non-2xx status.
+type statusError struct {
+	status     int
+	reason     string
+	retryAfter time.Duration
+}
+
+func (se *statusError) Error() string {
+	return fmt.Sprintf("server returned HTTP status %d: %s", se.status, se.reason)
+}
+
+// Client queues pushes for typed metric handles and sends them to tallyport in the background.
+// It is safe for concurrent use.
+type Client struct {
+	opts  Options
+	http  *http.Client
+	spool *spool
+
+	mu    sync.Mutex
+	queue []queuedPush
+
+	// initialized holds the names of metrics known to exist on the server.
+	initialized sync.Map
+
+	flushMu sync.Mutex
+	wake    chan struct{}
+	done    chan struct{}
+	wg      sync.WaitGroup
+	closed  sync.Once
+}
+
+// New creates a Client and starts its background flush loop.
+//
+// Parameters:
+//   - opts: Client options; BaseURL is required.
+//
+// Returns:
+//   - *Client: The client, to be closed with Close.
+//   - An error if BaseURL is missing, or SigningSecret is set without SigningKeyID.
+func New(opts Options) (*Client, error) {
+	if strings.TrimSpace(opts.BaseURL) == "" {
+		return nil, errors.New("client: BaseURL is required")
+	}
+	opts.BaseURL = strings.TrimRight(opts.BaseURL, "/")
+	if opts.SigningSecret != "" && opts.SigningKeyID == "" {
+		return nil, errors.New("client: SigningKeyID is required with SigningSecret")
+	}
+
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = &http.Client{Timeout: defaultTimeout}
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = defaultFlushInterval
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultBatchSize
+	}
+	if opts.MaxQueueSize <= 0 {
+		opts.MaxQueueSize = defaultMaxQueueSize
+	}
+	if opts.MaxRetries <= 0 {
+		opts.MaxRetries = defaultMaxRetries
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff <= 0 {
+		opts.MaxBackoff = defaultMaxBackoff
+	}
+	if opts.TenantHeader == "" {
+		opts.TenantHeader = auth.DefaultTenantHeader
+	}
+
+	c := &Client{
+		opts: opts,
+		http: opts.HTTPClient,
+		wake: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+	if opts.SpoolPath != "" {
+		c.spool = &spool{path: opts.SpoolPath}
+	}
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		c.run()
+	}()
+	return c, nil
+}
+
+// Flush sends every queued push, and any spooled ones, before returning.
+// Pushes that cannot be delivered are spooled when a spool is configured.
+func (c *Client) Flush(ctx context.Context) error {
+	c.flushMu.Lock()
+	defer c.flushMu.Unlock()
+
+	c.mu.Lock()
+	batch := c.queue
+	c.queue = nil
+	c.mu.Unlock()
+
+	if c.spool != nil {
+		spooled, err := c.spool.drain()
+		if err != nil {
+			c.report(err)
+		}
+		batch = append(spooled, batch...)
+	}
+	batch = coalesce(batch)
+
+	for i, item := range batch {
+		err := c.deliver(ctx, item)
+		if err == nil {
+			continue
+		}
+		if !recoverable(err) {
+			c.report(fmt.Errorf("push of %s rejected: %w", item.Push.Name, err))
+			continue
+		}
+		// The server is unreachable or overloaded: keep the rest of the batch for later.
+		return c.keep(batch[i:], err)
+	}
+	return nil
+}
+
+// Close stops the background loop after a final flush. Pushes made after Close are dropped.
+func (c *Client) Close() error {
+	var err error
+	c.closed.Do(func() {
+		close(c.done)
+		c.wg.Wait()
+		err = c.Flush(context.Background())
+	})
+	return err
+}
+
+func (c *Client) run() {
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-c.wake:
+		case <-c.done:
+			return
+		}
+		if err := c.Flush(context.Background()); err != nil {
+			c.report(err)
+		}
+	}
+}
+
+// enqueue queues a push and wakes the flush loop once a batch is full.
+func (c *Client) enqueue(def *registry.MetricRequest, push registry.MetricRequest) {
+	select {
+	case <-c.done:
+		c.report(fmt.Errorf("push of %s dropped: client is closed", push.Name))
+		return
+	default:
+	}
+
+	item := queuedPush{Init: *def, Push: push}
+
+	c.mu.Lock()
+	if len(c.queue) >= c.opts.MaxQueueSize {
+		c.mu.Unlock()
+		if err := c.keep([]queuedPush{item}, errors.New("queue is full")); err != nil {
+			c.report(err)
+		}
+		return
+	}
+	c.queue = append(c.queue, item)
+	full := len(c.queue) >= c.opts.BatchSize
+	c.mu.Unlock()
+
+	if full {
+		select {
+		case c.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// keep spools pushes that could not be delivered, or reports them as lost without a spool.
+func (c *Client) keep(items []queuedPush, cause error) error {
+	if c.spool == nil {
+		return fmt.Errorf("dropped %d pushes: %w", len(items), cause)
+	}
+	if err := c.spool.append(items); err != nil {
+		return fmt.Errorf("failed to spool %d pushes after %v: %w", len(items), cause, err)
+	}
+	return nil
+}
+
+// deliver initialises the metric of a push when needed and sends the push. A push for a metric
+// the server no longer knows, e.g. after a restart, initialises the metric again once.
+func (c *Client) deliver(ctx context.Context, item queuedPush) error {
+	for attempt := 0; ; attempt++ {
+		if _, ok := c.initialized.Load(item.Init.Name); !ok {
+			err := c.send(ctx, "/init", item.Init)
+			var status *statusError
+			// A conflict means the metric already exists, which is all init-on-first-use needs.
+			if err != nil && !(errors.As(err, &status) && status.status == http.StatusConflict) {
+				return err
+			}
+			c.initialized.Store(item.Init.Name, struct{}{})
+		}
+
+		err := c.send(ctx, "/push", item.Push)
+		var status *statusError
+		if attempt == 0 && errors.As(err, &status) && status.status == http.StatusNotFound {
+			c.initialized.Delete(item.Init.Name)
+			continue
+		}
+		return err
+	}
+}
+
+// send posts body to path, retrying recoverable errors with exponential backoff and full jitter.
+// Retry-After is honoured when the server sends it.
+func (c *Client) send(ctx context.Context, path string, body registry.MetricRequest) error {
+	raw, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	backoff := c.opts.MinBackoff
+	for attempt := 0; ; attempt++ {
+		err := c.post(ctx, path, raw)
+		if err == nil || !recoverable(err) || attempt >= c.opts.MaxRetries {
+			return err
+		}
+
+		wait := time.Duration(rand.Int64N(int64(backoff) + 1))
+		var status *statusError
+		if errors.As(err, &status) && status.retryAfter > 0 {
+			wait = status.retryAfter
+		}
+		backoff = min(backoff*2, c.opts.MaxBackoff)
+
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (c *Client) post(ctx context.Context, path string, raw []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.opts.BaseURL+path, bytes.NewReader(raw))
+	if err != nil {
+		return err
+	}
+	for key, values := range c.opts.Headers {
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.opts.SigningSecret != "" {
+		if err := auth.SignRequest(req, c.opts.SigningKeyID, c.opts.SigningSecret, c.opts.TenantHeader, raw); err != nil {
+			return err
+		}
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	payload, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+	if res.StatusCode/100 == 2 {
+		return nil
+	}
+
+	status := &statusError{status: res.StatusCode, reason: strings.TrimSpace(string(payload))}
+	var response api.MetricResponse
+	if json.Unmarshal(payload, &response) == nil && response.Reason != "" {
+		status.reason = response.Reason
+	}
+	if seconds, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		status.retryAfter = time.Duration(seconds) * time.Second
+	}
+	if status.status == c.opts.ThrottleStatusCode {
+		status.status = http.StatusTooManyRequests
+	}
+	return status
+}
+
+func (c *Client) report(err error) {
+	if c.opts.OnError != nil {
+		c.opts.OnError(err)
+	}
+}
+
+// recoverable reports whether a failed request is worth retrying: network errors, 429 and 5xx.
+func recoverable(err error) bool {
+	var status *statusError
+	if !errors.As(err, &status) {
+		return true
+	}
+	return status.status == http.StatusTooManyRequests || status.status/100 == 5
+}
+
+// coalesce drops gauge pushes overwritten by a later push to the same series in the batch,
+// since only the last value would survive on the server anyway.
+func coalesce(batch []queuedPush) []queuedPush {
+	last := make(map[string]int)
+	for i, item := range batch {
+		if item.Push.Type == registry.TypeGauge {
+			last[item.Push.Name+"\xff"+strings.Join(item.Push.Labels, "\xff")] = i
+		}
+	}
+
+	out := batch[:0:0]
+	for i, item := range batch {
+		if item.Push.Type == registry.TypeGauge &&
+			last[item.Push.Name+"\xff"+strings.Join(item.Push.Labels, "\xff")] != i {
+			continue
+		}
+		out = append(out, item)
+	}
+	return out
+}
@@ -0,0 +1,410 @@
+package client_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"tallyport/api"
+	"tallyport/client"
+	"tallyport/config"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+)
+
+// server is an in-process tallyport whose requests can be made to fail before they reach the API.
+type server struct {
+	*httptest.Server
+	reg *prometheus.Registry
+
+	mu       sync.Mutex
+	failures map[string][]int // Statuses the next requests to a path are answered with.
+	down     atomic.Bool      // Answers every request with 503 while set.
+	requests sync.Map         // Requests received per path, as *atomic.Int64.
+}
+
+func newServer(t *testing.T) *server {
+	t.Helper()
+	reg := prometheus.NewRegistry()
+	handler, err := api.NewHandler(config.Default(), reg, zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewHandler: %v", err)
+	}
+	handler.Start()
+	t.Cleanup(handler.Stop)
+
+	s := &server{reg: reg, failures: make(map[string][]int)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(res http.ResponseWriter, req *http.Request) {
+		counter, _ := s.requests.LoadOrStore(req.URL.Path, new(atomic.Int64))
+		counter.(*atomic.Int64).Add(1)
+
+		if s.down.Load() {
+			http.Error(res, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		s.mu.Lock()
+		var status int
+		if pending := s.failures[req.URL.Path]; len(pending) > 0 {
+			status, s.failures[req.URL.Path] = pending[0], pending[1:]
+		}
+		s.mu.Unlock()
+		if status != 0 {
+			if status == http.StatusTooManyRequests {
+				res.Header().Set("Retry-After", "1")
+			}
+			http.Error(res, http.StatusText(status), status)
+			return
+		}
+		handler.ServeHTTP(res, req)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// fail answers the next requests to path with statuses, in order.
+func (s *server) fail(path string, statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures[path] = append(s.failures[path], statuses...)
+}
+
+func (s *server) count(path string) int64 {
+	counter, ok := s.requests.Load(path)
+	if !ok {
+		return 0
+	}
+	return counter.(*atomic.Int64).Load()
+}
+
+// series returns the gathered series of metric name with the given label values, or nil.
+func (s *server) series(t *testing.T, name string, labelValues ...string) *dto.Metric {
+	t.Helper()
+	families, err := s.reg.Gather()
+	if err != nil {
+		t.Fatalf("gather: %v", err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	metrics:
+		for _, metric := range family.GetMetric() {
+			if len(metric.GetLabel()) != len(labelValues) {
+				continue
+			}
+			for i, pair := range metric.GetLabel() {
+				if pair.GetValue() != labelValues[i] {
+					continue metrics
+				}
+			}
+			return metric
+		}
+	}
+	return nil
+}
+
+// errorLog collects the errors a client reports through OnError.
+type errorLog struct {
+	mu     sync.Mutex
+	errors []error
+}
+
+func (l *errorLog) record(err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errors = append(l.errors, err)
+}
+
+func (l *errorLog) all() []error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]error(nil), l.errors...)
+}
+
+// newClient creates a client that only flushes when asked to, unless opts says otherwise.
+func newClient(t *testing.T, opts client.Options) *client.Client {
+	t.Helper()
+	if opts.FlushInterval == 0 {
+		opts.FlushInterval = time.Hour
+	}
+	if opts.MinBackoff == 0 {
+		opts.MinBackoff = time.Millisecond
+		opts.MaxBackoff = 5 * time.Millisecond
+	}
+	c, err := client.New(opts)
+	if err != nil {
+		t.Fatalf("client.New: %v", err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func flush(t *testing.T, c *client.Client) {
+	t.Helper()
+	if err := c.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+}
+
+func TestTypedHandlesInitializeAndPush(t *testing.T) {
+	srv := newServer(t)
+	errs := &errorLog{}
+	c := newClient(t, client.Options{BaseURL: srv.URL, OnError: errs.record})
+
+	requests := c.Counter("checkout_requests_total", "Checkout requests", "method")
+	battery := c.Gauge("app_battery_percent", "Battery level", "device")
+	latency := c.Histogram("checkout_latency_seconds", "Checkout latency", []float64{0.1, 1, 10}, "method")
+	sizes := c.Summary("checkout_cart_size", "Cart size", map[float64]float64{0.5: 0.05}, time.Minute, "method")
+
+	requests.Inc("POST")
+	requests.Inc("POST")
+	requests.Inc("GET")
+	battery.Set(80, "ios")
+	battery.Set(75, "ios")
+	latency.Observe(0.5, "POST")
+	latency.Observe(3, "POST")
+	sizes.Observe(4, "POST")
+	requests.Inc() // Missing label value, dropped on the client.
+	flush(t, c)
+
+	if got := srv.series(t, "checkout_requests_total", "POST").GetCounter().GetValue(); got != 2 {
+		t.Errorf("checkout_requests_total{method=POST} = %g, want 2", got)
+	}
+	if got := srv.series(t, "checkout_requests_total", "GET").GetCounter().GetValue(); got != 1 {
+		t.Errorf("checkout_requests_total{method=GET} = %g, want 1", got)
+	}
+	if got := srv.series(t, "app_battery_percent", "ios").GetGauge().GetValue(); got != 75 {
+		t.Errorf("app_battery_percent{device=ios} = %g, want 75", got)
+	}
+	histogram := srv.series(t, "checkout_latency_seconds", "POST").GetHistogram()
+	if histogram.GetSampleCount() != 2 || histogram.GetSampleSum() != 3.5 {
+		t.Errorf("checkout_latency_seconds{method=POST} count %d sum %g, want 2 and 3.5",
+			histogram.GetSampleCount(), histogram.GetSampleSum())
+	}
+	summary := srv.series(t, "checkout_cart_size", "POST").GetSummary()
+	if summary.GetSampleCount() != 1 || summary.GetSampleSum() != 4 {
+		t.Errorf("checkout_cart_size{method=POST} count %d sum %g, want 1 and 4",
+			summary.GetSampleCount(), summary.GetSampleSum())
+	}
+
+	// Every metric is initialised once, and the overwritten gauge value is never sent.
+	if got := srv.count("/init"); got != 4 {
+		t.Errorf("init requests = %d, want 4", got)
+	}
+	if got := srv.count("/push"); got != 7 {
+		t.Errorf("push requests = %d, want 7", got)
+	}
+	if got := errs.all(); len(got) != 1 || !strings.Contains(got[0].Error(), "expected 1 label values, got 0") {
+		t.Errorf("reported errors = %v, want the push without label values", got)
+	}
+}
+
+func TestReinitializesDeletedMetric(t *testing.T) {
+	srv := newServer(t)
+	c := newClient(t, client.Options{BaseURL: srv.URL})
+
+	requests := c.Counter("checkout_requests_total", "Checkout requests", "method")
+	requests.Inc("POST")
+	flush(t, c)
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/definitions/checkout_requests_total", nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("delete answered %d, want 200", res.StatusCode)
+	}
+
+	requests.Inc("POST")
+	flush(t, c)
+
+	if got := srv.series(t, "checkout_requests_total", "POST").GetCounter().GetValue(); got != 1 {
+		t.Errorf("checkout_requests_total{method=POST} = %g, want 1 after the metric was recreated", got)
+	}
+	if got := srv.count("/init"); got != 2 {
+		t.Errorf("init requests = %d, want 2", got)
+	}
+}
+
+func TestPushesToMetricInitializedByAnotherClient(t *testing.T) {
+	srv := newServer(t)
+	errs := &errorLog{}
+	first := newClient(t, client.Options{BaseURL: srv.URL})
+	second := newClient(t, client.Options{BaseURL: srv.URL, OnError: errs.record})
+
+	first.Counter("checkout_requests_total", "Checkout requests", "method").Inc("POST")
+	flush(t, first)
+	// The second init is answered with 409, which only means the metric exists.
+	second.Counter("checkout_requests_total", "Checkout requests", "method").Inc("POST")
+	flush(t, second)
+
+	if got := srv.series(t, "checkout_requests_total", "POST").GetCounter().GetValue(); got != 2 {
+		t.Errorf("checkout_requests_total{method=POST} = %g, want 2", got)
+	}
+	if got := errs.all(); len(got) != 0 {
+		t.Errorf("reported errors = %v, want none", got)
+	}
+}
+
+func TestBatchSizeTriggersFlush(t *testing.T) {
+	srv := newServer(t)
+	c := newClient(t, client.Options{BaseURL: srv.URL, BatchSize: 5})
+
+	requests := c.Counter("checkout_requests_total", "Checkout requests", "method")
+	for range 4 {
+		requests.Inc("POST")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if got := srv.count("/push"); got != 0 {
+		t.Fatalf("push requests = %d before the batch was full, want 0", got)
+	}
+
+	requests.Inc("POST")
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.count("/push") < 5 {
+		if time.Now().After(deadline) {
+			t.Fatalf("push requests = %d, want the full batch of 5 without calling Flush", srv.count("/push"))
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFlushIntervalSendsPartialBatch(t *testing.T) {
+	srv := newServer(t)
+	c := newClient(t, client.Options{BaseURL: srv.URL, FlushInterval: 20 * time.Millisecond})
+
+	c.Gauge("app_battery_percent", "Battery level", "device").Set(50, "ios")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for srv.series(t, "app_battery_percent", "ios") == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("gauge was not sent by the background flush")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestRetriesServerErrorsAndThrottling(t *testing.T) {
+	const throttleStatus = 418
+
+	srv := newServer(t)
+	srv.fail("/push", http.StatusServiceUnavailable, throttleStatus, http.StatusInternalServerError)
+	errs := &errorLog{}
+	c := newClient(t, client.Options{BaseURL: srv.URL, ThrottleStatusCode: throttleStatus, OnError: errs.record})
+
+	c.Counter("checkout_requests_total", "Checkout requests", "method").Inc("POST")
+	flush(t, c)
+
+	if got := srv.count("/push"); got != 4 {
+		t.Errorf("push requests = %d, want 3 failures and the one accepted", got)
+	}
+	if got := srv.series(t, "checkout_requests_total", "POST").GetCounter().GetValue(); got != 1 {
+		t.Errorf("checkout_requests_total{method=POST} = %g, want 1", got)
+	}
+	if got := errs.all(); len(got) != 0 {
+		t.Errorf("reported errors = %v, want none", got)
+	}
+}
+
+func TestHonoursRetryAfter(t *testing.T) {
+	srv := newServer(t)
+	srv.fail("/push", http.StatusTooManyRequests)
+	c := newClient(t, client.Options{BaseURL: srv.URL})
+
+	c.Counter("checkout_requests_total", "Checkout requests", "method").Inc("POST")
+	start := time.Now()
+	flush(t, c)
+
+	// The backoff is at most 5ms, so only Retry-After can explain the wait.
+	if elapsed := time.Since(start); elapsed < time.Second {
+		t.Errorf("retried after %s, want to wait the 1s of Retry-After", elapsed)
+	}
+	if got := srv.count("/push"); got != 2 {
+		t.Errorf("push requests = %d, want 2", got)
+	}
+}
+
+func TestDoesNotRetryRejectedPushes(t *testing.T) {
+	srv := newServer(t)
+	srv.fail("/push", http.StatusBadRequest)
+	errs := &errorLog{}
+	c := newClient(t, client.Options{BaseURL: srv.URL, OnError: errs.record})
+
+	requests := c.Counter("checkout_requests_total", "Checkout requests", "method")
+	requests.Inc("POST")
+	requests.Inc("GET")
+	flush(t, c)
+
+	if got := srv.count("/push"); got != 2 {
+		t.Errorf("push requests = %d, want one per push", got)
+	}
+	if srv.series(t, "checkout_requests_total", "POST") != nil {
+		t.Error("rejected push was applied")
+	}
+	if got := srv.series(t, "checkout_requests_total", "GET").GetCounter().GetValue(); got != 1 {
+		t.Errorf("checkout_requests_total{method=GET} = %g, want the push after the rejected one applied", got)
+	}
+	if got := errs.all(); len(got) != 1 || !strings.Contains(got[0].Error(), "rejected") {
+		t.Errorf("reported errors = %v, want the rejected push", got)
+	}
+}
+
+func TestSpoolReplaysPushesOnceServerIsBack(t *testing.T) {
+	srv := newServer(t)
+	path := filepath.Join(t.TempDir(), "tallyport.spool")
+	srv.down.Store(true)
+
+	first, err := client.New(client.Options{
+		BaseURL:       srv.URL,
+		FlushInterval: time.Hour,
+		MaxRetries:    1,
+		MinBackoff:    time.Millisecond,
+		MaxBackoff:    time.Millisecond,
+		SpoolPath:     path,
+	})
+	if err != nil {
+		t.Fatalf("client.New: %v", err)
+	}
+	requests := first.Counter("checkout_requests_total", "Checkout requests", "method")
+	requests.Inc("POST")
+	requests.Inc("POST")
+	battery := first.Gauge("app_battery_percent", "Battery level", "device")
+	battery.Set(40, "ios")
+	// Close flushes, which spools what the unreachable server could not take.
+	if err := first.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	spooled, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read spool: %v", err)
+	}
+	if lines := strings.Count(string(spooled), "\n"); lines != 3 {
+		t.Fatalf("spool holds %d pushes, want 3", lines)
+	}
+
+	// A new client with the same spool, as after a restart, replays the pushes in order.
+	srv.down.Store(false)
+	second := newClient(t, client.Options{BaseURL: srv.URL, SpoolPath: path})
+	flush(t, second)
+
+	if got := srv.series(t, "checkout_requests_total", "POST").GetCounter().GetValue(); got != 2 {
+		t.Errorf("checkout_requests_total{method=POST} = %g, want 2", got)
+	}
+	if got := srv.series(t, "app_battery_percent", "ios").GetGauge().GetValue(); got != 40 {
+		t.Errorf("app_battery_percent{device=ios} = %g, want 40", got)
+	}
+	if spooled, err := os.ReadFile(path); err != nil || len(spooled) != 0 {
+		t.Errorf("spool holds %q after replay (%v), want it empty", spooled, err)
+	}
+}
@@ -0,0 +1,146 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"tallyport/registry"
+	"time"
+)
+
+// handle is the part shared by every metric handle: the definition sent to /init and the
+// client its pushes are queued on.
+type handle struct {
+	client *Client
+	def    registry.MetricRequest
+}
+
+// push queues an update after checking it carries one value per declared label.
+func (h *handle) push(labelValues []string, fill func(*registry.MetricRequest)) {
+	if len(labelValues) != len(h.def.Labels) {
+		h.client.report(fmt.Errorf("push of %s dropped: expected %d label values, got %d",
+			h.def.Name, len(h.def.Labels), len(labelValues)))
+		return
+	}
+
+	push := registry.MetricRequest{
+		Type:   h.def.Type,
+		Name:   h.def.Name,
+		Labels: append([]string(nil), labelValues...),
+	}
+	fill(&push)
+	h.client.enqueue(&h.def, push)
+}
+
+// Counter is a handle to a tallyport counter.
+type Counter struct{ handle }
+
+// Gauge is a handle to a tallyport gauge.
+type Gauge struct{ handle }
+
+// Histogram is a handle to a tallyport histogram.
+type Histogram struct{ handle }
+
+// Summary is a handle to a tallyport summary.
+type Summary struct{ handle }
+
+// Counter declares a counter. Nothing is sent until the first Inc.
+//
+// Parameters:
+//   - name: Metric name.
+//   - help: Metric description.
+//   - labelNames: Names of the labels every push must provide values for.
+//
+// Returns:
+//   - *Counter: Handle to the counter.
+func (c *Client) Counter(name, help string, labelNames ...string) *Counter {
+	return &Counter{c.declare(registry.TypeCounter, name, help, labelNames)}
+}
+
+// Gauge declares a gauge. Nothing is sent until the first Set.
+//
+// Parameters:
+//   - name: Metric name.
+//   - help: Metric description.
+//   - labelNames: Names of the labels every push must provide values for.
+//
+// Returns:
+//   - *Gauge: Handle to the gauge.
+func (c *Client) Gauge(name, help string, labelNames ...string) *Gauge {
+	return &Gauge{c.declare(registry.TypeGauge, name, help, labelNames)}
+}
+
+// Histogram declares a histogram with the given bucket boundaries. Nothing is sent until
+// the first Observe.
+//
+// Parameters:
+//   - name: Metric name.
+//   - help: Metric description.
+//   - buckets: Upper bounds of the histogram buckets; the Prometheus defaults when empty.
+//   - labelNames: Names of the labels every push must provide values for.
+//
+// Returns:
+//   - *Histogram: Handle to the histogram.
+func (c *Client) Histogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := c.declare(registry.TypeHistogram, name, help, labelNames)
+	h.def.Histogram.Buckets = buckets
+	return &Histogram{h}
+}
+
+// Summary declares a summary. Nothing is sent until the first Observe.
+//
+// Parameters:
+//   - name: Metric name.
+//   - help: Metric description.
+//   - objectives: Quantiles mapped to their allowed absolute error, e.g. {0.5: 0.05, 0.99: 0.001}.
+//   - maxAge: How long observations are kept in the quantile estimates; must be positive.
+//   - labelNames: Names of the labels every push must provide values for.
+//
+// Returns:
+//   - *Summary: Handle to the summary.
+func (c *Client) Summary(name, help string, objectives map[float64]float64, maxAge time.Duration, labelNames ...string) *Summary {
+	h := c.declare(registry.TypeSummary, name, help, labelNames)
+	h.def.Summary.Objectives = make(map[string]float64, len(objectives))
+	for quantile, tolerance := range objectives {
+		h.def.Summary.Objectives[strconv.FormatFloat(quantile, 'g', -1, 64)] = tolerance
+	}
+	h.def.Summary.MaxAge = int64(maxAge)
+	return &Summary{h}
+}
+
+func (c *Client) declare(metricType, name, help string, labelNames []string) handle {
+	return handle{
+		client: c,
+		def: registry.MetricRequest{
+			Type:        metricType,
+			Name:        name,
+			Description: help,
+			Labels:      append([]string(nil), labelNames...),
+		},
+	}
+}
+
+// Inc increments the counter series identified by labelValues by one.
+func (m *Counter) Inc(labelValues ...string) {
+	m.push(labelValues, func(*registry.MetricRequest) {})
+}
+
+// Set sets the gauge series identified by labelValues to value.
+func (m *Gauge) Set(value float64, labelValues ...string) {
+	m.push(labelValues, func(push *registry.MetricRequest) {
+		push.Gauge.Value = value
+	})
+}
+
+// Observe adds value to the histogram series identified by labelValues.
+func (m *Histogram) Observe(value float64, labelValues ...string) {
+	m.push(labelValues, func(push *registry.MetricRequest) {
+		push.Histogram.ObservedValue = value
+	})
+}
+
+// Observe adds value to the summary series identified by labelValues.
+func (m *Summary) Observe(value float64, labelValues ...string) {
+	m.push(labelValues, func(push *registry.MetricRequest) {
+		push.Summary.ObservedValue = value
+	})
+}
@@ -0,0 +1,83 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// spool stores undelivered pushes as JSON lines in a file, so they survive until the server
+// is reachable again, or until the process restarts with the same spool path.
+type spool struct {
+	mu   sync.Mutex
+	path string
+}
+
+// append adds items to the end of the spool file.
+func (s *spool) append(items []queuedPush) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open spool: %w", err)
+	}
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, item := range items {
+		if err := encoder.Encode(item); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write spool: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write spool: %w", err)
+	}
+	return file.Close()
+}
+
+// drain returns every spooled push and empties the spool. Lines that cannot be decoded are
+// skipped and reported in the returned error alongside the pushes that could be read.
+func (s *spool) drain() ([]queuedPush, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.Open(s.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open spool: %w", err)
+	}
+	defer file.Close()
+
+	var items []queuedPush
+	corrupt := 0
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var item queuedPush
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			corrupt++
+			continue
+		}
+		items = append(items, item)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read spool: %w", err)
+	}
+
+	if err := os.Truncate(s.path, 0); err != nil {
+		return nil, fmt.Errorf("failed to empty spool: %w", err)
+	}
+	if corrupt > 0 {
+		return items, fmt.Errorf("skipped %d corrupt spool entries", corrupt)
+	}
+	return items, nil
+}
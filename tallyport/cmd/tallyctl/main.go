@@ -0,0 +1,545 @@
+// Command tallyctl manages the metrics of a running tallyport server over its HTTP API.
+//
+// Usage:
+//
+//	tallyctl [-server URL] [-api-key KEY] [-key-id ID -signing-secret SECRET [-tenant-header NAME]] [-output table|json] [-header "Key: Value"] <command> [flags] [args]
+//
+// Commands:
+//
+//	init      Create a metric (-type, -name, -help, -labels, -buckets, -objectives, -max-age, -min, -max, -policy) or all metrics in -f.
+//	push      Push an update to a metric (-type, -name, -labels, -value).
+//	list      List registered metrics.
+//	describe  Show the definition of a metric.
+//	delete    Delete a metric and its series.
+//	export    Write all metric definitions as JSON to stdout or -f.
+//	import    Create the metric definitions read from -f or stdin.
+//	validate  Check a settings file (-config) without starting a server.
+//	keygen    Generate an API key (-id), optionally with a signing secret (-signing), and the entry to add to the key file.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"tallyport/api"
+	"tallyport/auth"
+	"tallyport/config"
+	"tallyport/registry"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// headerFlags collects repeated -header flags.
+type headerFlags []string
+
+func (h *headerFlags) String() string { return strings.Join(*h, ", ") }
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header %q must look like \"Key: Value\"", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// cli holds the global flags shared by every command.
+type cli struct {
+	server  string
+	apiKey  string
+	keyID   string
+	signing string
+	tenant  string // Name of the tenant header, signed with the request
+	output  string
+	headers headerFlags
+	http    *http.Client
+	stdout  io.Writer
+}
+
+func main() {
+	c := &cli{http: &http.Client{Timeout: 30 * time.Second}, stdout: os.Stdout}
+
+	server := os.Getenv("TALLYPORT_URL")
+	if server == "" {
+		server = "http://localhost:8080"
+	}
+
+	flags := flag.NewFlagSet("tallyctl", flag.ExitOnError)
+	flags.StringVar(&c.server, "server", server, "address of the tallyport server (defaults to $TALLYPORT_URL)")
+	flags.StringVar(&c.apiKey, "api-key", os.Getenv("TALLYPORT_API_KEY"), "API key sent with every request (defaults to $TALLYPORT_API_KEY)")
+	flags.StringVar(&c.keyID, "key-id", os.Getenv("TALLYPORT_KEY_ID"), "id of the key signing requests (defaults to $TALLYPORT_KEY_ID)")
+	flags.StringVar(&c.signing, "signing-secret", os.Getenv("TALLYPORT_SIGNING_SECRET"), "signing secret of the key; signs every request (defaults to $TALLYPORT_SIGNING_SECRET)")
+	flags.StringVar(&c.tenant, "tenant-header", auth.DefaultTenantHeader, "header naming the tenant (tenant_config.header of the server), signed with the request")
+	flags.StringVar(&c.output, "output", "table", "output format: table or json")
+	flags.Var(&c.headers, "header", "extra request header as \"Key: Value\", repeatable")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: tallyctl [flags] <init|push|list|describe|delete|export|import|validate|keygen> [command flags] [args]")
+		flags.PrintDefaults()
+	}
+	flags.Parse(os.Args[1:])
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if c.output != "table" && c.output != "json" {
+		fatal(fmt.Errorf("unknown output format %q, expected table or json", c.output))
+	}
+	c.server = strings.TrimRight(c.server, "/")
+	if c.signing != "" && c.keyID == "" {
+		fatal(errors.New("-signing-secret requires -key-id"))
+	}
+
+	commands := map[string]func([]string) error{
+		"init":     c.init,
+		"push":     c.push,
+		"list":     c.list,
+		"describe": c.describe,
+		"delete":   c.delete,
+		"export":   c.export,
+		"import":   c.importDefinitions,
+		"validate": c.validate,
+		"keygen":   c.keygen,
+	}
+	command, ok := commands[flags.Arg(0)]
+	if !ok {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if err := command(flags.Args()[1:]); err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintln(os.Stderr, "tallyctl:", err)
+	os.Exit(1)
+}
+
+func (c *cli) init(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	file := flags.String("f", "", "JSON file with a definition or a list of definitions")
+	metricType := flags.String("type", "", "metric type: counter, gauge, histogram or summary")
+	name := flags.String("name", "", "metric name")
+	help := flags.String("help", "", "metric description")
+	labels := flags.String("labels", "", "comma separated label names")
+	buckets := flags.String("buckets", "", "comma separated histogram buckets")
+	objectives := flags.String("objectives", "", "comma separated summary objectives as quantile:error")
+	maxAge := flags.Duration("max-age", 10*time.Minute, "summary max age")
+	minValue := flags.String("min", "", "lowest accepted gauge value or observation")
+	maxValue := flags.String("max", "", "highest accepted gauge value or observation")
+	policy := flags.String("policy", "", "values outside -min and -max: reject (default) or clamp")
+	flags.Parse(args)
+
+	if *file != "" {
+		return c.importDefinitions([]string{"-f", *file})
+	}
+
+	definition := registry.MetricRequest{
+		Type:        *metricType,
+		Name:        *name,
+		Description: *help,
+		Labels:      splitList(*labels),
+	}
+	for _, bucket := range splitList(*buckets) {
+		value, err := strconv.ParseFloat(bucket, 64)
+		if err != nil {
+			return fmt.Errorf("invalid bucket %q: %v", bucket, err)
+		}
+		definition.Histogram.Buckets = append(definition.Histogram.Buckets, value)
+	}
+	if *minValue != "" || *maxValue != "" || *policy != "" {
+		definition.Range = &registry.ValueRange{Policy: *policy}
+		for _, bound := range []struct {
+			flag  string
+			value string
+			field **float64
+		}{{"min", *minValue, &definition.Range.Min}, {"max", *maxValue, &definition.Range.Max}} {
+			if bound.value == "" {
+				continue
+			}
+			value, err := strconv.ParseFloat(bound.value, 64)
+			if err != nil {
+				return fmt.Errorf("invalid -%s %q: %v", bound.flag, bound.value, err)
+			}
+			*bound.field = &value
+		}
+	}
+	if *metricType == registry.TypeSummary {
+		definition.Summary.MaxAge = int64(*maxAge)
+		definition.Summary.Objectives = map[string]float64{}
+		for _, objective := range splitList(*objectives) {
+			quantile, tolerance, ok := strings.Cut(objective, ":")
+			value, err := strconv.ParseFloat(tolerance, 64)
+			if !ok || err != nil {
+				return fmt.Errorf("invalid objective %q, expected quantile:error", objective)
+			}
+			definition.Summary.Objectives[quantile] = value
+		}
+	}
+
+	response, err := c.post("/init", definition)
+	if err != nil {
+		return err
+	}
+	return c.printResponse(response)
+}
+
+func (c *cli) push(args []string) error {
+	flags := flag.NewFlagSet("push", flag.ExitOnError)
+	metricType := flags.String("type", "", "metric type: counter, gauge, histogram or summary")
+	name := flags.String("name", "", "metric name")
+	labels := flags.String("labels", "", "comma separated label values")
+	value := flags.Float64("value", 0, "gauge value or observed value; ignored for counters")
+	flags.Parse(args)
+
+	push := registry.MetricRequest{Type: *metricType, Name: *name, Labels: splitList(*labels)}
+	push.Gauge.Value = *value
+	push.Histogram.ObservedValue = *value
+	push.Summary.ObservedValue = *value
+
+	response, err := c.post("/push", push)
+	if err != nil {
+		return err
+	}
+	return c.printResponse(response)
+}
+
+func (c *cli) list(args []string) error {
+	definitions, err := c.definitions("/definitions")
+	if err != nil {
+		return err
+	}
+	return c.printDefinitions(definitions)
+}
+
+func (c *cli) describe(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tallyctl describe <name>")
+	}
+	definitions, err := c.definitions("/definitions/" + url.PathEscape(args[0]))
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.printJSON(definitions[0])
+	}
+
+	definition := definitions[0]
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Name:\t%s\n", definition.Name)
+	fmt.Fprintf(w, "Type:\t%s\n", definition.Type)
+	fmt.Fprintf(w, "Description:\t%s\n", definition.Description)
+	fmt.Fprintf(w, "Labels:\t%s\n", strings.Join(definition.Labels, ", "))
+	fmt.Fprintf(w, "Series:\t%d\n", definition.Series)
+	if len(definition.Histogram.Buckets) > 0 {
+		fmt.Fprintf(w, "Buckets:\t%v\n", definition.Histogram.Buckets)
+	}
+	if bounds := definition.Range; bounds != nil {
+		lowest, highest, policy := "-Inf", "+Inf", registry.PolicyReject
+		if bounds.Min != nil {
+			lowest = strconv.FormatFloat(*bounds.Min, 'g', -1, 64)
+		}
+		if bounds.Max != nil {
+			highest = strconv.FormatFloat(*bounds.Max, 'g', -1, 64)
+		}
+		if bounds.Policy != "" {
+			policy = bounds.Policy
+		}
+		fmt.Fprintf(w, "Range:\t[%s, %s] (%s)\n", lowest, highest, policy)
+	}
+	if definition.Type == registry.TypeSummary {
+		fmt.Fprintf(w, "Objectives:\t%v\n", definition.Summary.Objectives)
+		fmt.Fprintf(w, "Max age:\t%s\n", time.Duration(definition.Summary.MaxAge))
+	}
+	return w.Flush()
+}
+
+func (c *cli) delete(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: tallyctl delete <name>")
+	}
+	response, err := c.do(http.MethodDelete, "/definitions/"+url.PathEscape(args[0]), nil)
+	if err != nil {
+		return err
+	}
+	var out api.MetricResponse
+	if err := json.Unmarshal(response, &out); err != nil {
+		return fmt.Errorf("unexpected response: %s", response)
+	}
+	return c.printResponse(out)
+}
+
+func (c *cli) export(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	file := flags.String("f", "", "file to write the definitions to instead of stdout")
+	flags.Parse(args)
+
+	descriptions, err := c.definitions("/definitions")
+	if err != nil {
+		return err
+	}
+	definitions := make([]registry.MetricRequest, 0, len(descriptions))
+	for _, description := range descriptions {
+		definitions = append(definitions, description.MetricRequest)
+	}
+
+	raw, err := json.MarshalIndent(definitions, "", "  ")
+	if err != nil {
+		return err
+	}
+	raw = append(raw, '\n')
+	if *file == "" {
+		_, err = c.stdout.Write(raw)
+		return err
+	}
+	return os.WriteFile(*file, raw, 0o644)
+}
+
+// importDefinitions creates every definition of a file written by export. Metrics that
+// already exist are skipped, so an import can be repeated safely.
+func (c *cli) importDefinitions(args []string) error {
+	flags := flag.NewFlagSet("import", flag.ExitOnError)
+	file := flags.String("f", "-", "JSON file with a definition or a list of definitions, - for stdin")
+	flags.Parse(args)
+
+	var raw []byte
+	var err error
+	if *file == "-" {
+		raw, err = io.ReadAll(os.Stdin)
+	} else {
+		raw, err = os.ReadFile(*file)
+	}
+	if err != nil {
+		return err
+	}
+
+	var definitions []registry.MetricRequest
+	if trimmed := bytes.TrimSpace(raw); len(trimmed) > 0 && trimmed[0] == '{' {
+		var definition registry.MetricRequest
+		err = json.Unmarshal(trimmed, &definition)
+		definitions = append(definitions, definition)
+	} else {
+		err = json.Unmarshal(raw, &definitions)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid definitions file: %v", err)
+	}
+
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	if c.output == "table" {
+		fmt.Fprintln(w, "NAME\tSTATUS\tRESULT")
+	}
+	var results []api.MetricResponse
+	failed := 0
+	for _, definition := range definitions {
+		response, err := c.post("/init", definition)
+		if err != nil {
+			return err
+		}
+		if response.Status != http.StatusCreated && response.Status != http.StatusConflict {
+			failed++
+		}
+		results = append(results, response)
+		if c.output == "table" {
+			fmt.Fprintf(w, "%s\t%d\t%s%s\n", definition.Name, response.Status, response.Message, response.Reason)
+		}
+	}
+	if c.output == "json" {
+		if err := c.printJSON(results); err != nil {
+			return err
+		}
+	} else if err := w.Flush(); err != nil {
+		return err
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d definitions could not be imported", failed, len(definitions))
+	}
+	return nil
+}
+
+// validate loads a settings file the way the server does and builds the API from it, which
+// checks every section the server would refuse at startup.
+func (c *cli) validate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	path := flags.String("config", "settings.yml", "settings file to validate")
+	flags.Parse(args)
+
+	cfg, err := config.Load(*path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := api.NewHandler(cfg, prometheus.NewRegistry(), zerolog.Nop()); err != nil {
+		return fmt.Errorf("%s: %v", *path, err)
+	}
+
+	return c.printResponse(api.MetricResponse{
+		Status:  http.StatusOK,
+		Message: fmt.Sprintf("%s is valid", *path),
+	})
+}
+
+// definitions fetches a MetricDefinitionsResponse and returns its metrics.
+// keygen prints a new API key and the key file entry holding its hash. The key itself is not
+// stored anywhere, so it has to be handed to the client right away.
+func (c *cli) keygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	id := flags.String("id", "", "identifier of the key, e.g. the client it is issued to")
+	signing := flags.Bool("signing", false, "also generate a secret the client signs its requests with")
+	flags.Parse(args)
+
+	if *id == "" {
+		return errors.New("keygen requires -id")
+	}
+	secret, hash, err := auth.GenerateKey()
+	if err != nil {
+		return err
+	}
+
+	var signingSecret string
+	if *signing {
+		if signingSecret, err = auth.GenerateSigningSecret(); err != nil {
+			return err
+		}
+	}
+
+	if c.output == "json" {
+		entry := map[string]string{"id": *id, "key": secret, "sha256": hash}
+		if signingSecret != "" {
+			entry["signing_secret"] = signingSecret
+		}
+		return c.printJSON(entry)
+	}
+	fmt.Fprintf(c.stdout, "key: %s\n\nkey file entry:\n  - id: %s\n    sha256: %q\n", secret, *id, hash)
+	if signingSecret != "" {
+		fmt.Fprintf(c.stdout, "    signing_secret: %q\n", signingSecret)
+	}
+	return nil
+}
+
+func (c *cli) definitions(path string) ([]api.MetricDescription, error) {
+	raw, err := c.do(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var response api.MetricDefinitionsResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return nil, fmt.Errorf("unexpected response: %s", raw)
+	}
+	if response.Status != http.StatusOK {
+		var failure api.MetricResponse
+		json.Unmarshal(raw, &failure)
+		return nil, fmt.Errorf("server returned %d: %s", failure.Status, failure.Reason)
+	}
+	return response.Metrics, nil
+}
+
+func (c *cli) post(path string, body registry.MetricRequest) (api.MetricResponse, error) {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return api.MetricResponse{}, err
+	}
+	raw, err := c.do(http.MethodPost, path, payload)
+	if err != nil {
+		return api.MetricResponse{}, err
+	}
+
+	var response api.MetricResponse
+	if err := json.Unmarshal(raw, &response); err != nil {
+		return api.MetricResponse{}, fmt.Errorf("unexpected response: %s", raw)
+	}
+	return response, nil
+}
+
+func (c *cli) do(method, path string, payload []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, c.server+path, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiKey)
+	}
+	for _, header := range c.headers {
+		key, value, _ := strings.Cut(header, ":")
+		req.Header.Add(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+	if c.signing != "" {
+		if err := auth.SignRequest(req, c.keyID, c.signing, c.tenant, payload); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if len(bytes.TrimSpace(raw)) == 0 {
+		return nil, fmt.Errorf("server returned %s", res.Status)
+	}
+	return raw, nil
+}
+
+func (c *cli) printResponse(response api.MetricResponse) error {
+	if c.output == "json" {
+		return c.printJSON(response)
+	}
+
+	if response.Status >= http.StatusBadRequest {
+		return fmt.Errorf("server returned %d: %s", response.Status, response.Reason)
+	}
+	fmt.Fprintln(c.stdout, response.Message)
+	return nil
+}
+
+func (c *cli) printDefinitions(definitions []api.MetricDescription) error {
+	if c.output == "json" {
+		return c.printJSON(definitions)
+	}
+
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTYPE\tLABELS\tSERIES\tDESCRIPTION")
+	for _, definition := range definitions {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\n", definition.Name, definition.Type,
+			strings.Join(definition.Labels, ","), definition.Series, definition.Description)
+	}
+	return w.Flush()
+}
+
+func (c *cli) printJSON(value any) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// splitList splits a comma separated flag value, ignoring empty entries.
+func splitList(value string) []string {
+	var out []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			out = append(out, item)
+		}
+	}
+	return out
+}
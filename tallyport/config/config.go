@@ -0,0 +1,539 @@
+// Package config defines the tallyport configuration file and helpers to load it.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// TallyPortConfig is the YAML configuration of a tallyport server.
+type TallyPortConfig struct {
+	ServerConfig struct {
+		MaxHeaderBytes    int    `yaml:"max_header_bytes"`
+		ReadHeaderTimeout int64  `yaml:"read_header_timeout"`
+		WriteTimeout      int64  `yaml:"write_timeout"`
+		ReadTimeout       int64  `yaml:"read_timeout"`
+		IdleTimeout       int64  `yaml:"idle_timeout"`
+		ServerName        string `yaml:"server_name"`
+		Port              string `yaml:"port"`
+		TlsPath           string `yaml:"tls_path"`
+	} `yaml:"server_config"`
+	TLSServerConfig struct {
+		ClientAuthType string   `yaml:"client_auth_type"`
+		ClientCAFile   string   `yaml:"client_ca_file"`
+		MinVersion     string   `yaml:"min_version"`
+		MaxVersion     string   `yaml:"max_version"`
+		CipherSuites   []string `yaml:"cipher_suites"`
+	} `yaml:"tls_server_config"`
+	CorsConfig struct {
+		Headers []struct {
+			Key   string `yaml:"key"`
+			Value string `yaml:"value"`
+		}
+	} `yaml:"cors_config"`
+	ThrottleConfig struct {
+		LimitSize      int           `yaml:"limit"`
+		BacklogLimit   int           `yaml:"backlog_limit"`
+		BacklogTimeout time.Duration `yaml:"backlog_timeout"`
+		StatusCode     int           `yaml:"status_code"`
+	} `yaml:"throttle_config"`
+
+	RequestConfig struct {
+		Size    int64 `yaml:"request_size"`
+		Timeout int64 `yaml:"request_timeout"`
+	} `yaml:"request_config"`
+
+	StreamConfig struct {
+		Path           string            `yaml:"path"`
+		Tokens         map[string]string `yaml:"tokens"`
+		AllowedOrigins []string          `yaml:"allowed_origins"`
+		AuthTimeout    int64             `yaml:"auth_timeout"`
+		RatePerSecond  float64           `yaml:"rate_per_second"`
+		Burst          int               `yaml:"burst"`
+		QueueSize      int               `yaml:"queue_size"`
+		MaxMessageSize int64             `yaml:"max_message_size"`
+	} `yaml:"stream_config"`
+
+	EventConfig struct {
+		Path       string `yaml:"path"`
+		BufferSize int    `yaml:"buffer_size"`
+		KeepAlive  int64  `yaml:"keep_alive"`
+	} `yaml:"event_config"`
+
+	RemoteWriteConfig struct {
+		URL            string            `yaml:"url"`
+		Interval       int64             `yaml:"interval"`
+		Timeout        int64             `yaml:"timeout"`
+		Shards         int               `yaml:"shards"`
+		QueueSize      int               `yaml:"queue_size"`
+		BatchSize      int               `yaml:"max_samples_per_send"`
+		BatchDeadline  int64             `yaml:"batch_send_deadline"`
+		MaxRetries     int               `yaml:"max_retries"`
+		MinBackoff     int64             `yaml:"min_backoff"`
+		MaxBackoff     int64             `yaml:"max_backoff"`
+		Headers        map[string]string `yaml:"headers"`
+		ExternalLabels map[string]string `yaml:"external_labels"`
+	} `yaml:"remote_write_config"`
+
+	IngestConfig struct {
+		Path           string `yaml:"path"`
+		InjectInstance bool   `yaml:"inject_instance"`
+	} `yaml:"ingest_config"`
+
+	BufferConfig struct {
+		Enabled         bool  `yaml:"enabled"`
+		FlushInterval   int64 `yaml:"flush_interval"`
+		MaxObservations int   `yaml:"max_observations"`
+	} `yaml:"buffer_config"`
+
+	AsyncConfig struct {
+		Enabled   bool   `yaml:"enabled"`
+		Workers   int    `yaml:"workers"`
+		QueueSize int    `yaml:"queue_size"`
+		Overflow  string `yaml:"overflow"`
+	} `yaml:"async_config"`
+
+	AuthConfig struct {
+		KeysFile         string            `yaml:"keys_file"`
+		Keys             map[string]string `yaml:"keys"`
+		SignatureMaxSkew int64             `yaml:"signature_max_skew"`
+		NonceCacheSize   int               `yaml:"nonce_cache_size"`
+
+		JWT struct {
+			JWKSFile        string            `yaml:"jwks_file"`
+			Issuer          string            `yaml:"issuer"`
+			Audiences       []string          `yaml:"audiences"`
+			Algorithms      []string          `yaml:"algorithms"`
+			Leeway          int64             `yaml:"leeway"`
+			IDClaim         string            `yaml:"id_claim"`
+			TenantClaim     string            `yaml:"tenant_claim"`
+			OperationsClaim string            `yaml:"operations_claim"`
+			LabelClaims     map[string]string `yaml:"label_claims"`
+		} `yaml:"jwt"`
+	} `yaml:"auth_config"`
+
+	ExportAuthConfig struct {
+		BasicAuthUsers map[string]string `yaml:"basic_auth_users"`
+		BearerTokens   map[string]string `yaml:"bearer_tokens"`
+		HeartBeat      bool              `yaml:"heart_beat"`
+	} `yaml:"export_auth_config"`
+
+	TenantConfig struct {
+		Enabled          bool   `yaml:"enabled"`
+		Header           string `yaml:"header"`
+		Required         bool   `yaml:"required"`
+		MaxTenants       int    `yaml:"max_tenants"`
+		Label            string `yaml:"label"`
+		ExportPathPrefix string `yaml:"export_path_prefix"`
+	} `yaml:"tenant_config"`
+
+	HeartBeatPath           string `yaml:"heart_beat_path"`
+	MetricExportPath        string `yaml:"metric_export_path"`
+	RemoteWriteReceiverPath string `yaml:"remote_write_receiver_path"`
+	RateLimitSizePerMinute  int    `yaml:"rate_limit_size_per_minute"`
+
+	RateLimitConfig struct {
+		KeyBy            string         `yaml:"key_by"`
+		ClientIDHeader   string         `yaml:"client_id_header"`
+		Routes           map[string]int `yaml:"routes"`
+		AddressPerMinute int            `yaml:"address_per_minute"`
+	} `yaml:"rate_limit_config"`
+
+	IPAccessConfig struct {
+		TrustedProxies []string          `yaml:"trusted_proxies"`
+		Routes         map[string]IPRule `yaml:"routes"`
+	} `yaml:"ip_access_config"`
+
+	QuotaConfig struct {
+		Enabled     bool `yaml:"enabled"`
+		QuotaLimits `yaml:",inline"`
+		Tenants     map[string]QuotaLimits `yaml:"tenants"`
+		Keys        map[string]QuotaLimits `yaml:"keys"`
+	} `yaml:"quota_config"`
+}
+
+// IPRule restricts the client addresses a route in ip_access_config accepts. Entries are CIDR
+// ranges or single addresses.
+type IPRule struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
+}
+
+// ParsePrefixes parses CIDR ranges such as "10.0.0.0/8", taking single addresses as ranges of
+// one address.
+//
+// Parameters:
+//   - entries: Ranges or addresses, in IPv4 or IPv6 notation.
+//
+// Returns:
+//   - []netip.Prefix: The parsed ranges, in the order given.
+//   - An error naming the first entry that is neither a range nor an address.
+func ParsePrefixes(entries []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(entries))
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if prefix, err := netip.ParsePrefix(entry); err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+		addr, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%q is neither a CIDR range nor an IP address", entry)
+		}
+		addr = addr.Unmap()
+		prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+	}
+	return prefixes, nil
+}
+
+// QuotaLimits are the quotas of a tenant or an API key in quota_config. Zero leaves a quota
+// unlimited.
+type QuotaLimits struct {
+	MaxMetrics          int `yaml:"max_metrics"`
+	MaxSeries           int `yaml:"max_series"`
+	MaxSamplesPerMinute int `yaml:"max_samples_per_minute"`
+}
+
+// Quota returns the limits of the tenant called name: its entry in tenants, or else the
+// defaults. The default tenant is named "".
+func (cfg TallyPortConfig) Quota(name string) QuotaLimits {
+	if limits, ok := cfg.QuotaConfig.Tenants[name]; ok && name != "" {
+		return limits
+	}
+	return cfg.QuotaConfig.QuotaLimits
+}
+
+// TenantExportRoute returns the route pattern of the metrics of single tenants, or "" when
+// tenant_config does not export them.
+func (cfg TallyPortConfig) TenantExportRoute() string {
+	if !cfg.TenantConfig.Enabled || cfg.TenantConfig.ExportPathPrefix == "" {
+		return ""
+	}
+	return strings.TrimSuffix(cfg.TenantConfig.ExportPathPrefix, "/") + "/{tenant}/metrics"
+}
+
+// Routes returns the patterns of the routes served with cfg, as named in
+// ip_access_config.routes and rate_limit_config.routes. Stream connections and the event feed
+// are only included with long-lived set, since they have no per-request rate limit.
+func (cfg TallyPortConfig) Routes(longLived bool) []string {
+	routes := []string{"/push", "/init", "/definitions", "/definitions/{name}", "/quota", cfg.MetricExportPath}
+	optional := []string{cfg.RemoteWriteReceiverPath, cfg.IngestConfig.Path, cfg.TenantExportRoute()}
+	if longLived {
+		optional = append(optional, cfg.StreamConfig.Path, cfg.EventConfig.Path)
+	}
+	for _, route := range optional {
+		if route != "" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// labelName matches valid Prometheus label names.
+var labelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// Defaults applied to settings missing from the configuration file. Durations are in
+// milliseconds, like in the file.
+const (
+	defaultMaxHeaderBytes    = 1 << 20
+	defaultReadHeaderTimeout = 15000
+	defaultWriteTimeout      = 15000
+	defaultReadTimeout       = 15000
+	defaultIdleTimeout       = 30000
+	defaultServerName        = "tallyport"
+	defaultPort              = ":8080"
+	defaultThrottleLimit     = 10000
+	defaultBacklogLimit      = 1000
+	defaultBacklogTimeout    = 2 * time.Minute
+	defaultThrottleStatus    = 429
+	defaultRequestSize       = 1 << 20
+	defaultRequestTimeout    = 10000
+	defaultHeartBeatPath     = "/health"
+	defaultMetricExportPath  = "/metrics"
+	defaultRateLimit         = 1000
+	defaultRateLimitKeyBy    = "api_key"
+	defaultClientIDHeader    = "X-Client-Id"
+	defaultAddressRateLimit  = 6000
+	defaultSignatureMaxSkew  = 300000
+	defaultNonceCacheSize    = 100000
+	defaultJWTLeeway         = 60000
+	defaultJWTIDClaim        = "sub"
+	defaultTenantHeader      = "X-Tallyport-Tenant"
+	defaultMaxTenants        = 100
+	defaultTenantLabel       = "tenant"
+)
+
+// Default returns the configuration used for settings missing from a configuration file.
+// Optional features, such as streaming, events, ingestion, remote write and the remote write
+// receiver, stay disabled. Settings of those features that are left at zero fall back to
+// the defaults of the feature itself.
+func Default() TallyPortConfig {
+	var cfg TallyPortConfig
+	cfg.ServerConfig.MaxHeaderBytes = defaultMaxHeaderBytes
+	cfg.ServerConfig.ReadHeaderTimeout = defaultReadHeaderTimeout
+	cfg.ServerConfig.WriteTimeout = defaultWriteTimeout
+	cfg.ServerConfig.ReadTimeout = defaultReadTimeout
+	cfg.ServerConfig.IdleTimeout = defaultIdleTimeout
+	cfg.ServerConfig.ServerName = defaultServerName
+	cfg.ServerConfig.Port = defaultPort
+	cfg.ThrottleConfig.LimitSize = defaultThrottleLimit
+	cfg.ThrottleConfig.BacklogLimit = defaultBacklogLimit
+	cfg.ThrottleConfig.BacklogTimeout = defaultBacklogTimeout
+	cfg.ThrottleConfig.StatusCode = defaultThrottleStatus
+	cfg.RequestConfig.Size = defaultRequestSize
+	cfg.RequestConfig.Timeout = defaultRequestTimeout
+	cfg.HeartBeatPath = defaultHeartBeatPath
+	cfg.MetricExportPath = defaultMetricExportPath
+	cfg.RateLimitSizePerMinute = defaultRateLimit
+	cfg.RateLimitConfig.KeyBy = defaultRateLimitKeyBy
+	cfg.RateLimitConfig.ClientIDHeader = defaultClientIDHeader
+	cfg.RateLimitConfig.AddressPerMinute = defaultAddressRateLimit
+	cfg.AuthConfig.SignatureMaxSkew = defaultSignatureMaxSkew
+	cfg.AuthConfig.NonceCacheSize = defaultNonceCacheSize
+	cfg.AuthConfig.JWT.Algorithms = []string{"RS256", "ES256"}
+	cfg.AuthConfig.JWT.Leeway = defaultJWTLeeway
+	cfg.AuthConfig.JWT.IDClaim = defaultJWTIDClaim
+	cfg.TenantConfig.Header = defaultTenantHeader
+	cfg.TenantConfig.MaxTenants = defaultMaxTenants
+	cfg.TenantConfig.Label = defaultTenantLabel
+	return cfg
+}
+
+// Load reads, parses and validates the YAML configuration file at path.
+//
+// ${NAME} references in the file are replaced with the value of the environment variable NAME
+// (empty when unset) before parsing. Unknown keys are rejected, settings missing from the file
+// keep their Default value, and TALLYPORT_* environment variables override the result, e.g.
+// TALLYPORT_THROTTLE_CONFIG_LIMIT for throttle_config.limit.
+//
+// Parameters:
+//   - path: Location of the configuration file.
+//
+// Returns:
+//   - TallyPortConfig: The parsed configuration.
+//   - An error if the file cannot be read, is not valid YAML, contains unknown keys, an
+//     override cannot be applied or a setting is out of range.
+func Load(path string) (TallyPortConfig, error) {
+	cfg := Default()
+
+	raw, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return cfg, fmt.Errorf("failed to read config file: %w", err)
+	}
+	if err := yaml.UnmarshalStrict(expandEnv(raw), &cfg); err != nil {
+		return cfg, fmt.Errorf("failed to parse config file %s: %w", path, err)
+	}
+	if err := applyEnvOverrides(&cfg, os.LookupEnv); err != nil {
+		return cfg, fmt.Errorf("failed to apply environment overrides: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return cfg, fmt.Errorf("invalid config file %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate reports settings that are out of range or would make the server fail to build its
+// routes, so a configuration can be rejected before it replaces a working one.
+//
+// Returns:
+//   - An error listing every invalid setting, or nil if the configuration is usable.
+func (cfg TallyPortConfig) Validate() error {
+	var errs []error
+	atLeast := func(key string, value, min int64) {
+		if value < min {
+			errs = append(errs, fmt.Errorf("%s must be at least %d, got %d", key, min, value))
+		}
+	}
+
+	atLeast("server_config.max_header_bytes", int64(cfg.ServerConfig.MaxHeaderBytes), 0)
+	atLeast("server_config.read_header_timeout", cfg.ServerConfig.ReadHeaderTimeout, 0)
+	atLeast("server_config.write_timeout", cfg.ServerConfig.WriteTimeout, 0)
+	atLeast("server_config.read_timeout", cfg.ServerConfig.ReadTimeout, 0)
+	atLeast("server_config.idle_timeout", cfg.ServerConfig.IdleTimeout, 0)
+	if cfg.ServerConfig.Port == "" {
+		errs = append(errs, errors.New("server_config.port is required"))
+	}
+	if _, err := cfg.ServerTLS(); err != nil {
+		errs = append(errs, err)
+	}
+
+	atLeast("throttle_config.limit", int64(cfg.ThrottleConfig.LimitSize), 1)
+	atLeast("throttle_config.backlog_limit", int64(cfg.ThrottleConfig.BacklogLimit), 0)
+	if cfg.ThrottleConfig.BacklogTimeout < 0 {
+		errs = append(errs, fmt.Errorf("throttle_config.backlog_timeout must not be negative, got %s",
+			cfg.ThrottleConfig.BacklogTimeout))
+	}
+	if code := cfg.ThrottleConfig.StatusCode; code < 400 || code > 599 || http.StatusText(code) == "" {
+		errs = append(errs, fmt.Errorf("throttle_config.status_code must be a 4xx or 5xx HTTP status code, got %d", code))
+	}
+
+	atLeast("request_config.request_size", cfg.RequestConfig.Size, 1)
+	atLeast("request_config.request_timeout", cfg.RequestConfig.Timeout, 1)
+	atLeast("rate_limit_size_per_minute", int64(cfg.RateLimitSizePerMinute), 1)
+	atLeast("rate_limit_config.address_per_minute", int64(cfg.RateLimitConfig.AddressPerMinute), 0)
+	switch rlc := cfg.RateLimitConfig; rlc.KeyBy {
+	case "api_key", "ip":
+	case "client_id":
+		if rlc.ClientIDHeader == "" {
+			errs = append(errs, errors.New("rate_limit_config.client_id_header is required with key_by client_id"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("rate_limit_config.key_by must be \"api_key\", \"client_id\" or \"ip\", got %q", rlc.KeyBy))
+	}
+	// A misspelt route would silently keep the default limit.
+	limited := cfg.Routes(false)
+	for route, limit := range cfg.RateLimitConfig.Routes {
+		if !slices.Contains(limited, route) {
+			errs = append(errs, fmt.Errorf("rate_limit_config.routes: unknown route %q, expected one of %s",
+				route, strings.Join(limited, ", ")))
+		}
+		atLeast("rate_limit_config.routes."+route, int64(limit), 0)
+	}
+
+	if sc, ac := cfg.StreamConfig, cfg.AuthConfig; sc.Path != "" && len(sc.Tokens) == 0 &&
+		ac.KeysFile == "" && len(ac.Keys) == 0 && ac.JWT.JWKSFile == "" {
+		errs = append(errs, errors.New("stream_config.path requires stream_config.tokens, API keys or JWT validation"))
+	}
+	atLeast("stream_config.auth_timeout", cfg.StreamConfig.AuthTimeout, 0)
+	if cfg.StreamConfig.RatePerSecond < 0 {
+		errs = append(errs, fmt.Errorf("stream_config.rate_per_second must not be negative, got %g",
+			cfg.StreamConfig.RatePerSecond))
+	}
+	atLeast("stream_config.burst", int64(cfg.StreamConfig.Burst), 0)
+	atLeast("stream_config.queue_size", int64(cfg.StreamConfig.QueueSize), 0)
+	atLeast("stream_config.max_message_size", cfg.StreamConfig.MaxMessageSize, 0)
+
+	atLeast("event_config.buffer_size", int64(cfg.EventConfig.BufferSize), 0)
+	atLeast("event_config.keep_alive", cfg.EventConfig.KeepAlive, 0)
+
+	if raw := cfg.RemoteWriteConfig.URL; raw != "" {
+		if u, err := url.Parse(raw); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("remote_write_config.url must be an absolute http(s) URL, got %q", raw))
+		}
+	}
+	atLeast("remote_write_config.interval", cfg.RemoteWriteConfig.Interval, 0)
+	atLeast("remote_write_config.timeout", cfg.RemoteWriteConfig.Timeout, 0)
+	atLeast("remote_write_config.shards", int64(cfg.RemoteWriteConfig.Shards), 0)
+	atLeast("remote_write_config.queue_size", int64(cfg.RemoteWriteConfig.QueueSize), 0)
+	atLeast("remote_write_config.max_samples_per_send", int64(cfg.RemoteWriteConfig.BatchSize), 0)
+	atLeast("remote_write_config.batch_send_deadline", cfg.RemoteWriteConfig.BatchDeadline, 0)
+	atLeast("remote_write_config.max_retries", int64(cfg.RemoteWriteConfig.MaxRetries), 0)
+	atLeast("remote_write_config.min_backoff", cfg.RemoteWriteConfig.MinBackoff, 0)
+	atLeast("remote_write_config.max_backoff", cfg.RemoteWriteConfig.MaxBackoff, 0)
+	if minBackoff, maxBackoff := cfg.RemoteWriteConfig.MinBackoff, cfg.RemoteWriteConfig.MaxBackoff; minBackoff > 0 && maxBackoff > 0 && minBackoff > maxBackoff {
+		errs = append(errs, fmt.Errorf("remote_write_config.min_backoff (%d) must not exceed max_backoff (%d)", minBackoff, maxBackoff))
+	}
+
+	atLeast("buffer_config.flush_interval", cfg.BufferConfig.FlushInterval, 0)
+	atLeast("buffer_config.max_observations", int64(cfg.BufferConfig.MaxObservations), 0)
+
+	atLeast("async_config.workers", int64(cfg.AsyncConfig.Workers), 0)
+	atLeast("async_config.queue_size", int64(cfg.AsyncConfig.QueueSize), 0)
+	switch cfg.AsyncConfig.Overflow {
+	case "", "reject", "drop_oldest":
+	default:
+		errs = append(errs, fmt.Errorf("async_config.overflow must be \"reject\" or \"drop_oldest\", got %q",
+			cfg.AsyncConfig.Overflow))
+	}
+
+	atLeast("auth_config.signature_max_skew", cfg.AuthConfig.SignatureMaxSkew, 1000)
+	atLeast("auth_config.nonce_cache_size", int64(cfg.AuthConfig.NonceCacheSize), 1)
+	if jwt := cfg.AuthConfig.JWT; jwt.JWKSFile != "" {
+		if jwt.Issuer == "" {
+			errs = append(errs, errors.New("auth_config.jwt.issuer is required with jwks_file"))
+		}
+		if len(jwt.Audiences) == 0 {
+			errs = append(errs, errors.New("auth_config.jwt.audiences is required with jwks_file"))
+		}
+		if len(jwt.Algorithms) == 0 {
+			errs = append(errs, errors.New("auth_config.jwt.algorithms must not be empty"))
+		}
+		if jwt.IDClaim == "" {
+			errs = append(errs, errors.New("auth_config.jwt.id_claim must not be empty"))
+		}
+		atLeast("auth_config.jwt.leeway", jwt.Leeway, 0)
+	}
+
+	if eac := cfg.ExportAuthConfig; eac.HeartBeat && len(eac.BasicAuthUsers) == 0 && len(eac.BearerTokens) == 0 {
+		errs = append(errs, errors.New("export_auth_config.heart_beat requires basic_auth_users or bearer_tokens"))
+	}
+
+	if tc := cfg.TenantConfig; tc.Enabled {
+		if tc.Header == "" {
+			errs = append(errs, errors.New("tenant_config.header must not be empty"))
+		}
+		if !labelName.MatchString(tc.Label) || strings.HasPrefix(tc.Label, "__") {
+			errs = append(errs, fmt.Errorf("tenant_config.label %q is not a valid label name", tc.Label))
+		}
+		atLeast("tenant_config.max_tenants", int64(tc.MaxTenants), 1)
+	}
+
+	if _, err := ParsePrefixes(cfg.IPAccessConfig.TrustedProxies); err != nil {
+		errs = append(errs, fmt.Errorf("ip_access_config.trusted_proxies: %w", err))
+	}
+	// A misspelt route would silently be left open to every address.
+	served := cfg.Routes(true)
+	for route, rule := range cfg.IPAccessConfig.Routes {
+		if !slices.Contains(served, route) {
+			errs = append(errs, fmt.Errorf("ip_access_config.routes: unknown route %q, expected one of %s",
+				route, strings.Join(served, ", ")))
+		}
+		if _, err := ParsePrefixes(rule.Allow); err != nil {
+			errs = append(errs, fmt.Errorf("ip_access_config.routes.%s.allow: %w", route, err))
+		}
+		if _, err := ParsePrefixes(rule.Deny); err != nil {
+			errs = append(errs, fmt.Errorf("ip_access_config.routes.%s.deny: %w", route, err))
+		}
+	}
+
+	quotas := map[string]QuotaLimits{"quota_config": cfg.QuotaConfig.QuotaLimits}
+	for name, limits := range cfg.QuotaConfig.Tenants {
+		quotas["quota_config.tenants."+name] = limits
+	}
+	for id, limits := range cfg.QuotaConfig.Keys {
+		quotas["quota_config.keys."+id] = limits
+	}
+	for key, limits := range quotas {
+		atLeast(key+".max_metrics", int64(limits.MaxMetrics), 0)
+		atLeast(key+".max_series", int64(limits.MaxSeries), 0)
+		atLeast(key+".max_samples_per_minute", int64(limits.MaxSamplesPerMinute), 0)
+	}
+
+	if cfg.MetricExportPath == "" {
+		errs = append(errs, errors.New("metric_export_path is required"))
+	}
+	for _, path := range []struct{ key, value string }{
+		{"heart_beat_path", cfg.HeartBeatPath},
+		{"metric_export_path", cfg.MetricExportPath},
+		{"remote_write_receiver_path", cfg.RemoteWriteReceiverPath},
+		{"stream_config.path", cfg.StreamConfig.Path},
+		{"event_config.path", cfg.EventConfig.Path},
+		{"ingest_config.path", cfg.IngestConfig.Path},
+		{"tenant_config.export_path_prefix", cfg.TenantConfig.ExportPathPrefix},
+	} {
+		if path.value != "" && !strings.HasPrefix(path.value, "/") {
+			errs = append(errs, fmt.Errorf("%s %q must start with /", path.key, path.value))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// MillisecondsOr converts a configured number of milliseconds to a duration,
+// falling back to def when the value is not set.
+func MillisecondsOr(milliseconds int64, def time.Duration) time.Duration {
+	if milliseconds <= 0 {
+		return def
+	}
+	return time.Duration(milliseconds * int64(time.Millisecond))
+}
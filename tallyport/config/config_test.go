@@ -0,0 +1,250 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *TallyPortConfig)
+		want   string // Part of the expected error, empty if the configuration is valid
+	}{
+		{name: "default", change: func(cfg *TallyPortConfig) {}},
+		{name: "every optional route limited", change: func(cfg *TallyPortConfig) {
+			cfg.RemoteWriteReceiverPath = "/api/v1/write"
+			cfg.IngestConfig.Path = "/ingest"
+			cfg.TenantConfig.Enabled = true
+			cfg.TenantConfig.ExportPathPrefix = "/tenants/"
+			cfg.StreamConfig.Path = "/stream"
+			cfg.StreamConfig.Tokens = map[string]string{"app": "secret"}
+			cfg.RateLimitConfig.Routes = map[string]int{
+				"/push": 10, "/definitions/{name}": 0, "/api/v1/write": 10, "/ingest": 10, "/tenants/{tenant}/metrics": 10,
+			}
+			cfg.IPAccessConfig.Routes = map[string]IPRule{
+				"/stream": {Allow: []string{"10.0.0.0/8"}}, "/tenants/{tenant}/metrics": {Deny: []string{"::1"}},
+			}
+		}},
+		{name: "no port", change: func(cfg *TallyPortConfig) { cfg.ServerConfig.Port = "" }, want: "server_config.port is required"},
+		{name: "negative timeout", change: func(cfg *TallyPortConfig) { cfg.ServerConfig.IdleTimeout = -1 },
+			want: "server_config.idle_timeout must be at least 0, got -1"},
+		{name: "throttle status not an error", change: func(cfg *TallyPortConfig) { cfg.ThrottleConfig.StatusCode = 200 },
+			want: "throttle_config.status_code"},
+		{name: "unknown key_by", change: func(cfg *TallyPortConfig) { cfg.RateLimitConfig.KeyBy = "user" },
+			want: "rate_limit_config.key_by"},
+		{name: "key_by client_id without header", change: func(cfg *TallyPortConfig) {
+			cfg.RateLimitConfig.KeyBy = "client_id"
+			cfg.RateLimitConfig.ClientIDHeader = ""
+		}, want: "rate_limit_config.client_id_header is required"},
+		{name: "negative address rate limit", change: func(cfg *TallyPortConfig) { cfg.RateLimitConfig.AddressPerMinute = -1 },
+			want: "rate_limit_config.address_per_minute must be at least 0"},
+		{name: "misspelt rate limited route", change: func(cfg *TallyPortConfig) {
+			cfg.RateLimitConfig.Routes = map[string]int{"/definition/{name}": 10}
+		}, want: `rate_limit_config.routes: unknown route "/definition/{name}"`},
+		{name: "rate limited stream", change: func(cfg *TallyPortConfig) {
+			cfg.StreamConfig.Path = "/stream"
+			cfg.StreamConfig.Tokens = map[string]string{"app": "secret"}
+			cfg.RateLimitConfig.Routes = map[string]int{"/stream": 10}
+		}, want: `rate_limit_config.routes: unknown route "/stream"`},
+		{name: "rate limit of a disabled route", change: func(cfg *TallyPortConfig) {
+			cfg.RateLimitConfig.Routes = map[string]int{"/ingest": 10}
+		}, want: `rate_limit_config.routes: unknown route "/ingest"`},
+		{name: "negative route rate limit", change: func(cfg *TallyPortConfig) {
+			cfg.RateLimitConfig.Routes = map[string]int{"/push": -5}
+		}, want: "rate_limit_config.routes./push must be at least 0, got -5"},
+		{name: "misspelt restricted route", change: func(cfg *TallyPortConfig) {
+			cfg.IPAccessConfig.Routes = map[string]IPRule{"/pushes": {Allow: []string{"10.0.0.0/8"}}}
+		}, want: `ip_access_config.routes: unknown route "/pushes"`},
+		{name: "malformed allowed range", change: func(cfg *TallyPortConfig) {
+			cfg.IPAccessConfig.Routes = map[string]IPRule{"/push": {Allow: []string{"10.0.0.0/33"}}}
+		}, want: "ip_access_config.routes./push.allow"},
+		{name: "malformed trusted proxy", change: func(cfg *TallyPortConfig) {
+			cfg.IPAccessConfig.TrustedProxies = []string{"proxy.internal"}
+		}, want: "ip_access_config.trusted_proxies"},
+		{name: "stream without credentials", change: func(cfg *TallyPortConfig) { cfg.StreamConfig.Path = "/stream" },
+			want: "stream_config.path requires"},
+		{name: "remote write to a relative URL", change: func(cfg *TallyPortConfig) { cfg.RemoteWriteConfig.URL = "/write" },
+			want: "remote_write_config.url"},
+		{name: "backoff bounds swapped", change: func(cfg *TallyPortConfig) {
+			cfg.RemoteWriteConfig.MinBackoff = 5000
+			cfg.RemoteWriteConfig.MaxBackoff = 100
+		}, want: "remote_write_config.min_backoff (5000) must not exceed max_backoff (100)"},
+		{name: "unknown overflow", change: func(cfg *TallyPortConfig) { cfg.AsyncConfig.Overflow = "block" },
+			want: "async_config.overflow"},
+		{name: "signature skew below a second", change: func(cfg *TallyPortConfig) { cfg.AuthConfig.SignatureMaxSkew = 10 },
+			want: "auth_config.signature_max_skew must be at least 1000"},
+		{name: "JWT without issuer and audiences", change: func(cfg *TallyPortConfig) { cfg.AuthConfig.JWT.JWKSFile = "jwks.json" },
+			want: "auth_config.jwt.issuer is required"},
+		{name: "heart beat auth without credentials", change: func(cfg *TallyPortConfig) { cfg.ExportAuthConfig.HeartBeat = true },
+			want: "export_auth_config.heart_beat requires"},
+		{name: "reserved tenant label", change: func(cfg *TallyPortConfig) {
+			cfg.TenantConfig.Enabled = true
+			cfg.TenantConfig.Label = "__tenant"
+		}, want: `tenant_config.label "__tenant"`},
+		{name: "negative key quota", change: func(cfg *TallyPortConfig) {
+			cfg.QuotaConfig.Keys = map[string]QuotaLimits{"app": {MaxSeries: -1}}
+		}, want: "quota_config.keys.app.max_series must be at least 0"},
+		{name: "relative path", change: func(cfg *TallyPortConfig) { cfg.IngestConfig.Path = "ingest" },
+			want: `ingest_config.path "ingest" must start with /`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			tt.change(&cfg)
+			err := cfg.Validate()
+			switch {
+			case tt.want == "" && err != nil:
+				t.Fatalf("Validate() = %v, want nil", err)
+			case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+				t.Fatalf("Validate() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestValidateReportsEveryError(t *testing.T) {
+	cfg := Default()
+	cfg.ServerConfig.Port = ""
+	cfg.RateLimitConfig.KeyBy = "user"
+	cfg.IPAccessConfig.Routes = map[string]IPRule{"/pushes": {}}
+
+	err := cfg.Validate()
+	if err == nil {
+		t.Fatal("Validate() = nil, want errors")
+	}
+	for _, want := range []string{"server_config.port", "rate_limit_config.key_by", "ip_access_config.routes"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Validate() = %v, want it to report %s", err, want)
+		}
+	}
+}
+
+func TestApplyEnvOverrides(t *testing.T) {
+	env := map[string]string{
+		"TALLYPORT_SERVER_CONFIG_PORT":               ":9090",
+		"TALLYPORT_SERVER_CONFIG_IDLE_TIMEOUT":       " 45000 ",
+		"TALLYPORT_THROTTLE_CONFIG_BACKLOG_TIMEOUT":  "30s",
+		"TALLYPORT_STREAM_CONFIG_RATE_PER_SECOND":    "2.5",
+		"TALLYPORT_BUFFER_CONFIG_ENABLED":            "true",
+		"TALLYPORT_IP_ACCESS_CONFIG_TRUSTED_PROXIES": "10.0.0.0/8, ::1,",
+		"TALLYPORT_RATE_LIMIT_CONFIG_ROUTES":         "/push=10, /init = 5",
+		"TALLYPORT_QUOTA_CONFIG_MAX_SERIES":          "100",
+		"TALLYPORT_METRIC_EXPORT_PATH":               "/export",
+	}
+	cfg := Default()
+	if err := applyEnvOverrides(&cfg, func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}); err != nil {
+		t.Fatalf("applyEnvOverrides: %v", err)
+	}
+
+	if cfg.ServerConfig.Port != ":9090" {
+		t.Errorf("server_config.port = %q, want :9090", cfg.ServerConfig.Port)
+	}
+	if cfg.ServerConfig.IdleTimeout != 45000 {
+		t.Errorf("server_config.idle_timeout = %d, want 45000", cfg.ServerConfig.IdleTimeout)
+	}
+	if cfg.ThrottleConfig.BacklogTimeout != 30*time.Second {
+		t.Errorf("throttle_config.backlog_timeout = %s, want 30s", cfg.ThrottleConfig.BacklogTimeout)
+	}
+	if cfg.StreamConfig.RatePerSecond != 2.5 {
+		t.Errorf("stream_config.rate_per_second = %g, want 2.5", cfg.StreamConfig.RatePerSecond)
+	}
+	if !cfg.BufferConfig.Enabled {
+		t.Error("buffer_config.enabled = false, want true")
+	}
+	if want := []string{"10.0.0.0/8", "::1"}; !reflect.DeepEqual(cfg.IPAccessConfig.TrustedProxies, want) {
+		t.Errorf("ip_access_config.trusted_proxies = %q, want %q", cfg.IPAccessConfig.TrustedProxies, want)
+	}
+	if want := map[string]int{"/push": 10, "/init": 5}; !reflect.DeepEqual(cfg.RateLimitConfig.Routes, want) {
+		t.Errorf("rate_limit_config.routes = %v, want %v", cfg.RateLimitConfig.Routes, want)
+	}
+	if cfg.QuotaConfig.MaxSeries != 100 {
+		t.Errorf("quota_config.max_series = %d, want 100", cfg.QuotaConfig.MaxSeries)
+	}
+	if cfg.MetricExportPath != "/export" {
+		t.Errorf("metric_export_path = %q, want /export", cfg.MetricExportPath)
+	}
+	if cfg.ServerConfig.ServerName != defaultServerName {
+		t.Errorf("server_config.server_name = %q, want the default %q", cfg.ServerConfig.ServerName, defaultServerName)
+	}
+}
+
+func TestApplyEnvOverridesRefusesInvalidValues(t *testing.T) {
+	tests := []struct {
+		name, variable, value string
+	}{
+		{name: "integer", variable: "TALLYPORT_THROTTLE_CONFIG_LIMIT", value: "many"},
+		{name: "boolean", variable: "TALLYPORT_BUFFER_CONFIG_ENABLED", value: "sometimes"},
+		{name: "duration", variable: "TALLYPORT_THROTTLE_CONFIG_BACKLOG_TIMEOUT", value: "30"},
+		{name: "number", variable: "TALLYPORT_STREAM_CONFIG_RATE_PER_SECOND", value: "fast"},
+		{name: "map pair", variable: "TALLYPORT_RATE_LIMIT_CONFIG_ROUTES", value: "/push"},
+		{name: "map value", variable: "TALLYPORT_RATE_LIMIT_CONFIG_ROUTES", value: "/push=ten"},
+		{name: "map of objects", variable: "TALLYPORT_IP_ACCESS_CONFIG_ROUTES", value: "/push=10.0.0.0/8"},
+		{name: "list of objects", variable: "TALLYPORT_CORS_CONFIG_HEADERS", value: "Vary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := Default()
+			err := applyEnvOverrides(&cfg, func(name string) (string, bool) {
+				return tt.value, name == tt.variable
+			})
+			if err == nil || !strings.HasPrefix(err.Error(), tt.variable+":") {
+				t.Fatalf("applyEnvOverrides() = %v, want an error naming %s", err, tt.variable)
+			}
+		})
+	}
+}
+
+func TestLoad(t *testing.T) {
+	write := func(t *testing.T, content string) string {
+		t.Helper()
+		path := filepath.Join(t.TempDir(), "config.yml")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	t.Run("references and overrides", func(t *testing.T) {
+		t.Setenv("TP_TEST_SERVER_NAME", "edge-1")
+		t.Setenv("TALLYPORT_THROTTLE_CONFIG_LIMIT", "50")
+		cfg, err := Load(write(t, "server_config:\n  server_name: ${TP_TEST_SERVER_NAME}\n  port: \":9090\"\n"+
+			"throttle_config:\n  limit: 20\nrate_limit_config:\n  routes:\n    /push: 10\n"))
+		if err != nil {
+			t.Fatalf("Load: %v", err)
+		}
+		if cfg.ServerConfig.ServerName != "edge-1" {
+			t.Errorf("server_config.server_name = %q, want edge-1", cfg.ServerConfig.ServerName)
+		}
+		if cfg.ServerConfig.Port != ":9090" {
+			t.Errorf("server_config.port = %q, want :9090", cfg.ServerConfig.Port)
+		}
+		if cfg.ThrottleConfig.LimitSize != 50 {
+			t.Errorf("throttle_config.limit = %d, want the override 50", cfg.ThrottleConfig.LimitSize)
+		}
+		if cfg.ServerConfig.IdleTimeout != defaultIdleTimeout {
+			t.Errorf("server_config.idle_timeout = %d, want the default %d", cfg.ServerConfig.IdleTimeout, defaultIdleTimeout)
+		}
+	})
+
+	for _, tt := range []struct {
+		name, content, want string
+	}{
+		{name: "unknown key", content: "server_config:\n  prot: \":9090\"\n", want: "failed to parse"},
+		{name: "duplicate key", content: "rate_limit_config:\n  routes:\n    /push: 10\n  routes:\n    /init: 5\n", want: "failed to parse"},
+		{name: "invalid setting", content: "rate_limit_config:\n  routes:\n    /pushes: 10\n", want: "invalid config file"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := Load(write(t, tt.content)); err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Fatalf("Load() = %v, want an error containing %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envPrefix starts the name of every environment variable overriding a setting.
+const envPrefix = "TALLYPORT_"
+
+// envReference matches ${NAME} references in a configuration file. A bare $ is left alone,
+// since it also appears in values such as password hashes.
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// expandEnv replaces ${NAME} references in raw with the value of the environment variable
+// NAME, or with nothing when it is not set, as Prometheus does for its configuration files.
+func expandEnv(raw []byte) []byte {
+	return envReference.ReplaceAllFunc(raw, func(ref []byte) []byte {
+		return []byte(os.Getenv(string(ref[2 : len(ref)-1])))
+	})
+}
+
+// applyEnvOverrides sets every setting that has a TALLYPORT_* environment variable. The name
+// of the variable is the upper-cased YAML path of the setting joined by underscores, e.g.
+// TALLYPORT_SERVER_CONFIG_PORT for server_config.port.
+//
+// Lists of strings are given comma separated and maps as comma separated key=value pairs.
+// Durations use Go duration syntax ("2m"). Lists and maps of objects, such as
+// cors_config.headers, quota_config.tenants and quota_config.keys, can only be set in the file.
+// Settings of inlined structs are named as if they were declared in the enclosing one.
+//
+// Parameters:
+//   - cfg: Configuration to override.
+//   - lookup: Returns the value of an environment variable and whether it is set.
+//
+// Returns:
+//   - An error naming the variable whose value cannot be parsed.
+func applyEnvOverrides(cfg *TallyPortConfig, lookup func(string) (string, bool)) error {
+	return overrideFields(reflect.ValueOf(cfg).Elem(), envPrefix, lookup)
+}
+
+func overrideFields(v reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		key, flags, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if key == "-" {
+			continue
+		}
+		if flags == "inline" && field.Type.Kind() == reflect.Struct {
+			if err := overrideFields(v.Field(i), prefix, lookup); err != nil {
+				return err
+			}
+			continue
+		}
+		if key == "" {
+			// yaml.v2 falls back to the lower-cased field name.
+			key = strings.ToLower(field.Name)
+		}
+		name := prefix + strings.ToUpper(key)
+
+		if field.Type.Kind() == reflect.Struct {
+			if err := overrideFields(v.Field(i), name+"_", lookup); err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		if err := setField(v.Field(i), strings.TrimSpace(value)); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return nil
+}
+
+func setField(field reflect.Value, value string) error {
+	if field.Type() == durationType {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("invalid duration %q", value)
+		}
+		field.SetInt(int64(d))
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("invalid boolean %q", value)
+		}
+		field.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", value)
+		}
+		field.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid number %q", value)
+		}
+		field.SetFloat(f)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return errors.New("lists of objects can only be set in the config file")
+		}
+		var items []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	case reflect.Map:
+		if field.Type().Elem().Kind() == reflect.Struct {
+			return errors.New("maps of objects can only be set in the config file")
+		}
+		items := reflect.MakeMap(field.Type())
+		for _, pair := range strings.Split(value, ",") {
+			if strings.TrimSpace(pair) == "" {
+				continue
+			}
+			k, v, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("invalid key=value pair %q", pair)
+			}
+			item := reflect.New(field.Type().Elem()).Elem()
+			if err := setField(item, strings.TrimSpace(v)); err != nil {
+				return fmt.Errorf("%s: %w", strings.TrimSpace(k), err)
+			}
+			items.SetMapIndex(reflect.ValueOf(strings.TrimSpace(k)), item)
+		}
+		field.Set(items)
+	default:
+		return fmt.Errorf("%s settings cannot be set from the environment", field.Kind())
+	}
+	return nil
+}
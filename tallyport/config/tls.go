@@ -0,0 +1,122 @@
+package config
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// clientAuthTypes maps tls_server_config.client_auth_type to crypto/tls, using the names of
+// the Prometheus web configuration.
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"NoClientCert":               tls.NoClientCert,
+	"RequestClientCert":          tls.RequestClientCert,
+	"RequireAnyClientCert":       tls.RequireAnyClientCert,
+	"VerifyClientCertIfGiven":    tls.VerifyClientCertIfGiven,
+	"RequireAndVerifyClientCert": tls.RequireAndVerifyClientCert,
+}
+
+// tlsVersions maps tls_server_config.min_version and max_version to crypto/tls.
+var tlsVersions = map[string]uint16{
+	"TLS10": tls.VersionTLS10,
+	"TLS11": tls.VersionTLS11,
+	"TLS12": tls.VersionTLS12,
+	"TLS13": tls.VersionTLS13,
+}
+
+// ServerTLS holds tls_server_config in the form crypto/tls expects.
+type ServerTLS struct {
+	ClientAuth   tls.ClientAuthType // Client certificate policy
+	ClientCAs    *x509.CertPool     // CAs client certificates are verified against; nil without client_ca_file
+	MinVersion   uint16             // Lowest accepted TLS version
+	MaxVersion   uint16             // Highest accepted TLS version; 0 for the highest supported
+	CipherSuites []uint16           // TLS 1.0-1.2 cipher suites; nil for the Go defaults
+}
+
+// ServerTLS parses tls_server_config and loads the client CA bundle. TLS itself is enabled by
+// server_config.tls_path, so client certificate settings without it are rejected.
+//
+// Returns:
+//   - ServerTLS: The parsed settings; TLS 1.2 at minimum and no client certificates by default.
+//   - An error if a setting is unknown, inconsistent, or the client CA bundle cannot be loaded.
+func (cfg TallyPortConfig) ServerTLS() (ServerTLS, error) {
+	tc := cfg.TLSServerConfig
+	settings := ServerTLS{ClientAuth: tls.NoClientCert, MinVersion: tls.VersionTLS12}
+
+	if tc.ClientAuthType != "" {
+		clientAuth, ok := clientAuthTypes[tc.ClientAuthType]
+		if !ok {
+			return settings, fmt.Errorf("tls_server_config.client_auth_type %q is not one of %s",
+				tc.ClientAuthType, strings.Join(sortedKeys(clientAuthTypes), ", "))
+		}
+		settings.ClientAuth = clientAuth
+	}
+
+	if tc.MinVersion != "" {
+		version, ok := tlsVersions[tc.MinVersion]
+		if !ok {
+			return settings, fmt.Errorf("tls_server_config.min_version %q is not one of %s",
+				tc.MinVersion, strings.Join(sortedKeys(tlsVersions), ", "))
+		}
+		settings.MinVersion = version
+	}
+	if tc.MaxVersion != "" {
+		version, ok := tlsVersions[tc.MaxVersion]
+		if !ok {
+			return settings, fmt.Errorf("tls_server_config.max_version %q is not one of %s",
+				tc.MaxVersion, strings.Join(sortedKeys(tlsVersions), ", "))
+		}
+		if version < settings.MinVersion {
+			return settings, fmt.Errorf("tls_server_config.max_version %s is lower than min_version", tc.MaxVersion)
+		}
+		settings.MaxVersion = version
+	}
+
+	if len(tc.CipherSuites) > 0 {
+		suites := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			suites[suite.Name] = suite.ID
+		}
+		for _, name := range tc.CipherSuites {
+			id, ok := suites[name]
+			if !ok {
+				return settings, fmt.Errorf("tls_server_config.cipher_suites: %q is not a supported cipher suite", name)
+			}
+			settings.CipherSuites = append(settings.CipherSuites, id)
+		}
+	}
+
+	verifies := settings.ClientAuth == tls.VerifyClientCertIfGiven || settings.ClientAuth == tls.RequireAndVerifyClientCert
+	switch {
+	case tc.ClientCAFile != "":
+		raw, err := os.ReadFile(filepath.Clean(tc.ClientCAFile))
+		if err != nil {
+			return settings, fmt.Errorf("tls_server_config.client_ca_file: %w", err)
+		}
+		settings.ClientCAs = x509.NewCertPool()
+		if !settings.ClientCAs.AppendCertsFromPEM(raw) {
+			return settings, fmt.Errorf("tls_server_config.client_ca_file %s contains no PEM certificates", tc.ClientCAFile)
+		}
+	case verifies:
+		return settings, fmt.Errorf("tls_server_config.client_auth_type %s requires client_ca_file", tc.ClientAuthType)
+	}
+
+	if cfg.ServerConfig.TlsPath == "" && (settings.ClientAuth != tls.NoClientCert || tc.ClientCAFile != "") {
+		return settings, errors.New("tls_server_config client certificates require server_config.tls_path")
+	}
+	return settings, nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
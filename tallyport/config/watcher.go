@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/rs/zerolog"
+)
+
+// watchDebounce is how long a watcher waits for a burst of file events to settle, since
+// editors usually write, truncate and rename a file in several steps when saving it.
+const watchDebounce = 250 * time.Millisecond
+
+// Watcher calls a function whenever the configuration file changes on disk.
+//
+// The directory of the file is watched rather than the file itself, so changes made by
+// replacing the file, as editors and configuration management tools do, are noticed as well.
+type Watcher struct {
+	path     string
+	onChange func()
+	watcher  *fsnotify.Watcher
+	logger   zerolog.Logger
+	done     chan struct{}
+	wg       sync.WaitGroup
+}
+
+// NewWatcher creates a Watcher for the configuration file at path.
+//
+// Parameters:
+//   - path: Location of the configuration file.
+//   - onChange: Function called once per burst of changes to the file.
+//   - logger: Logger used to report watch errors.
+//
+// Returns:
+//   - *Watcher: The watcher, started with Start.
+//   - An error if the directory of the file cannot be watched.
+func NewWatcher(path string, onChange func(), logger zerolog.Logger) (*Watcher, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve config file path: %w", err)
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create config watcher: %w", err)
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch config directory: %w", err)
+	}
+
+	return &Watcher{
+		path:     path,
+		onChange: onChange,
+		watcher:  watcher,
+		logger:   logger,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Start begins watching the configuration file in the background.
+func (w *Watcher) Start() {
+	w.wg.Add(1)
+	go func() {
+		defer w.wg.Done()
+		w.run()
+	}()
+}
+
+// Stop stops watching the configuration file.
+func (w *Watcher) Stop() {
+	close(w.done)
+	w.watcher.Close()
+	w.wg.Wait()
+}
+
+func (w *Watcher) run() {
+	debounce := time.NewTimer(watchDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != w.path || event.Op == fsnotify.Chmod {
+				continue
+			}
+			debounce.Reset(watchDebounce)
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			w.logger.Warn().Err(err).Msg("config watcher error")
+		case <-debounce.C:
+			w.onChange()
+		case <-w.done:
+			return
+		}
+	}
+}
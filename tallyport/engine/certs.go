@@ -0,0 +1,233 @@
+package engine
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/rs/zerolog"
+)
+
+// certReloadDebounce is how long the certificate store waits for a burst of changes in the
+// TLS directory to settle, since a certificate and its key are rarely replaced at once.
+const certReloadDebounce = time.Second
+
+// certSet is an immutable snapshot of the certificates loaded from the TLS directory.
+type certSet struct {
+	certificates []*tls.Certificate
+	byName       map[string]*tls.Certificate // DNS names and IP addresses, lower-cased
+}
+
+// certStore serves certificates from the TLS directory through tls.Config.GetCertificate,
+// selecting them by SNI and reloading them whenever the directory changes. Handshakes keep
+// using the previous certificates when a reload fails.
+type certStore struct {
+	directory string
+	current   atomic.Pointer[certSet]
+	logger    zerolog.Logger
+	watcher   *fsnotify.Watcher
+	done      chan struct{}
+	wg        sync.WaitGroup
+
+	notAfter *prometheus.GaugeVec
+	reloads  *prometheus.CounterVec
+}
+
+// newCertStore loads the certificates in directory and registers the certificate metrics.
+//
+// Parameters:
+//   - directory: Directory containing TLS certificate (.cert) and key (.key) files.
+//   - reg: Registerer for the certificate metrics; the metrics are not exported when nil.
+//   - logger: Logger used to report reloads.
+//
+// Returns:
+//   - *certStore: The store, watching directory once started.
+//   - An error if no certificate can be loaded or the metrics cannot be registered.
+func newCertStore(directory string, reg prometheus.Registerer, logger zerolog.Logger) (*certStore, error) {
+	cs := &certStore{
+		directory: directory,
+		logger:    logger,
+		done:      make(chan struct{}),
+		notAfter: prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Namespace: "__tallyport__",
+				Subsystem: "tls",
+				Name:      "certificate_not_after_timestamp_seconds",
+				Help:      "Expiry of the served TLS certificates",
+			},
+			[]string{"file", "common_name"},
+		),
+		reloads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: "__tallyport__",
+				Subsystem: "tls",
+				Name:      "certificate_reloads_total",
+				Help:      "TLS certificate reloads by result (success or failure)",
+			},
+			[]string{"result"},
+		),
+	}
+
+	if err := cs.reload(); err != nil {
+		return nil, err
+	}
+
+	if reg != nil {
+		for _, collector := range []prometheus.Collector{cs.notAfter, cs.reloads} {
+			if err := reg.Register(collector); err != nil {
+				return nil, fmt.Errorf("failed to register certificate metric: %w", err)
+			}
+		}
+	}
+	return cs, nil
+}
+
+// start watches the TLS directory and reloads the certificates when it changes.
+func (cs *certStore) start() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("failed to create certificate watcher: %w", err)
+	}
+	if err := watcher.Add(cs.directory); err != nil {
+		watcher.Close()
+		return fmt.Errorf("failed to watch %s: %w", cs.directory, err)
+	}
+	cs.watcher = watcher
+
+	cs.wg.Add(1)
+	go func() {
+		defer cs.wg.Done()
+		cs.run()
+	}()
+	return nil
+}
+
+// stop stops watching the TLS directory.
+func (cs *certStore) stop() {
+	if cs.watcher == nil {
+		return
+	}
+	close(cs.done)
+	cs.watcher.Close()
+	cs.wg.Wait()
+}
+
+func (cs *certStore) run() {
+	debounce := time.NewTimer(certReloadDebounce)
+	debounce.Stop()
+	defer debounce.Stop()
+
+	for {
+		select {
+		case event, ok := <-cs.watcher.Events:
+			if !ok {
+				return
+			}
+			if event.Op != fsnotify.Chmod {
+				debounce.Reset(certReloadDebounce)
+			}
+		case err, ok := <-cs.watcher.Errors:
+			if !ok {
+				return
+			}
+			cs.logger.Warn().Err(err).Msg("certificate watcher error")
+		case <-debounce.C:
+			if err := cs.reload(); err != nil {
+				cs.logger.Error().Err(err).Msg("certificate reload failed, keeping the current certificates")
+				continue
+			}
+			cs.logger.Info().Msgf("certificates reloaded from %s", cs.directory)
+		case <-cs.done:
+			return
+		}
+	}
+}
+
+// reload loads every certificate pair in the directory and swaps them in.
+func (cs *certStore) reload() error {
+	named, err := collectTlsCertificates(cs.directory)
+	if err == nil && len(named) == 0 {
+		err = fmt.Errorf("no .cert/.key pairs found in %s", cs.directory)
+	}
+	if err != nil {
+		cs.reloads.WithLabelValues("failure").Inc()
+		return fmt.Errorf("error occurred loading tls certificate: %w", err)
+	}
+
+	set := &certSet{byName: make(map[string]*tls.Certificate)}
+	cs.notAfter.Reset()
+	files := make([]string, 0, len(named))
+	for file := range named {
+		files = append(files, file)
+	}
+	slices.Sort(files)
+
+	for _, file := range files {
+		certificate := named[file]
+		leaf := certificate.Leaf
+		set.certificates = append(set.certificates, certificate)
+		for _, name := range leaf.DNSNames {
+			set.byName[strings.ToLower(name)] = certificate
+		}
+		for _, ip := range leaf.IPAddresses {
+			set.byName[ip.String()] = certificate
+		}
+		if len(leaf.DNSNames) == 0 && leaf.Subject.CommonName != "" {
+			set.byName[strings.ToLower(leaf.Subject.CommonName)] = certificate
+		}
+		cs.notAfter.WithLabelValues(file, leaf.Subject.CommonName).Set(float64(leaf.NotAfter.Unix()))
+	}
+
+	cs.current.Store(set)
+	cs.reloads.WithLabelValues("success").Inc()
+	return nil
+}
+
+// getCertificate selects the certificate for a handshake: an exact match of the requested
+// server name first, then a wildcard certificate covering it, then any certificate the client
+// supports, and finally the first certificate.
+func (cs *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set := cs.current.Load()
+
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" && hello.Conn != nil {
+		// Clients connecting by IP address send no SNI.
+		name, _, _ = net.SplitHostPort(hello.Conn.LocalAddr().String())
+	}
+	if certificate, ok := set.byName[name]; ok {
+		return certificate, nil
+	}
+	if _, parent, ok := strings.Cut(name, "."); ok {
+		if certificate, ok := set.byName["*."+parent]; ok {
+			return certificate, nil
+		}
+	}
+
+	for _, certificate := range set.certificates {
+		if hello.SupportsCertificate(certificate) == nil {
+			return certificate, nil
+		}
+	}
+	return set.certificates[0], nil
+}
+
+// parseLeaf makes sure certificate.Leaf is set, which tls.LoadX509KeyPair only does since Go 1.23.
+func parseLeaf(certificate *tls.Certificate) error {
+	if certificate.Leaf != nil {
+		return nil
+	}
+	leaf, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		return err
+	}
+	certificate.Leaf = leaf
+	return nil
+}
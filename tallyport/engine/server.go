@@ -3,6 +3,7 @@ package engine
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"io/fs"
@@ -15,6 +16,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/rs/zerolog"
 )
 
@@ -31,6 +33,15 @@ type ServerOpts struct {
 	DisableGeneralOptionsHandler bool          // Whether to disable the default OPTIONS handler
 	UseColorizedLogger           bool          // Whether to use a colorized console logger
 	ReadTimeout                  time.Duration
+	OnReload                     func() // Called on SIGHUP; the signal is only logged when nil
+
+	ClientAuth    tls.ClientAuthType // Client certificate policy when TLS is enabled
+	ClientCAs     *x509.CertPool     // CAs client certificates are verified against
+	MinTLSVersion uint16             // Lowest accepted TLS version; TLS 1.2 when zero
+	MaxTLSVersion uint16             // Highest accepted TLS version; the highest supported when zero
+	CipherSuites  []uint16           // TLS 1.0-1.2 cipher suites; the Go defaults when nil
+
+	Registerer prometheus.Registerer // Registerer for the TLS certificate metrics; not exported when nil
 }
 
 // Server represents an HTTP server with support for TLS and graceful shutdown.
@@ -51,7 +62,8 @@ type Server struct {
 //
 // It initializes the server with a name, address, logger, TLS directory, and options.
 // If UseColorizedLogger is enabled in opts, a colorized console logger is configured.
-// A shutdown channel is created to handle graceful shutdown signals (SIGINT, SIGTERM).
+// A shutdown channel is created to handle graceful shutdown signals (SIGINT, SIGTERM) and
+// reload signals (SIGHUP).
 //
 // Parameters:
 //   - serverName: The name of the server, used in logs.
@@ -98,11 +110,15 @@ func NewServer(
 //
 // It configures the server with the provided options (e.g., MaxHeaderBytes, TLS settings)
 // and starts listening on the specified address. If EnableTls is true, it loads TLS certificates
-// from TlsConfigDir and serves over HTTPS. The server runs in a background goroutine and
-// listens for shutdown signals (SIGINT, SIGTERM). On receiving a signal, it performs a graceful
-// shutdown with a 10-second timeout. Errors during startup or shutdown are logged using the
-// configured logger (colorized if enabled).
-func (s *Server) Serve() {
+// from TlsConfigDir and serves over HTTPS, verifying client certificates as set by ClientAuth
+// and ClientCAs. Certificates are selected by SNI and reloaded whenever TlsConfigDir changes,
+// and their expiry is exported through Registerer. The server runs in a background goroutine and listens for shutdown signals
+// (SIGINT, SIGTERM). On receiving a signal, it performs a graceful shutdown with a 10-second
+// timeout. SIGHUP calls OnReload, when set, and keeps serving.
+//
+// Returns:
+//   - An error if the certificates cannot be loaded or the server cannot listen on its address.
+func (s *Server) Serve() error {
 	logger := s.ColorizedLogger
 	if !s.Opts.UseColorizedLogger {
 		logger = s.ExternalLogger
@@ -117,40 +133,64 @@ func (s *Server) Serve() {
 	}
 
 	if s.Opts.EnableTls {
-		certificates, err := collectTlsCertificates(s.TlsConfigDir)
+		certificates, err := newCertStore(s.TlsConfigDir, s.Opts.Registerer, logger)
 		if err != nil {
-			logger.Error().Msgf("error occurred loading tls certificate: %v", err)
+			return err
 		}
+		if err := certificates.start(); err != nil {
+			return err
+		}
+		defer certificates.stop()
 
+		minVersion := s.Opts.MinTLSVersion
+		if minVersion == 0 {
+			minVersion = tls.VersionTLS12
+		}
 		s.server.TLSConfig = &tls.Config{
-			ServerName:         s.ServerName,
-			Certificates:       certificates,
-			InsecureSkipVerify: false,
-			ClientAuth:         tls.VerifyClientCertIfGiven,
+			ServerName:     s.ServerName,
+			GetCertificate: certificates.getCertificate,
+			ClientAuth:     s.Opts.ClientAuth,
+			ClientCAs:      s.Opts.ClientCAs,
+			MinVersion:     minVersion,
+			MaxVersion:     s.Opts.MaxTLSVersion,
+			CipherSuites:   s.Opts.CipherSuites,
 			Time: func() time.Time {
 				return time.Now()
 			},
 		}
 	}
 
-	signal.Notify(s.shutdownChannel, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(s.shutdownChannel, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(s.shutdownChannel)
 
+	serveErr := make(chan error, 1)
 	go func(s *Server, logger zerolog.Logger) {
-		logger.Info().Msgf("Starting server (%s) on %v", s.ServerName, s.server.Addr)
+		logger.Info().Msgf("Starting server (%s) on %v (tls: %t)", s.ServerName, s.server.Addr, s.Opts.EnableTls)
+		var err error
 		if !s.Opts.EnableTls {
-			err := s.server.ListenAndServe()
-			if err != nil && !errors.Is(err, http.ErrServerClosed) {
-				logger.Error().Msg("Could not start server engine")
-			}
+			err = s.server.ListenAndServe()
 		} else {
-			err := s.server.ListenAndServeTLS("", "")
-			if err != nil && !errors.Is(err, http.ErrServerClosed) {
-				logger.Error().Msg("Could not start server engine")
-			}
+			err = s.server.ListenAndServeTLS("", "")
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			serveErr <- err
 		}
 	}(s, logger)
 
-	sig := <-s.shutdownChannel
+	var sig os.Signal
+	for sig == nil || sig == syscall.SIGHUP {
+		select {
+		case err := <-serveErr:
+			return fmt.Errorf("could not start server engine: %w", err)
+		case sig = <-s.shutdownChannel:
+		}
+		if sig == syscall.SIGHUP {
+			logger.Info().Msgf("=> Caught %v, reloading", sig.String())
+			if s.Opts.OnReload != nil {
+				s.Opts.OnReload()
+			}
+		}
+	}
 	logger.Info().Msgf("=> Caught %v", sig.String())
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -161,6 +201,7 @@ func (s *Server) Serve() {
 
 	<-ctx.Done()
 	logger.Info().Msg("Server terminated successfully")
+	return nil
 }
 
 // Shutdown initiates a graceful shutdown of the server by sending a SIGTERM signal.
@@ -173,15 +214,16 @@ func (s *Server) Shutdown() {
 // collectTlsCertificates loads TLS certificate and key pairs from the specified directory.
 //
 // It walks the directory to find files with ".cert" and ".key" extensions, pairing them by name
-// (e.g., "server.cert" with "server.key"). Each pair is loaded into a tls.Certificate.
+// (e.g., "server.cert" with "server.key"). Each pair is loaded into a tls.Certificate with its
+// parsed leaf certificate.
 //
 // Parameters:
 //   - directory: The directory containing TLS certificate (.cert) and key (.key) files.
 //
 // Returns:
-//   - A slice of tls.Certificate objects for the loaded certificate-key pairs.
+//   - The loaded certificate-key pairs, keyed by certificate file name.
 //   - An error if the directory cannot be read, a key is missing, or a certificate pair fails to load.
-func collectTlsCertificates(directory string) ([]tls.Certificate, error) {
+func collectTlsCertificates(directory string) (map[string]*tls.Certificate, error) {
 	keyFiles := make(map[string]string)
 	certFiles := make(map[string]string)
 
@@ -210,7 +252,7 @@ func collectTlsCertificates(directory string) ([]tls.Certificate, error) {
 		return nil, fmt.Errorf("error walking directory: %w", err)
 	}
 
-	certificates := make([]tls.Certificate, 0, len(certFiles))
+	certificates := make(map[string]*tls.Certificate, len(certFiles))
 	for certName, certPath := range certFiles {
 		keyName := strings.TrimSuffix(certName, ".cert") + ".key"
 		keyPath, ok := keyFiles[keyName]
@@ -222,8 +264,11 @@ func collectTlsCertificates(directory string) ([]tls.Certificate, error) {
 		if err != nil {
 			return nil, fmt.Errorf("failed to load certificate pair %s: %w", certName, err)
 		}
+		if err := parseLeaf(&cert); err != nil {
+			return nil, fmt.Errorf("failed to parse certificate %s: %w", certName, err)
+		}
 
-		certificates = append(certificates, cert)
+		certificates[certName] = &cert
 	}
 
 	return certificates, nil
@@ -0,0 +1,232 @@
+// Package prompb implements the subset of the Prometheus remote write protocol used by tallyport.
+//
+// The types mirror the messages of prometheus/prompb (remote.proto and types.proto) and are
+// encoded by hand with protowire, which keeps tallyport free of the Prometheus server module.
+// Fields tallyport does not use (exemplars, native histograms) are skipped when decoding.
+package prompb
+
+import (
+	"fmt"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// MetricType is the metric family type carried in remote write metadata.
+type MetricType int32
+
+// Metric types as numbered in types.proto.
+const (
+	MetricTypeUnknown        MetricType = 0
+	MetricTypeCounter        MetricType = 1
+	MetricTypeGauge          MetricType = 2
+	MetricTypeHistogram      MetricType = 3
+	MetricTypeGaugeHistogram MetricType = 4
+	MetricTypeSummary        MetricType = 5
+	MetricTypeInfo           MetricType = 6
+	MetricTypeStateset       MetricType = 7
+)
+
+// Label is a single name/value pair of a series.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is a single value of a series at a timestamp in milliseconds.
+type Sample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// TimeSeries is a series identified by its labels, including __name__, and its samples.
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+// MetricMetadata describes a metric family sent alongside the series.
+type MetricMetadata struct {
+	Type             MetricType
+	MetricFamilyName string
+	Help             string
+	Unit             string
+}
+
+// WriteRequest is the body of a remote write request before snappy compression.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+	Metadata   []MetricMetadata
+}
+
+// Marshal encodes the request in the protobuf wire format.
+func (m *WriteRequest) Marshal() []byte {
+	var b []byte
+	for i := range m.Timeseries {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Timeseries[i].marshal())
+	}
+	for i := range m.Metadata {
+		b = protowire.AppendTag(b, 3, protowire.BytesType)
+		b = protowire.AppendBytes(b, m.Metadata[i].marshal())
+	}
+	return b
+}
+
+// Unmarshal decodes a request from the protobuf wire format.
+func (m *WriteRequest) Unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var ts TimeSeries
+			if err := ts.unmarshal(v); err != nil {
+				return fmt.Errorf("timeseries: %w", err)
+			}
+			m.Timeseries = append(m.Timeseries, ts)
+		case num == 3 && typ == protowire.BytesType:
+			var md MetricMetadata
+			if err := md.unmarshal(v); err != nil {
+				return fmt.Errorf("metadata: %w", err)
+			}
+			m.Metadata = append(m.Metadata, md)
+		}
+		return nil
+	})
+}
+
+func (m *TimeSeries) marshal() []byte {
+	var b []byte
+	for _, label := range m.Labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendString(lb, label.Name)
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, label.Value)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+	for _, sample := range m.Samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(sample.Value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(sample.Timestamp))
+
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
+
+func (m *TimeSeries) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var label Label
+			err := walk(v, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) error {
+				switch {
+				case num == 1 && typ == protowire.BytesType:
+					label.Name = string(v)
+				case num == 2 && typ == protowire.BytesType:
+					label.Value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("label: %w", err)
+			}
+			m.Labels = append(m.Labels, label)
+		case num == 2 && typ == protowire.BytesType:
+			var sample Sample
+			err := walk(v, func(num protowire.Number, typ protowire.Type, _ []byte, n uint64) error {
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					sample.Value = math.Float64frombits(n)
+				case num == 2 && typ == protowire.VarintType:
+					sample.Timestamp = int64(n)
+				}
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("sample: %w", err)
+			}
+			m.Samples = append(m.Samples, sample)
+		}
+		return nil
+	})
+}
+
+func (m *MetricMetadata) marshal() []byte {
+	var b []byte
+	b = protowire.AppendTag(b, 1, protowire.VarintType)
+	b = protowire.AppendVarint(b, uint64(m.Type))
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendString(b, m.MetricFamilyName)
+	if m.Help != "" {
+		b = protowire.AppendTag(b, 4, protowire.BytesType)
+		b = protowire.AppendString(b, m.Help)
+	}
+	if m.Unit != "" {
+		b = protowire.AppendTag(b, 5, protowire.BytesType)
+		b = protowire.AppendString(b, m.Unit)
+	}
+	return b
+}
+
+func (m *MetricMetadata) unmarshal(b []byte) error {
+	return walk(b, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error {
+		switch {
+		case num == 1 && typ == protowire.VarintType:
+			m.Type = MetricType(n)
+		case num == 2 && typ == protowire.BytesType:
+			m.MetricFamilyName = string(v)
+		case num == 4 && typ == protowire.BytesType:
+			m.Help = string(v)
+		case num == 5 && typ == protowire.BytesType:
+			m.Unit = string(v)
+		}
+		return nil
+	})
+}
+
+// walk iterates over the fields of an encoded message.
+// For length-delimited fields v holds the payload; for varint and fixed fields n holds the value.
+func walk(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64) error) error {
+	for len(b) > 0 {
+		num, typ, tagLen := protowire.ConsumeTag(b)
+		if tagLen < 0 {
+			return protowire.ParseError(tagLen)
+		}
+		b = b[tagLen:]
+
+		var (
+			v        []byte
+			n        uint64
+			valueLen int
+		)
+		switch typ {
+		case protowire.VarintType:
+			n, valueLen = protowire.ConsumeVarint(b)
+		case protowire.Fixed64Type:
+			n, valueLen = protowire.ConsumeFixed64(b)
+		case protowire.Fixed32Type:
+			var n32 uint32
+			n32, valueLen = protowire.ConsumeFixed32(b)
+			n = uint64(n32)
+		case protowire.BytesType:
+			v, valueLen = protowire.ConsumeBytes(b)
+		default:
+			valueLen = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if valueLen < 0 {
+			return protowire.ParseError(valueLen)
+		}
+		b = b[valueLen:]
+
+		if err := fn(num, typ, v, n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
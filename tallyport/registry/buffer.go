@@ -0,0 +1,249 @@
+package registry
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"tallyport/config"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Defaults used when the matching buffer_config field is not set.
+const (
+	bufferDefaultFlushInterval   = time.Second
+	bufferDefaultMaxObservations = 1000
+	bufferShardCount             = 16
+)
+
+// bufferedSeries aggregates the pushes received for one series since the last flush.
+// The resolved vector child is kept across flushes so steady-state pushes never touch the vector.
+type bufferedSeries struct {
+	metric       MetricRequest
+	child        prometheus.Metric
+	delta        float64
+	value        float64
+	observations []float64
+	dirty        bool
+}
+
+// bufferShard is one lock-protected slice of the buffered series.
+type bufferShard struct {
+	sync.Mutex
+	series map[string]*bufferedSeries
+}
+
+// IngestBuffer pre-aggregates pushes in memory and applies them to the Prometheus vectors on a
+// short interval. Counter increments are summed, only the latest gauge value is kept and histogram
+// observations are collected, trading a delay of at most one flush interval for far less
+// contention on hot series. Series are spread over shards by key, and every shard is swapped out
+// under its lock and applied to the vectors after the lock is released.
+type IngestBuffer struct {
+	shards          [bufferShardCount]bufferShard
+	forgets         atomic.Uint64 // Calls to forget, so record notices deletions while it resolves
+	events          *EventBroker
+	interval        time.Duration
+	maxObservations int
+	done            chan struct{}
+	wg              sync.WaitGroup
+
+	pending       prometheus.Gauge
+	flushed       prometheus.Counter
+	flushDuration prometheus.Histogram
+}
+
+// NewIngestBuffer creates an IngestBuffer from buffer_config and registers its own metrics with reg.
+// Pushes are only aggregated; nothing reaches the vectors until Start is called.
+//
+// Parameters:
+//   - cfg: Server configuration, of which buffer_config is used.
+//   - events: EventBroker notified when buffered series are flushed.
+//   - reg: Prometheus registry receiving the buffer metrics.
+//
+// Returns:
+//   - *IngestBuffer: The configured buffer.
+//   - An error if the buffer metrics cannot be registered.
+func NewIngestBuffer(cfg config.TallyPortConfig, events *EventBroker, reg prometheus.Registerer) (*IngestBuffer, error) {
+	ib := &IngestBuffer{
+		events:          events,
+		interval:        config.MillisecondsOr(cfg.BufferConfig.FlushInterval, bufferDefaultFlushInterval),
+		maxObservations: cfg.BufferConfig.MaxObservations,
+		done:            make(chan struct{}),
+		pending: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "buffer",
+			Name:      "pending_series",
+			Help:      "Series with unflushed updates at the start of the last flush",
+		}),
+		flushed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "buffer",
+			Name:      "flushed_series_total",
+			Help:      "Series updates applied to the metric vectors by the buffer",
+		}),
+		flushDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "buffer",
+			Name:      "flush_duration_seconds",
+			Help:      "Duration of buffer flushes in seconds",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+	if ib.maxObservations <= 0 {
+		ib.maxObservations = bufferDefaultMaxObservations
+	}
+	for i := range ib.shards {
+		ib.shards[i].series = make(map[string]*bufferedSeries)
+	}
+
+	for _, collector := range []prometheus.Collector{ib.pending, ib.flushed, ib.flushDuration} {
+		if err := reg.Register(collector); err != nil {
+			return nil, fmt.Errorf("failed to register buffer metric: %w", err)
+		}
+	}
+
+	return ib, nil
+}
+
+// Start launches the flush loop.
+func (ib *IngestBuffer) Start() {
+	ib.wg.Add(1)
+	go func() {
+		defer ib.wg.Done()
+		ticker := time.NewTicker(ib.interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				ib.flush()
+			case <-ib.done:
+				ib.flush()
+				return
+			}
+		}
+	}()
+}
+
+// Stop ends the flush loop after a final flush.
+func (ib *IngestBuffer) Stop() {
+	close(ib.done)
+	ib.wg.Wait()
+}
+
+// record aggregates a push into its series. resolve is only called the first time a series is
+// seen, to validate the labels and look up the vector child the series is flushed into. It
+// must fail once the metric is deleted; a series whose metric is forgotten while it is
+// resolved is resolved again, so it never binds to the child of a deleted vector.
+func (ib *IngestBuffer) record(metric MetricRequest, resolve func() (prometheus.Metric, error)) error {
+	key := metric.Type + "\xff" + metric.Name + "\xff" + strings.Join(metric.Labels, "\xff")
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	shard := &ib.shards[hash.Sum32()%bufferShardCount]
+
+	shard.Lock()
+	entry, exists := shard.series[key]
+	for !exists {
+		shard.Unlock()
+		forgets := ib.forgets.Load()
+		child, err := resolve()
+		if err != nil {
+			return err
+		}
+		shard.Lock()
+		if entry, exists = shard.series[key]; !exists && ib.forgets.Load() == forgets {
+			entry = &bufferedSeries{metric: metric, child: child}
+			shard.series[key] = entry
+			exists = true
+		}
+	}
+
+	var overflow []float64
+	switch metric.Type {
+	case TypeCounter:
+		entry.delta++
+	case TypeGauge:
+		entry.value = metric.Gauge.Value
+	case TypeHistogram:
+		entry.observations = append(entry.observations, metric.Histogram.ObservedValue)
+		entry.metric.Histogram.ObservedValue = metric.Histogram.ObservedValue
+		// A series observed faster than it is flushed is applied right away to bound memory.
+		if len(entry.observations) >= ib.maxObservations {
+			overflow = entry.observations
+			entry.observations = nil
+		}
+	}
+	entry.dirty = true
+	shard.Unlock()
+
+	if overflow != nil {
+		observer := entry.child.(prometheus.Observer)
+		for _, value := range overflow {
+			observer.Observe(value)
+		}
+	}
+	return nil
+}
+
+// forget drops every buffered series of a metric, e.g. after the metric was deleted.
+func (ib *IngestBuffer) forget(name string) {
+	ib.forgets.Add(1)
+	for i := range ib.shards {
+		shard := &ib.shards[i]
+		shard.Lock()
+		for key, entry := range shard.series {
+			if entry.metric.Name == name {
+				delete(shard.series, key)
+			}
+		}
+		shard.Unlock()
+	}
+}
+
+// flush applies the aggregated updates of every shard. Each shard is locked only while its
+// pending updates are copied out; the vectors are updated after the lock is released.
+func (ib *IngestBuffer) flush() {
+	start := time.Now()
+	pending := 0
+
+	for i := range ib.shards {
+		shard := &ib.shards[i]
+
+		var batch []bufferedSeries
+		shard.Lock()
+		for _, entry := range shard.series {
+			if !entry.dirty {
+				continue
+			}
+			batch = append(batch, *entry)
+			entry.delta = 0
+			entry.observations = nil
+			entry.dirty = false
+		}
+		shard.Unlock()
+
+		pending += len(batch)
+		for _, update := range batch {
+			// Gauges also satisfy prometheus.Counter, so dispatch on the metric type.
+			switch update.metric.Type {
+			case TypeCounter:
+				update.child.(prometheus.Counter).Add(update.delta)
+			case TypeGauge:
+				update.child.(prometheus.Gauge).Set(update.value)
+			case TypeHistogram:
+				observer := update.child.(prometheus.Observer)
+				for _, value := range update.observations {
+					observer.Observe(value)
+				}
+			}
+			ib.events.publish(update.metric, update.child)
+		}
+	}
+
+	ib.pending.Set(float64(pending))
+	ib.flushed.Add(float64(pending))
+	ib.flushDuration.Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,81 @@
+package registry
+
+import (
+	"tallyport/config"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newBufferedRegistry(t *testing.T) (*CollectorRegistry, *IngestBuffer) {
+	t.Helper()
+	mc := NewCollectorRegistry()
+	buffer, err := mc.EnableBuffer(config.Default(), prometheus.NewRegistry())
+	if err != nil {
+		t.Fatalf("EnableBuffer: %v", err)
+	}
+	return mc, buffer
+}
+
+func TestIngestBufferResolvesAgainWhenForgottenWhileResolving(t *testing.T) {
+	_, ib := newBufferedRegistry(t)
+	deleted := prometheus.NewCounter(prometheus.CounterOpts{Name: "deleted"})
+	current := prometheus.NewCounter(prometheus.CounterOpts{Name: "current"})
+
+	calls := 0
+	resolve := func() (prometheus.Metric, error) {
+		calls++
+		if calls == 1 {
+			// DeleteMetric runs while the first push of the series resolves its child.
+			ib.forget("app_requests")
+			return deleted, nil
+		}
+		return current, nil
+	}
+	if err := ib.record(MetricRequest{Type: TypeCounter, Name: "app_requests"}, resolve); err != nil {
+		t.Fatalf("record: %v", err)
+	}
+	ib.flush()
+
+	if calls != 2 {
+		t.Errorf("resolve called %d times, want 2", calls)
+	}
+	if got := testutil.ToFloat64(deleted); got != 0 {
+		t.Errorf("child of the deleted vector = %g, want 0", got)
+	}
+	if got := testutil.ToFloat64(current); got != 1 {
+		t.Errorf("child of the current vector = %g, want 1", got)
+	}
+}
+
+func TestIngestBufferFlushesIntoReinitializedMetric(t *testing.T) {
+	mc, buffer := newBufferedRegistry(t)
+	definition := MetricRequest{Type: TypeGauge, Name: "app_battery", Description: "Battery level", Labels: []string{"device"}}
+	push := MetricRequest{Type: TypeGauge, Name: "app_battery", Labels: []string{"ios"}}
+
+	if _, err := mc.Register(definition); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	push.Gauge.Value = 10
+	if err := mc.Update(push); err != nil {
+		t.Fatalf("update: %v", err)
+	}
+	mc.Remove(TypeGauge, definition.Name)
+	if _, err := mc.Register(definition); err != nil {
+		t.Fatalf("register again: %v", err)
+	}
+	push.Gauge.Value = 20
+	if err := mc.Update(push); err != nil {
+		t.Fatalf("update again: %v", err)
+	}
+	buffer.flush()
+
+	gauge, ok := mc.gauges.load(Metric{key: definition.Name})
+	if !ok {
+		t.Fatal("gauge is not registered")
+	}
+	if got := testutil.ToFloat64(gauge.WithLabelValues("ios")); got != 20 {
+		t.Errorf("gauge = %g, want 20", got)
+	}
+}
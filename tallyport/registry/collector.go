@@ -0,0 +1,638 @@
+// Package registry keeps the Prometheus metric vectors created through tallyport and applies
+// pushed updates to them.
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"tallyport/config"
+	"tallyport/validation"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// CacheMap is a thread-safe map for storing Prometheus metric vectors.
+// It uses a generic type T to support different metric types (CounterVec, GaugeVec, etc.).
+// Metrics are registered once and then looked up on every push, so the map is backed by a
+// sync.Map, whose reads take no lock. Callers observe into the returned vector after the
+// lookup; Prometheus vectors are safe for concurrent use on their own.
+type CacheMap[T any] struct {
+	cache sync.Map
+}
+
+// load returns the vector stored under key.
+func (cm *CacheMap[T]) load(key Metric) (*T, bool) {
+	value, ok := cm.cache.Load(key)
+	if !ok {
+		return nil, false
+	}
+	return value.(*T), true
+}
+
+// store saves vector under key unless the key is already taken, and reports whether it did.
+func (cm *CacheMap[T]) store(key Metric, vector *T) bool {
+	_, loaded := cm.cache.LoadOrStore(key, vector)
+	return !loaded
+}
+
+// delete removes the vector stored under key.
+func (cm *CacheMap[T]) delete(key Metric) {
+	cm.cache.Delete(key)
+}
+
+// each calls fn for every stored vector until fn returns false.
+func (cm *CacheMap[T]) each(fn func(key Metric, vector *T) bool) {
+	cm.cache.Range(func(key, value any) bool {
+		return fn(key.(Metric), value.(*T))
+	})
+}
+
+// CollectorRegistry manages caches for different Prometheus metric types.
+// It stores CounterVec, HistogramVec, GaugeVec, and SummaryVec instances in thread-safe maps.
+type CollectorRegistry struct {
+	counters   CacheMap[prometheus.CounterVec]
+	histograms CacheMap[prometheus.HistogramVec]
+	gauges     CacheMap[prometheus.GaugeVec]
+	summary    CacheMap[prometheus.SummaryVec]
+	// definitions keeps the request every metric was registered with, for listing and export.
+	definitions CacheMap[MetricRequest]
+	events      *EventBroker
+	// buffer pre-aggregates counter, gauge and histogram pushes when buffer_config is enabled.
+	buffer *IngestBuffer
+	// quota counts metrics, series and samples against quota_config when it is enabled.
+	quota *quotaTracker
+	// keyQuotas counts what API keys write against quota_config.keys, with metric names
+	// prefixed by keyMetricPrefix to tell the registries of tenants apart.
+	keyQuotas       *KeyQuotas
+	keyMetricPrefix string
+
+	// absolute serializes set on counters, which reads a series before adding to it.
+	absolute sync.Mutex
+}
+
+func NewCollectorRegistry() *CollectorRegistry {
+	return &CollectorRegistry{events: NewEventBroker()}
+}
+
+// Events returns the broker every applied update is published to.
+func (mc *CollectorRegistry) Events() *EventBroker {
+	return mc.events
+}
+
+// EnableBuffer makes the registry pre-aggregate counter, gauge and histogram updates in an
+// IngestBuffer configured from buffer_config. It must be called before the registry receives
+// updates, and the buffer only applies them once it is started.
+//
+// Parameters:
+//   - cfg: Server configuration, of which buffer_config is used.
+//   - reg: Prometheus registry receiving the buffer metrics.
+//
+// Returns:
+//   - *IngestBuffer: The buffer, to be started and stopped by the caller.
+//   - An error if the buffer metrics cannot be registered.
+func (mc *CollectorRegistry) EnableBuffer(cfg config.TallyPortConfig, reg prometheus.Registerer) (*IngestBuffer, error) {
+	buffer, err := NewIngestBuffer(cfg, mc.events, reg)
+	if err != nil {
+		return nil, err
+	}
+	mc.buffer = buffer
+	return buffer, nil
+}
+
+// Update applies a pushed metric update: counters are incremented, gauges are set and
+// histograms observe the value. The metric must have been registered before, and the value
+// must pass CheckValue.
+func (mc *CollectorRegistry) Update(metric MetricRequest) error {
+	return mc.UpdateAs("", metric)
+}
+
+// UpdateAs is Update on behalf of the API key called keyID, which is charged for the update
+// when it has a quota. An empty keyID only charges the registry.
+func (mc *CollectorRegistry) UpdateAs(keyID string, metric MetricRequest) error {
+	metric, err := mc.CheckValue(metric)
+	if err != nil {
+		return err
+	}
+	validator := validation.NewValidator(metric)
+	metricKey := Metric{key: metric.Name}
+
+	if metric.Type == TypeCounter {
+		if counter, exists := mc.counters.load(metricKey); exists {
+			if err := validator.ValidateField("Labels", validation.IsEmpty).Errors(); err != nil {
+				raw, err := err.ToJSON()
+				if err != nil {
+					return err
+				}
+				return errors.New(string(raw))
+			}
+			if err := mc.admit(keyID, metric.Name, metric.Labels); err != nil {
+				return err
+			}
+			resolve := func() (prometheus.Metric, error) {
+				// A buffered series resolved while the metric is deleted must not bind to its vector.
+				if current, ok := mc.counters.load(metricKey); !ok || current != counter {
+					return nil, fmt.Errorf("counter %w: %v", ErrMetricNotFound, metricKey)
+				}
+				child, err := counter.GetMetricWithLabelValues(metric.Labels...)
+				if err != nil {
+					return nil, fmt.Errorf("invalid labels for counter %v: %v", metricKey, err)
+				}
+				return child, nil
+			}
+			if mc.buffer != nil {
+				return mc.buffer.record(metric, resolve)
+			}
+
+			child, err := resolve()
+			if err != nil {
+				return err
+			}
+			child.(prometheus.Counter).Inc()
+			mc.events.publish(metric, child)
+			return nil
+		}
+		return fmt.Errorf("counter %w: %v", ErrMetricNotFound, metricKey)
+	}
+
+	if metric.Type == TypeHistogram {
+		if histogram, exists := mc.histograms.load(metricKey); exists {
+			if err := validator.ValidateField("Labels", validation.IsEmpty).Errors(); err != nil {
+				raw, err := err.ToJSON()
+				if err != nil {
+					return err
+				}
+				return errors.New(string(raw))
+			}
+			if err := mc.admit(keyID, metric.Name, metric.Labels); err != nil {
+				return err
+			}
+			resolve := func() (prometheus.Metric, error) {
+				if current, ok := mc.histograms.load(metricKey); !ok || current != histogram {
+					return nil, fmt.Errorf("histogram %w: %v", ErrMetricNotFound, metricKey)
+				}
+				child, err := histogram.GetMetricWithLabelValues(metric.Labels...)
+				if err != nil {
+					return nil, fmt.Errorf("invalid labels for histogram %v: %v", metricKey, err)
+				}
+				return child.(prometheus.Metric), nil
+			}
+			if mc.buffer != nil {
+				return mc.buffer.record(metric, resolve)
+			}
+
+			child, err := resolve()
+			if err != nil {
+				return err
+			}
+			child.(prometheus.Observer).Observe(metric.Histogram.ObservedValue)
+			mc.events.publish(metric, child)
+			return nil
+		}
+		return fmt.Errorf("histogram %w: %v", ErrMetricNotFound, metricKey)
+	}
+
+	if metric.Type == TypeGauge {
+		if gauge, exists := mc.gauges.load(metricKey); exists {
+			if err := validator.ValidateField("Labels", validation.IsEmpty).Errors(); err != nil {
+				raw, err := err.ToJSON()
+				if err != nil {
+					return err
+				}
+				return errors.New(string(raw))
+			}
+			if err := mc.admit(keyID, metric.Name, metric.Labels); err != nil {
+				return err
+			}
+			resolve := func() (prometheus.Metric, error) {
+				if current, ok := mc.gauges.load(metricKey); !ok || current != gauge {
+					return nil, fmt.Errorf("gauge %w: %v", ErrMetricNotFound, metricKey)
+				}
+				child, err := gauge.GetMetricWithLabelValues(metric.Labels...)
+				if err != nil {
+					return nil, fmt.Errorf("invalid labels for gauge %v: %v", metricKey, err)
+				}
+				return child, nil
+			}
+			if mc.buffer != nil {
+				return mc.buffer.record(metric, resolve)
+			}
+
+			child, err := resolve()
+			if err != nil {
+				return err
+			}
+			child.(prometheus.Gauge).Set(metric.Gauge.Value)
+			mc.events.publish(metric, child)
+			return nil
+		}
+		return fmt.Errorf("gauge %w: %v", ErrMetricNotFound, metricKey)
+	}
+
+	if metric.Type == TypeSummary {
+		if summary, exists := mc.summary.load(metricKey); exists {
+			if err := validator.ValidateField("Labels", validation.IsEmpty).Errors(); err != nil {
+				raw, err := err.ToJSON()
+				if err != nil {
+					return err
+				}
+				return errors.New(string(raw))
+			}
+			if err := mc.admit(keyID, metric.Name, metric.Labels); err != nil {
+				return err
+			}
+			child, err := summary.GetMetricWithLabelValues(metric.Labels...)
+			if err != nil {
+				return fmt.Errorf("invalid labels for summary %v: %v", metricKey, err)
+			}
+			child.Observe(metric.Summary.ObservedValue)
+			mc.events.publish(metric, child.(prometheus.Metric))
+			return nil
+		}
+		return fmt.Errorf("summary %w: %v", ErrMetricNotFound, metricKey)
+	}
+
+	return fmt.Errorf("invalid metric type: %s", metric.Type)
+}
+
+// admit counts an update to the series of metric name with the label values values against the
+// quota, if one is enabled, and the quota of the key called keyID, if it has one. Values the
+// vector will reject, because their number does not match the labels of the metric or they are
+// not valid UTF-8, are left for it to reject, so they never count as a series or a sample.
+func (mc *CollectorRegistry) admit(keyID, name string, values []string) error {
+	charges := mc.sampleCharges(keyID, name, values)
+	if len(charges) == 0 {
+		return nil
+	}
+	return admitSample(values, charges...)
+}
+
+// CheckQuota reports whether UpdateAs would admit metric under the quotas right now, without
+// counting it. Pushes queued in async mode are checked before they are accepted, so their
+// refusals are answered rather than only logged by the worker, which counts them.
+//
+// Returns:
+//   - A *QuotaError if the update would currently be refused by a quota.
+func (mc *CollectorRegistry) CheckQuota(keyID string, metric MetricRequest) error {
+	charges := mc.sampleCharges(keyID, metric.Name, metric.Labels)
+	if len(charges) == 0 {
+		return nil
+	}
+	return checkSample(metric.Labels, charges...)
+}
+
+// sampleCharges returns the quotas an update to the series of metric name with the label values
+// values counts against, or none when the values are not valid for the metric.
+func (mc *CollectorRegistry) sampleCharges(keyID, name string, values []string) []quotaCharge {
+	charges := mc.quotaCharges(keyID, name)
+	if len(charges) == 0 {
+		return nil
+	}
+	definition, exists := mc.definitions.load(Metric{key: name})
+	if !exists || len(definition.Labels) != len(values) {
+		return nil
+	}
+	// The vectors refuse label values that are not valid UTF-8, so such updates must not count.
+	for _, value := range values {
+		if !utf8.ValidString(value) {
+			return nil
+		}
+	}
+	return charges
+}
+
+// admitLabels is admit for updates naming their label values by label.
+func (mc *CollectorRegistry) admitLabels(keyID, name string, labels prometheus.Labels) error {
+	charges := mc.quotaCharges(keyID, name)
+	if len(charges) == 0 {
+		return nil
+	}
+	definition, exists := mc.definitions.load(Metric{key: name})
+	if !exists || len(definition.Labels) != len(labels) {
+		return nil
+	}
+	values := make([]string, 0, len(labels))
+	for _, label := range definition.Labels {
+		value, ok := labels[label]
+		if !ok || !utf8.ValidString(value) {
+			return nil
+		}
+		values = append(values, value)
+	}
+	return admitSample(values, charges...)
+}
+
+// quotaCharges returns the quotas a write to metric name by the key called keyID counts
+// against: the quota of the registry first, then the quota of the key.
+func (mc *CollectorRegistry) quotaCharges(keyID, name string) []quotaCharge {
+	var charges []quotaCharge
+	if mc.quota != nil {
+		charges = append(charges, quotaCharge{tracker: mc.quota, metric: name})
+	}
+	if qt := mc.keyQuotas.tracker(keyID); qt != nil {
+		charges = append(charges, quotaCharge{tracker: qt, metric: mc.keyMetricPrefix + name})
+	}
+	return charges
+}
+
+// Register creates the vector described by metric and caches it under its name.
+// The returned collector still has to be registered with a Prometheus registry for export;
+// when that fails the metric should be dropped again with Remove.
+func (mc *CollectorRegistry) Register(metric MetricRequest) (prometheus.Collector, error) {
+	return mc.RegisterAs("", metric)
+}
+
+// RegisterAs is Register on behalf of the API key called keyID, which is charged for the
+// metric when it has a quota. An empty keyID only charges the registry.
+func (mc *CollectorRegistry) RegisterAs(keyID string, metric MetricRequest) (prometheus.Collector, error) {
+	if err := validateRange(metric); err != nil {
+		return nil, err
+	}
+	added, err := admitMetric(mc.quotaCharges(keyID, metric.Name)...)
+	if err != nil {
+		return nil, err
+	}
+	collector, err := mc.register(metric)
+	if err != nil {
+		for _, c := range added {
+			c.tracker.forgetMetric(c.metric)
+		}
+		return nil, err
+	}
+
+	// Only the fields used to create the metric are kept, not values pushed along with it.
+	// A definition of another type under the same name wins; the new metric is then rejected
+	// by the Prometheus registry and removed again.
+	definition := metric
+	definition.Gauge.Value = 0
+	definition.Histogram.ObservedValue = 0
+	definition.Summary.ObservedValue = 0
+	mc.definitions.store(Metric{key: metric.Name}, &definition)
+	return collector, nil
+}
+
+func (mc *CollectorRegistry) register(metric MetricRequest) (prometheus.Collector, error) {
+	metricKey := Metric{key: metric.Name}
+
+	if metric.Type == TypeCounter {
+		if _, exists := mc.counters.load(metricKey); exists {
+			return nil, fmt.Errorf("%w: cannot reinitialize metric %v", ErrMetricExists, metricKey)
+		}
+
+		counter := prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Name: metric.Name,
+				Help: metric.Description,
+			},
+			metric.Labels,
+		)
+		if !mc.counters.store(metricKey, counter) {
+			return nil, fmt.Errorf("%w: cannot reinitialize metric %v", ErrMetricExists, metricKey)
+		}
+		return counter, nil
+	}
+
+	if metric.Type == TypeHistogram {
+		if _, exists := mc.histograms.load(metricKey); exists {
+			return nil, fmt.Errorf("%w: cannot reinitialize metric %v", ErrMetricExists, metricKey)
+		}
+
+		histogram := prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Name:    metric.Name,
+				Help:    metric.Description,
+				Buckets: metric.Histogram.Buckets,
+			},
+			metric.Labels,
+		)
+		if !mc.histograms.store(metricKey, histogram) {
+			return nil, fmt.Errorf("%w: cannot reinitialize metric %v", ErrMetricExists, metricKey)
+		}
+		return histogram, nil
+	}
+
+	if metric.Type == TypeGauge {
+		if _, exists := mc.gauges.load(metricKey); exists {
+			return nil, fmt.Errorf("%w: cannot reinitialize metric %v", ErrMetricExists, metricKey)
+		}
+
+		gauge := prometheus.NewGaugeVec(
+			prometheus.GaugeOpts{
+				Name: metric.Name,
+				Help: metric.Description,
+			},
+			metric.Labels,
+		)
+		if !mc.gauges.store(metricKey, gauge) {
+			return nil, fmt.Errorf("%w: cannot reinitialize metric %v", ErrMetricExists, metricKey)
+		}
+		return gauge, nil
+	}
+
+	if metric.Type == TypeSummary {
+		if _, exists := mc.summary.load(metricKey); exists {
+			return nil, fmt.Errorf("%w: cannot reinitialize metric %v", ErrMetricExists, metricKey)
+		}
+
+		if metric.Summary.MaxAge <= 0 {
+			return nil, fmt.Errorf("invalid MaxAge for summary")
+		}
+
+		objectives := map[float64]float64{}
+		for kobj, vobj := range metric.Summary.Objectives {
+			v, err := strconv.ParseFloat(kobj, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid objectives data: %v", err)
+			}
+			objectives[v] = vobj
+		}
+
+		summary := prometheus.NewSummaryVec(
+			prometheus.SummaryOpts{
+				Name:       metric.Name,
+				Help:       metric.Description,
+				Objectives: objectives,
+				MaxAge:     time.Duration(metric.Summary.MaxAge),
+			},
+			metric.Labels,
+		)
+		if !mc.summary.store(metricKey, summary) {
+			return nil, fmt.Errorf("%w: cannot reinitialize metric %v", ErrMetricExists, metricKey)
+		}
+		return summary, nil
+	}
+
+	return nil, fmt.Errorf("invalid metric type: %s", metric.Type)
+}
+
+// TypeOf returns the type a metric name is registered with, if any.
+func (mc *CollectorRegistry) TypeOf(name string) (string, bool) {
+	metricKey := Metric{key: name}
+
+	if _, exists := mc.counters.load(metricKey); exists {
+		return TypeCounter, true
+	}
+	if _, exists := mc.gauges.load(metricKey); exists {
+		return TypeGauge, true
+	}
+	if _, exists := mc.histograms.load(metricKey); exists {
+		return TypeHistogram, true
+	}
+	if _, exists := mc.summary.load(metricKey); exists {
+		return TypeSummary, true
+	}
+
+	return "", false
+}
+
+// Set moves a counter or gauge series to an absolute value, as reported by remote write senders.
+// Counters only move forward: the difference to the current value is added, and a value below
+// the current one is taken as a reset at the source and added in full. Counter values must be
+// finite and not negative, and gauge values pass CheckValue.
+func (mc *CollectorRegistry) Set(metricType, name string, labels prometheus.Labels, value float64) error {
+	return mc.SetAs("", metricType, name, labels, value)
+}
+
+// SetAs is Set on behalf of the API key called keyID, which is charged for the sample when it
+// has a quota. An empty keyID only charges the registry.
+func (mc *CollectorRegistry) SetAs(keyID, metricType, name string, labels prometheus.Labels, value float64) error {
+	metricKey := Metric{key: name}
+	event := MetricRequest{Type: metricType, Name: name}
+
+	if metricType == TypeCounter {
+		counter, exists := mc.counters.load(metricKey)
+		if !exists {
+			return fmt.Errorf("counter %w: %v", ErrMetricNotFound, metricKey)
+		}
+		zero := 0.0
+		if err := checkValue(struct{ Value float64 }{value}, "Value", ValueRange{Min: &zero}); err != nil {
+			return fmt.Errorf("invalid value for counter %v: %v", metricKey, err)
+		}
+		if err := mc.admitLabels(keyID, name, labels); err != nil {
+			return err
+		}
+		child, err := counter.GetMetricWith(labels)
+		if err != nil {
+			return fmt.Errorf("invalid labels for counter %v: %v", metricKey, err)
+		}
+
+		mc.absolute.Lock()
+		var current dto.Metric
+		if err := child.Write(&current); err != nil {
+			mc.absolute.Unlock()
+			return fmt.Errorf("failed to read counter %v: %v", metricKey, err)
+		}
+		delta := value - current.GetCounter().GetValue()
+		if delta < 0 {
+			delta = value
+		}
+		if delta > 0 {
+			child.Add(delta)
+		}
+		mc.absolute.Unlock()
+
+		if delta > 0 {
+			mc.events.publish(event, child)
+		}
+		return nil
+	}
+
+	if metricType == TypeGauge {
+		gauge, exists := mc.gauges.load(metricKey)
+		if !exists {
+			return fmt.Errorf("gauge %w: %v", ErrMetricNotFound, metricKey)
+		}
+		event.Gauge.Value = value
+		checked, err := mc.CheckValue(event)
+		if err != nil {
+			return fmt.Errorf("invalid value for gauge %v: %v", metricKey, err)
+		}
+		value = checked.Gauge.Value
+		if err := mc.admitLabels(keyID, name, labels); err != nil {
+			return err
+		}
+		child, err := gauge.GetMetricWith(labels)
+		if err != nil {
+			return fmt.Errorf("invalid labels for gauge %v: %v", metricKey, err)
+		}
+		child.Set(value)
+		mc.events.publish(event, child)
+		return nil
+	}
+
+	return fmt.Errorf("cannot set absolute values on metric type: %s", metricType)
+}
+
+// Definition returns the request a metric was registered with.
+func (mc *CollectorRegistry) Definition(name string) (MetricRequest, bool) {
+	definition, exists := mc.definitions.load(Metric{key: name})
+	if !exists {
+		return MetricRequest{}, false
+	}
+	return *definition, true
+}
+
+// Definitions returns the requests of every registered metric, sorted by name.
+func (mc *CollectorRegistry) Definitions() []MetricRequest {
+	var definitions []MetricRequest
+	mc.definitions.each(func(_ Metric, definition *MetricRequest) bool {
+		definitions = append(definitions, *definition)
+		return true
+	})
+	sort.Slice(definitions, func(i, j int) bool { return definitions[i].Name < definitions[j].Name })
+	return definitions
+}
+
+// Collector returns the vector registered under name, e.g. to unregister it from export.
+func (mc *CollectorRegistry) Collector(name string) (prometheus.Collector, bool) {
+	metricKey := Metric{key: name}
+
+	if counter, exists := mc.counters.load(metricKey); exists {
+		return counter, true
+	}
+	if gauge, exists := mc.gauges.load(metricKey); exists {
+		return gauge, true
+	}
+	if histogram, exists := mc.histograms.load(metricKey); exists {
+		return histogram, true
+	}
+	if summary, exists := mc.summary.load(metricKey); exists {
+		return summary, true
+	}
+
+	return nil, false
+}
+
+// Remove drops a metric from its type cache, e.g. when it could not be registered for export.
+func (mc *CollectorRegistry) Remove(metricType, name string) {
+	metricKey := Metric{key: name}
+	if definition, exists := mc.definitions.load(metricKey); exists && definition.Type == metricType {
+		mc.definitions.delete(metricKey)
+		if mc.quota != nil {
+			mc.quota.forgetMetric(name)
+		}
+		if mc.keyQuotas != nil {
+			mc.keyQuotas.forgetMetric(mc.keyMetricPrefix + name)
+		}
+	}
+
+	switch metricType {
+	case TypeCounter:
+		mc.counters.delete(metricKey)
+	case TypeGauge:
+		mc.gauges.delete(metricKey)
+	case TypeHistogram:
+		mc.histograms.delete(metricKey)
+	case TypeSummary:
+		mc.summary.delete(metricKey)
+	}
+	// The vector is gone first, so series resolved from now on cannot bind to it again.
+	if mc.buffer != nil {
+		mc.buffer.forget(name)
+	}
+}
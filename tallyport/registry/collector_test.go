@@ -0,0 +1,52 @@
+package registry
+
+import (
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// BenchmarkUpdateParallel measures push throughput when many clients update the same few
+// series of a metric at once, which is where a registry-wide lock would serialize them.
+func BenchmarkUpdateParallel(b *testing.B) {
+	const series = 8
+
+	for _, metricType := range []string{TypeCounter, TypeGauge, TypeHistogram, TypeSummary} {
+		b.Run(metricType, func(b *testing.B) {
+			mc := NewCollectorRegistry()
+			definition := MetricRequest{
+				Type:        metricType,
+				Name:        "bench_" + metricType,
+				Description: "Benchmark " + metricType,
+				Labels:      []string{"device"},
+			}
+			definition.Histogram.Buckets = []float64{0.1, 1, 10}
+			definition.Summary.Objectives = map[string]float64{"0.5": 0.05, "0.99": 0.001}
+			definition.Summary.MaxAge = int64(10 * time.Minute)
+			if _, err := mc.Register(definition); err != nil {
+				b.Fatalf("register %s: %v", metricType, err)
+			}
+
+			var worker atomic.Int64
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				push := MetricRequest{
+					Type:   metricType,
+					Name:   definition.Name,
+					Labels: []string{"device-" + strconv.FormatInt(worker.Add(1)%series, 10)},
+				}
+				push.Gauge.Value = 42
+				push.Histogram.ObservedValue = 0.5
+				push.Summary.ObservedValue = 0.5
+				for pb.Next() {
+					if err := mc.Update(push); err != nil {
+						b.Errorf("update %s: %v", metricType, err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// MetricEvent describes a single metric update as published on the event feed.
+// Value holds the counter total or gauge value after the update, and the observed
+// value for histograms. Count and Sum are set for histograms and summaries.
+type MetricEvent struct {
+	Type      string            `json:"type"`
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Value     float64           `json:"value"`
+	Count     uint64            `json:"count,omitempty"`
+	Sum       float64           `json:"sum,omitempty"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// Subscriber is a single feed consumer with its own buffered channel.
+// Prefixes restricts the events it receives by metric name; an empty list receives everything.
+type Subscriber struct {
+	prefixes []string
+	events   chan MetricEvent
+}
+
+// Events returns the channel the subscriber's events are delivered on.
+func (es *Subscriber) Events() <-chan MetricEvent {
+	return es.events
+}
+
+func (es *Subscriber) wants(name string) bool {
+	if len(es.prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range es.prefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// EventBroker fans metric updates out to the subscribers of the event feed.
+// Publishing never blocks: events for a subscriber whose buffer is full are dropped.
+type EventBroker struct {
+	sync.RWMutex
+	subscribers map[*Subscriber]struct{}
+	// active mirrors len(subscribers) so publish can return without locking while nobody listens.
+	active atomic.Int32
+}
+
+func NewEventBroker() *EventBroker {
+	return &EventBroker{subscribers: make(map[*Subscriber]struct{})}
+}
+
+// Subscribe adds a subscriber receiving the updates of metrics matching one of prefixes,
+// buffering up to bufferSize events. It must be removed with Unsubscribe when done.
+func (eb *EventBroker) Subscribe(prefixes []string, bufferSize int) *Subscriber {
+	subscriber := &Subscriber{
+		prefixes: prefixes,
+		events:   make(chan MetricEvent, bufferSize),
+	}
+	eb.Lock()
+	eb.subscribers[subscriber] = struct{}{}
+	eb.active.Store(int32(len(eb.subscribers)))
+	eb.Unlock()
+	return subscriber
+}
+
+// Unsubscribe removes a subscriber added with Subscribe.
+func (eb *EventBroker) Unsubscribe(subscriber *Subscriber) {
+	eb.Lock()
+	delete(eb.subscribers, subscriber)
+	eb.active.Store(int32(len(eb.subscribers)))
+	eb.Unlock()
+}
+
+// publish reads the current state of the updated series and hands it to every interested subscriber.
+// The series is only read when at least one subscriber wants the metric, so pushes stay cheap
+// while nobody is listening.
+func (eb *EventBroker) publish(metric MetricRequest, series prometheus.Metric) {
+	if eb.active.Load() == 0 {
+		return
+	}
+
+	eb.RLock()
+	defer eb.RUnlock()
+
+	var event *MetricEvent
+	for subscriber := range eb.subscribers {
+		if !subscriber.wants(metric.Name) {
+			continue
+		}
+		if event == nil {
+			event = newMetricEvent(metric, series)
+			if event == nil {
+				return
+			}
+		}
+		select {
+		case subscriber.events <- *event:
+		default:
+		}
+	}
+}
+
+func newMetricEvent(metric MetricRequest, series prometheus.Metric) *MetricEvent {
+	var out dto.Metric
+	if err := series.Write(&out); err != nil {
+		return nil
+	}
+
+	event := &MetricEvent{
+		Type:      metric.Type,
+		Name:      metric.Name,
+		Labels:    make(map[string]string, len(out.GetLabel())),
+		Timestamp: time.Now(),
+	}
+	for _, pair := range out.GetLabel() {
+		event.Labels[pair.GetName()] = pair.GetValue()
+	}
+
+	switch metric.Type {
+	case TypeCounter:
+		event.Value = out.GetCounter().GetValue()
+	case TypeGauge:
+		event.Value = out.GetGauge().GetValue()
+	case TypeHistogram:
+		event.Value = metric.Histogram.ObservedValue
+		event.Count = out.GetHistogram().GetSampleCount()
+		event.Sum = out.GetHistogram().GetSampleSum()
+	case TypeSummary:
+		event.Count = out.GetSummary().GetSampleCount()
+		event.Sum = out.GetSummary().GetSampleSum()
+	}
+	return event
+}
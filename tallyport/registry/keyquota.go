@@ -0,0 +1,143 @@
+package registry
+
+import (
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// KeyQuotas holds the quotas of single API keys, shared by every registry they are enabled on,
+// so a key has one budget whichever tenant it writes to. A key is charged for the metrics it
+// creates, the series it writes to, including series of metrics created by other clients, and
+// its samples per minute. Keys without limits are not counted.
+type KeyQuotas struct {
+	mu       sync.RWMutex
+	trackers map[string]*quotaTracker
+
+	limitDesc, usageDesc, rejectedDesc *prometheus.Desc
+}
+
+// NewKeyQuotas creates the quotas of API keys. It has to be registered with a Prometheus
+// registry to export their usage, and enabled on registries with EnableKeyQuotas.
+//
+// Parameters:
+//   - limits: Quota of each key by key id.
+//
+// Returns:
+//   - *KeyQuotas: The key quotas.
+func NewKeyQuotas(limits map[string]Quota) *KeyQuotas {
+	kq := &KeyQuotas{
+		trackers: make(map[string]*quotaTracker, len(limits)),
+		limitDesc: prometheus.NewDesc("__tallyport___key_quota_limit",
+			"Limit of each quota of an API key; absent for unlimited quotas", []string{"key_id", "quota"}, nil),
+		usageDesc: prometheus.NewDesc("__tallyport___key_quota_usage",
+			"Current usage of each quota of an API key; samples_per_minute counts the current minute", []string{"key_id", "quota"}, nil),
+		rejectedDesc: prometheus.NewDesc("__tallyport___key_quota_rejections_total",
+			"Updates of an API key refused because they would exceed one of its quotas", []string{"key_id", "quota"}, nil),
+	}
+	kq.SetLimits(limits)
+	return kq
+}
+
+// SetLimits replaces the quotas of the keys. Keys that keep a quota keep their usage, keys
+// that get one start counting from zero, and keys that lose theirs are no longer counted.
+func (kq *KeyQuotas) SetLimits(limits map[string]Quota) {
+	kq.mu.Lock()
+	defer kq.mu.Unlock()
+
+	for id := range kq.trackers {
+		if _, ok := limits[id]; !ok {
+			delete(kq.trackers, id)
+		}
+	}
+	for id, quota := range limits {
+		if qt, ok := kq.trackers[id]; ok {
+			qt.mu.Lock()
+			qt.quota = quota
+			qt.mu.Unlock()
+			continue
+		}
+		qt := newQuotaTracker(quota)
+		qt.anyMetric, qt.key = true, id
+		kq.trackers[id] = qt
+	}
+}
+
+// Usage reports every quota of the key called id and how much of it is used.
+//
+// Returns:
+//   - []QuotaUsage: Usage of metrics, series and samples_per_minute, in that order.
+//   - bool: False when the key has no quota.
+func (kq *KeyQuotas) Usage(id string) ([]QuotaUsage, bool) {
+	qt := kq.tracker(id)
+	if qt == nil {
+		return nil, false
+	}
+	return qt.usage(time.Now()), true
+}
+
+// tracker returns the tracker of the key called id, or nil when it has no quota.
+func (kq *KeyQuotas) tracker(id string) *quotaTracker {
+	if kq == nil || id == "" {
+		return nil
+	}
+	kq.mu.RLock()
+	defer kq.mu.RUnlock()
+	return kq.trackers[id]
+}
+
+// forgetMetric stops counting a deleted metric, and its series, for every key.
+func (kq *KeyQuotas) forgetMetric(name string) {
+	kq.mu.RLock()
+	defer kq.mu.RUnlock()
+	for _, qt := range kq.trackers {
+		qt.forgetMetric(name)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (kq *KeyQuotas) Describe(ch chan<- *prometheus.Desc) {
+	ch <- kq.limitDesc
+	ch <- kq.usageDesc
+	ch <- kq.rejectedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (kq *KeyQuotas) Collect(ch chan<- prometheus.Metric) {
+	kq.mu.RLock()
+	trackers := maps.Clone(kq.trackers)
+	kq.mu.RUnlock()
+
+	now := time.Now()
+	for _, id := range slices.Sorted(maps.Keys(trackers)) {
+		qt := trackers[id]
+		usage := qt.usage(now)
+		qt.mu.Lock()
+		rejected := maps.Clone(qt.rejected)
+		qt.mu.Unlock()
+
+		for _, u := range usage {
+			if u.Limit > 0 {
+				ch <- prometheus.MustNewConstMetric(kq.limitDesc, prometheus.GaugeValue, float64(u.Limit), id, u.Quota)
+			}
+			ch <- prometheus.MustNewConstMetric(kq.usageDesc, prometheus.GaugeValue, float64(u.Used), id, u.Quota)
+			ch <- prometheus.MustNewConstMetric(kq.rejectedDesc, prometheus.CounterValue, float64(rejected[u.Quota]), id, u.Quota)
+		}
+	}
+}
+
+// EnableKeyQuotas charges the updates applied with UpdateAs, RegisterAs and SetAs to the
+// quota of their key, on top of the quota of the registry. It must be called before the
+// registry receives metrics.
+//
+// Parameters:
+//   - kq: Key quotas shared by the registries of every tenant.
+//   - tenant: Name of the tenant of the registry, so metrics of the same name in two tenants
+//     are counted apart.
+func (mc *CollectorRegistry) EnableKeyQuotas(kq *KeyQuotas, tenant string) {
+	mc.keyQuotas = kq
+	mc.keyMetricPrefix = tenant + "\xff"
+}
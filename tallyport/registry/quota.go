@@ -0,0 +1,319 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Quotas a CollectorRegistry can enforce, as named in QuotaError and the quota metrics.
+const (
+	QuotaMetrics          = "metrics"
+	QuotaSeries           = "series"
+	QuotaSamplesPerMinute = "samples_per_minute"
+)
+
+// quotaNames lists every quota in the order they are reported.
+var quotaNames = []string{QuotaMetrics, QuotaSeries, QuotaSamplesPerMinute}
+
+// Quota caps how much a CollectorRegistry holds and how fast it is written to. Zero fields do
+// not limit anything.
+type Quota struct {
+	MaxMetrics          int // Registered metrics
+	MaxSeries           int // Series across all metrics, counted from their first update until the metric is deleted
+	MaxSamplesPerMinute int // Updates applied per calendar minute, one per push, observation or remote written sample
+}
+
+// limit returns the limit of the quota called name.
+func (q Quota) limit(name string) int {
+	switch name {
+	case QuotaMetrics:
+		return q.MaxMetrics
+	case QuotaSeries:
+		return q.MaxSeries
+	case QuotaSamplesPerMinute:
+		return q.MaxSamplesPerMinute
+	}
+	return 0
+}
+
+// QuotaError is returned for updates that would exceed a quota of the registry or of an API key.
+type QuotaError struct {
+	Quota      string        // Name of the exceeded quota
+	Limit      int           // Its limit
+	RetryAfter time.Duration // Time until the quota frees up by itself; zero for metrics and series
+	Key        string        // API key whose quota was exceeded; empty for the quota of the registry
+}
+
+func (e *QuotaError) Error() string {
+	if e.Key != "" {
+		return fmt.Sprintf("quota of %d %s of key %s exceeded", e.Limit, strings.ReplaceAll(e.Quota, "_", " "), e.Key)
+	}
+	return fmt.Sprintf("quota of %d %s exceeded", e.Limit, strings.ReplaceAll(e.Quota, "_", " "))
+}
+
+// QuotaUsage reports a quota together with how much of it is used.
+type QuotaUsage struct {
+	Quota string    // Name of the quota
+	Limit int       // Limit of the quota; zero when unlimited
+	Used  int       // Current usage
+	Reset time.Time // When the usage of samples_per_minute starts again from zero; zero for the others
+}
+
+// quotaTracker counts the metrics, series and samples of a registry, or of an API key, against
+// its Quota.
+type quotaTracker struct {
+	mu       sync.Mutex
+	quota    Quota
+	metrics  map[string]struct{}            // Metrics counted against max_metrics
+	series   map[string]map[string]struct{} // Series keys by metric name
+	count    int                            // Series across all metrics
+	window   time.Time                      // Minute the samples are counted in
+	samples  int
+	rejected map[string]int
+	// anyMetric counts the series of metrics the tracker did not admit itself, as API keys
+	// write to metrics created by other clients.
+	anyMetric bool
+	key       string // API key the tracker counts for, if any
+
+	limitDesc, usageDesc, rejectedDesc *prometheus.Desc
+}
+
+// newQuotaTracker creates a tracker enforcing quota.
+func newQuotaTracker(quota Quota) *quotaTracker {
+	return &quotaTracker{
+		quota:    quota,
+		metrics:  make(map[string]struct{}),
+		series:   make(map[string]map[string]struct{}),
+		rejected: make(map[string]int),
+	}
+}
+
+// EnableQuota makes the registry count its metrics, series and samples and refuse updates
+// that would exceed quota with a *QuotaError. It must be called before the registry receives
+// metrics; SetQuota changes the limits afterwards.
+//
+// Parameters:
+//   - quota: Limits to enforce.
+//   - reg: Prometheus registry receiving the quota metrics.
+//
+// Returns:
+//   - An error if the quota metrics cannot be registered.
+func (mc *CollectorRegistry) EnableQuota(quota Quota, reg prometheus.Registerer) error {
+	qt := newQuotaTracker(quota)
+	qt.limitDesc = prometheus.NewDesc("__tallyport___quota_limit",
+		"Limit of each quota; absent for unlimited quotas", []string{"quota"}, nil)
+	qt.usageDesc = prometheus.NewDesc("__tallyport___quota_usage",
+		"Current usage of each quota; samples_per_minute counts the current minute", []string{"quota"}, nil)
+	qt.rejectedDesc = prometheus.NewDesc("__tallyport___quota_rejections_total",
+		"Updates refused because they would exceed a quota", []string{"quota"}, nil)
+	if err := reg.Register(qt); err != nil {
+		return fmt.Errorf("failed to register quota metric: %w", err)
+	}
+	mc.quota = qt
+	return nil
+}
+
+// SetQuota replaces the limits enforced by a registry with an enabled quota. Usage above a
+// lowered limit is kept, but nothing more is admitted until it drops below.
+func (mc *CollectorRegistry) SetQuota(quota Quota) {
+	if mc.quota == nil {
+		return
+	}
+	mc.quota.mu.Lock()
+	mc.quota.quota = quota
+	mc.quota.mu.Unlock()
+}
+
+// QuotaUsage reports every quota of the registry and how much of it is used.
+//
+// Returns:
+//   - []QuotaUsage: Usage of metrics, series and samples_per_minute, in that order.
+//   - bool: False when no quota is enabled.
+func (mc *CollectorRegistry) QuotaUsage() ([]QuotaUsage, bool) {
+	if mc.quota == nil {
+		return nil, false
+	}
+	return mc.quota.usage(time.Now()), true
+}
+
+// usage reports every quota as of now.
+func (qt *quotaTracker) usage(now time.Time) []QuotaUsage {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	qt.roll(now)
+
+	usage := make([]QuotaUsage, 0, len(quotaNames))
+	for _, name := range quotaNames {
+		u := QuotaUsage{Quota: name, Limit: qt.quota.limit(name)}
+		switch name {
+		case QuotaMetrics:
+			u.Used = len(qt.metrics)
+		case QuotaSeries:
+			u.Used = qt.count
+		case QuotaSamplesPerMinute:
+			u.Used = qt.samples
+			u.Reset = qt.window.Add(time.Minute)
+		}
+		usage = append(usage, u)
+	}
+	return usage
+}
+
+// roll starts counting samples from zero when now is in a later minute than the window.
+func (qt *quotaTracker) roll(now time.Time) {
+	if window := now.Truncate(time.Minute); window.After(qt.window) {
+		qt.window = window
+		qt.samples = 0
+	}
+}
+
+// refuse counts a rejection and returns the error for it.
+func (qt *quotaTracker) refuse(name string, now time.Time) error {
+	qt.rejected[name]++
+	err := &QuotaError{Quota: name, Limit: qt.quota.limit(name), Key: qt.key}
+	if name == QuotaSamplesPerMinute {
+		err.RetryAfter = qt.window.Add(time.Minute).Sub(now)
+	}
+	return err
+}
+
+// quotaCharge names the tracker an admission is counted against, and the metric under the
+// name that tracker knows it by.
+type quotaCharge struct {
+	tracker *quotaTracker
+	metric  string
+}
+
+// admitMetric counts a metric about to be registered against every charge, or against none
+// of them when one refuses it.
+//
+// Returns:
+//   - []quotaCharge: The charges the metric was new to, which have to forget it again if its
+//     registration fails.
+//   - A *QuotaError if the metric would exceed a max_metrics.
+func admitMetric(charges ...quotaCharge) ([]quotaCharge, error) {
+	now := time.Now()
+	for _, c := range charges {
+		c.tracker.mu.Lock()
+		defer c.tracker.mu.Unlock()
+	}
+
+	var added []quotaCharge
+	for _, c := range charges {
+		qt := c.tracker
+		if _, exists := qt.metrics[c.metric]; exists {
+			continue
+		}
+		if limit := qt.quota.MaxMetrics; limit > 0 && len(qt.metrics) >= limit {
+			return nil, qt.refuse(QuotaMetrics, now)
+		}
+		added = append(added, c)
+	}
+	for _, c := range added {
+		c.tracker.metrics[c.metric] = struct{}{}
+		if _, exists := c.tracker.series[c.metric]; !exists {
+			c.tracker.series[c.metric] = make(map[string]struct{})
+		}
+	}
+	return added, nil
+}
+
+// forgetMetric stops counting a metric and its series.
+func (qt *quotaTracker) forgetMetric(name string) {
+	qt.mu.Lock()
+	defer qt.mu.Unlock()
+	qt.count -= len(qt.series[name])
+	delete(qt.series, name)
+	delete(qt.metrics, name)
+}
+
+// admitSample counts a sample about to be written to the series with the label values values
+// against every charge, and the series itself where it is new. Nothing is counted when one of
+// them refuses it. Trackers are locked in the order given, so callers always pass the registry
+// tracker before the tracker of a key.
+//
+// Returns:
+//   - A *QuotaError if the series would exceed a max_series or the sample a max_samples_per_minute.
+func admitSample(values []string, charges ...quotaCharge) error {
+	return chargeSample(values, true, charges...)
+}
+
+// checkSample is admitSample without counting the sample when it is admitted; refusals are
+// still counted.
+func checkSample(values []string, charges ...quotaCharge) error {
+	return chargeSample(values, false, charges...)
+}
+
+// chargeSample checks a sample against every charge and counts it when commit is set.
+func chargeSample(values []string, commit bool, charges ...quotaCharge) error {
+	now := time.Now()
+	for _, c := range charges {
+		c.tracker.mu.Lock()
+		defer c.tracker.mu.Unlock()
+	}
+
+	key := strings.Join(values, "\xff")
+	newSeries := make([]bool, len(charges))
+	for i, c := range charges {
+		qt := c.tracker
+		qt.roll(now)
+
+		series, tracked := qt.series[c.metric]
+		_, known := series[key]
+		if (tracked || qt.anyMetric) && !known {
+			if limit := qt.quota.MaxSeries; limit > 0 && qt.count >= limit {
+				return qt.refuse(QuotaSeries, now)
+			}
+			newSeries[i] = true
+		}
+		if limit := qt.quota.MaxSamplesPerMinute; limit > 0 && qt.samples >= limit {
+			return qt.refuse(QuotaSamplesPerMinute, now)
+		}
+	}
+	if !commit {
+		return nil
+	}
+
+	for i, c := range charges {
+		qt := c.tracker
+		if newSeries[i] {
+			if _, tracked := qt.series[c.metric]; !tracked {
+				qt.series[c.metric] = make(map[string]struct{})
+			}
+			qt.series[c.metric][key] = struct{}{}
+			qt.count++
+		}
+		qt.samples++
+	}
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (qt *quotaTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- qt.limitDesc
+	ch <- qt.usageDesc
+	ch <- qt.rejectedDesc
+}
+
+// Collect implements prometheus.Collector.
+func (qt *quotaTracker) Collect(ch chan<- prometheus.Metric) {
+	usage := qt.usage(time.Now())
+	qt.mu.Lock()
+	rejected := make(map[string]int, len(qt.rejected))
+	for name, count := range qt.rejected {
+		rejected[name] = count
+	}
+	qt.mu.Unlock()
+
+	for _, u := range usage {
+		if u.Limit > 0 {
+			ch <- prometheus.MustNewConstMetric(qt.limitDesc, prometheus.GaugeValue, float64(u.Limit), u.Quota)
+		}
+		ch <- prometheus.MustNewConstMetric(qt.usageDesc, prometheus.GaugeValue, float64(u.Used), u.Quota)
+		ch <- prometheus.MustNewConstMetric(qt.rejectedDesc, prometheus.CounterValue, float64(rejected[u.Quota]), u.Quota)
+	}
+}
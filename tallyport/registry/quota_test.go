@@ -0,0 +1,241 @@
+package registry
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// quotaStep registers a metric when register is set, and pushes to it otherwise.
+type quotaStep struct {
+	register bool
+	key      string
+	metric   MetricRequest
+	want     string // Name of the quota expected to refuse the step, empty if it is admitted
+}
+
+// counter returns a counter request for the metric called name with the label values labels.
+func counter(name string, labels ...string) MetricRequest {
+	return MetricRequest{Type: TypeCounter, Name: name, Labels: labels}
+}
+
+func newQuotaRegistry(t *testing.T, quota Quota) *CollectorRegistry {
+	t.Helper()
+	mc := NewCollectorRegistry()
+	if err := mc.EnableQuota(quota, prometheus.NewRegistry()); err != nil {
+		t.Fatalf("EnableQuota: %v", err)
+	}
+	return mc
+}
+
+// runQuotaSteps applies steps to mc, checking which of them are refused by a quota.
+func runQuotaSteps(t *testing.T, mc *CollectorRegistry, steps []quotaStep) {
+	t.Helper()
+	for i, step := range steps {
+		var err error
+		if step.register {
+			_, err = mc.RegisterAs(step.key, step.metric)
+		} else {
+			err = mc.UpdateAs(step.key, step.metric)
+		}
+		var quotaErr *QuotaError
+		switch {
+		case step.want == "" && errors.As(err, &quotaErr):
+			t.Fatalf("step %d: refused by quota: %v", i, err)
+		case step.want != "" && !errors.As(err, &quotaErr):
+			t.Fatalf("step %d: error = %v, want quota %s to refuse it", i, err, step.want)
+		case step.want != "" && quotaErr.Quota != step.want:
+			t.Fatalf("step %d: refused by quota %s, want %s", i, quotaErr.Quota, step.want)
+		}
+	}
+}
+
+// quotaUsed returns the usage of the quota called name.
+func quotaUsed(t *testing.T, usage []QuotaUsage, name string) int {
+	t.Helper()
+	for _, u := range usage {
+		if u.Quota == name {
+			return u.Used
+		}
+	}
+	t.Fatalf("no usage reported for quota %s", name)
+	return 0
+}
+
+func TestQuota(t *testing.T) {
+	requests := counter("app_requests_total", "route")
+	tests := []struct {
+		name   string
+		quota  Quota
+		steps  []quotaStep
+		series int // Series counted at the end
+	}{
+		{
+			name:  "max metrics",
+			quota: Quota{MaxMetrics: 1},
+			steps: []quotaStep{
+				{register: true, metric: requests},
+				{register: true, metric: counter("app_errors_total"), want: QuotaMetrics},
+				{register: true, metric: requests}, // Already counted, refused by the registry instead
+			},
+		},
+		{
+			name:  "max series",
+			quota: Quota{MaxSeries: 2},
+			steps: []quotaStep{
+				{register: true, metric: requests},
+				{metric: counter("app_requests_total", "/home")},
+				{metric: counter("app_requests_total", "/cart")},
+				{metric: counter("app_requests_total", "/home")},
+				{metric: counter("app_requests_total", "/checkout"), want: QuotaSeries},
+			},
+			series: 2,
+		},
+		{
+			name:  "max samples per minute",
+			quota: Quota{MaxSamplesPerMinute: 2},
+			steps: []quotaStep{
+				{register: true, metric: requests},
+				{metric: counter("app_requests_total", "/home")},
+				{metric: counter("app_requests_total", "/home")},
+				{metric: counter("app_requests_total", "/home"), want: QuotaSamplesPerMinute},
+			},
+			series: 1,
+		},
+		{
+			name:  "invalid label values are not charged",
+			quota: Quota{MaxSeries: 1, MaxSamplesPerMinute: 1},
+			steps: []quotaStep{
+				{register: true, metric: requests},
+				{metric: counter("app_requests_total", "\xff")},
+				{metric: counter("app_requests_total", "/home", "extra")},
+				{metric: counter("app_requests_total")},
+				{metric: counter("app_requests_total", "/home")},
+			},
+			series: 1,
+		},
+		{
+			name:  "unknown metrics are not charged",
+			quota: Quota{MaxSamplesPerMinute: 1},
+			steps: []quotaStep{
+				{register: true, metric: requests},
+				{metric: counter("app_missing_total", "/home")},
+				{metric: counter("app_requests_total", "/home")},
+			},
+			series: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mc := newQuotaRegistry(t, tt.quota)
+			runQuotaSteps(t, mc, tt.steps)
+
+			usage, ok := mc.QuotaUsage()
+			if !ok {
+				t.Fatal("QuotaUsage reports no quota")
+			}
+			if got := quotaUsed(t, usage, QuotaSeries); got != tt.series {
+				t.Errorf("series used = %d, want %d", got, tt.series)
+			}
+		})
+	}
+}
+
+func TestKeyQuotasAreSharedAcrossTenants(t *testing.T) {
+	kq := NewKeyQuotas(map[string]Quota{"app": {MaxMetrics: 2, MaxSeries: 2}})
+	acme, globex := NewCollectorRegistry(), NewCollectorRegistry()
+	acme.EnableKeyQuotas(kq, "acme")
+	globex.EnableKeyQuotas(kq, "globex")
+
+	requests := counter("app_requests_total", "route")
+	runQuotaSteps(t, acme, []quotaStep{
+		{register: true, key: "app", metric: requests},
+		{key: "app", metric: counter("app_requests_total", "/home")},
+	})
+	runQuotaSteps(t, globex, []quotaStep{
+		// The metric of another tenant under the same name is another metric, and so are its series.
+		{register: true, key: "app", metric: requests},
+		{key: "app", metric: counter("app_requests_total", "/home")},
+		{register: true, key: "app", metric: counter("app_errors_total"), want: QuotaMetrics},
+		{key: "app", metric: counter("app_requests_total", "/cart"), want: QuotaSeries},
+		// Keys without a quota and updates without a key are not limited.
+		{key: "web", metric: counter("app_requests_total", "/cart")},
+		{metric: counter("app_requests_total", "/checkout")},
+	})
+
+	err := globex.UpdateAs("app", counter("app_requests_total", "/cart"))
+	var quotaErr *QuotaError
+	if !errors.As(err, &quotaErr) || quotaErr.Key != "app" {
+		t.Fatalf("error = %v, want a quota error of key app", err)
+	}
+
+	// Series of metrics created by other clients count against the key as well.
+	if _, err := acme.Register(counter("app_sessions_total", "platform")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+	acme.Remove(TypeCounter, "app_requests_total")
+	runQuotaSteps(t, acme, []quotaStep{
+		{key: "app", metric: counter("app_sessions_total", "ios")},
+		{key: "app", metric: counter("app_sessions_total", "android"), want: QuotaSeries},
+	})
+
+	usage, ok := kq.Usage("app")
+	if !ok {
+		t.Fatal("Usage reports no quota for key app")
+	}
+	if got := quotaUsed(t, usage, QuotaSeries); got != 2 {
+		t.Errorf("series used by key app = %d, want 2", got)
+	}
+	if _, ok := kq.Usage("web"); ok {
+		t.Error("Usage reports a quota for key web, which has none")
+	}
+}
+
+func TestCheckQuotaDoesNotCount(t *testing.T) {
+	mc := newQuotaRegistry(t, Quota{MaxSeries: 1, MaxSamplesPerMinute: 1})
+	if _, err := mc.Register(counter("app_requests_total", "route")); err != nil {
+		t.Fatalf("register: %v", err)
+	}
+
+	for range 3 {
+		if err := mc.CheckQuota("", counter("app_requests_total", "/home")); err != nil {
+			t.Fatalf("CheckQuota: %v", err)
+		}
+	}
+	if err := mc.Update(counter("app_requests_total", "/home")); err != nil {
+		t.Fatalf("update after checks: %v", err)
+	}
+
+	var quotaErr *QuotaError
+	if err := mc.CheckQuota("", counter("app_requests_total", "/home")); !errors.As(err, &quotaErr) ||
+		quotaErr.Quota != QuotaSamplesPerMinute {
+		t.Errorf("CheckQuota() error = %v, want the samples per minute quota to refuse it", err)
+	}
+	if err := mc.CheckQuota("", counter("app_requests_total", "/cart")); !errors.As(err, &quotaErr) ||
+		quotaErr.Quota != QuotaSeries {
+		t.Errorf("CheckQuota() error = %v, want the series quota to refuse it", err)
+	}
+}
+
+func TestRemoveFreesQuota(t *testing.T) {
+	mc := newQuotaRegistry(t, Quota{MaxMetrics: 1, MaxSeries: 1})
+	runQuotaSteps(t, mc, []quotaStep{
+		{register: true, metric: counter("app_requests_total", "route")},
+		{metric: counter("app_requests_total", "/home")},
+	})
+
+	mc.Remove(TypeCounter, "app_requests_total")
+
+	runQuotaSteps(t, mc, []quotaStep{
+		{register: true, metric: counter("app_errors_total", "route")},
+		{metric: counter("app_errors_total", "/cart")},
+	})
+	usage, _ := mc.QuotaUsage()
+	if got := quotaUsed(t, usage, QuotaMetrics); got != 1 {
+		t.Errorf("metrics used = %d, want 1", got)
+	}
+	if got := quotaUsed(t, usage, QuotaSeries); got != 1 {
+		t.Errorf("series used = %d, want 1", got)
+	}
+}
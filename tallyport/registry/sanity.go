@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"tallyport/validation"
+)
+
+// CheckValue enforces the value rules of a metric on an update: gauge values and histogram and
+// summary observations must be finite and, when the metric was registered with a range, inside
+// it. Under the clamp policy values outside the range, infinities included, are moved to the
+// nearest bound instead of being refused; NaN is always refused. Counter pushes carry no value.
+//
+// Parameters:
+//   - metric: The update.
+//
+// Returns:
+//   - MetricRequest: The update with its value clamped where the range asks for it.
+//   - An error holding the JSON of a validation.ValidationError keyed by the value field,
+//     e.g. "Gauge.Value", if the value is refused.
+func (mc *CollectorRegistry) CheckValue(metric MetricRequest) (MetricRequest, error) {
+	var field string
+	var value *float64
+	switch metric.Type {
+	case TypeGauge:
+		field, value = "Gauge.Value", &metric.Gauge.Value
+	case TypeHistogram:
+		field, value = "Histogram.ObservedValue", &metric.Histogram.ObservedValue
+	case TypeSummary:
+		field, value = "Summary.ObservedValue", &metric.Summary.ObservedValue
+	default:
+		return metric, nil
+	}
+
+	var bounds ValueRange
+	if definition, exists := mc.definitions.load(Metric{key: metric.Name}); exists &&
+		definition.Type == metric.Type && definition.Range != nil {
+		bounds = *definition.Range
+	}
+	if bounds.Policy == PolicyClamp && !math.IsNaN(*value) {
+		if bounds.Min != nil {
+			*value = max(*value, *bounds.Min)
+		}
+		if bounds.Max != nil {
+			*value = min(*value, *bounds.Max)
+		}
+	}
+	return metric, checkValue(metric, field, bounds)
+}
+
+// checkValue validates that the number in field of target is finite and within bounds.
+func checkValue[T any](target T, field string, bounds ValueRange) error {
+	validator := validation.NewValidator(target).ValidateField(field, validation.IsFinite)
+	if validator.Errors() == nil {
+		validator.ValidateField(field, validation.InRange(bounds.Min, bounds.Max))
+	}
+	return validationError(validator.Errors())
+}
+
+// validateRange checks the range a metric is registered with. Counters only count up, so they
+// cannot have one.
+func validateRange(metric MetricRequest) error {
+	if metric.Range == nil {
+		return nil
+	}
+
+	validator := validation.NewValidator(metric)
+	if metric.Type == TypeCounter {
+		validator.ValidateField("Range", func(any) error {
+			return errors.New("counters cannot have a range")
+		})
+		return validationError(validator.Errors())
+	}
+
+	validator.
+		ValidateField("Range.Min", validation.IsFinite).
+		ValidateField("Range.Max", validation.IsFinite, func(any) error {
+			if bounds := metric.Range; bounds.Min != nil && bounds.Max != nil && *bounds.Min > *bounds.Max {
+				return fmt.Errorf("maximum %v is below the minimum %v", *bounds.Max, *bounds.Min)
+			}
+			return nil
+		})
+	if metric.Range.Policy != "" {
+		validator.ValidateField("Range.Policy", validation.IsSupported(PolicyReject, PolicyClamp))
+	}
+	return validationError(validator.Errors())
+}
+
+// validationError turns validation errors into an error carrying their JSON, as returned for
+// every refused update.
+func validationError(validationErr validation.ValidationError) error {
+	if validationErr == nil {
+		return nil
+	}
+	raw, err := validationErr.ToJSON()
+	if err != nil {
+		return err
+	}
+	return errors.New(string(raw))
+}
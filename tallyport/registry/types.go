@@ -0,0 +1,75 @@
+package registry
+
+import "errors"
+
+// Errors wrapped by the errors of Register and Update, so callers can answer them with a
+// status of their own instead of matching their text.
+var (
+	// ErrMetricExists is returned for metrics that are registered already.
+	ErrMetricExists = errors.New("resource conflict")
+	// ErrMetricNotFound is returned for updates of metrics that are not registered.
+	ErrMetricNotFound = errors.New("not found")
+)
+
+// Constants defining supported Prometheus metric types.
+const (
+	// TypeSummary represents the Prometheus summary metric type.
+	TypeSummary = "summary"
+	// TypeGauge represents the Prometheus gauge metric type.
+	TypeGauge = "gauge"
+	// TypeHistogram represents the Prometheus histogram metric type.
+	TypeHistogram = "histogram"
+	// TypeCounter represents the Prometheus counter metric type.
+	TypeCounter = "counter"
+)
+
+// Metric represents a key for storing Prometheus metrics in a cache.
+// The hash field uniquely identifies a metric by its name.
+type Metric struct {
+	key string
+}
+
+// Policies for values outside the range of a metric.
+const (
+	// PolicyReject refuses values outside the range with a validation error.
+	PolicyReject = "reject"
+	// PolicyClamp moves values outside the range to its nearest bound.
+	PolicyClamp = "clamp"
+)
+
+// ValueRange bounds the values a gauge, histogram or summary accepts, e.g. 0 to 100 for a
+// battery percentage or a minimum of 0 for durations.
+type ValueRange struct {
+	Min    *float64 `json:"min,omitempty"`    // Lowest accepted value; unbounded when omitted.
+	Max    *float64 `json:"max,omitempty"`    // Highest accepted value; unbounded when omitted.
+	Policy string   `json:"policy,omitempty"` // What happens to values outside the range: reject (default) or clamp.
+}
+
+// BucketValue represents a single bucket configuration for a histogram metric.
+// It includes a label and the upper bound value for the bucket.
+type BucketValue struct {
+	Label string  `json:"label"`
+	Value float64 `json:"value"`
+}
+
+// MetricRequest defines the JSON request structure for initializing or pushing metrics.
+// It supports configuration for counter, gauge, histogram, and summary metric types.
+type MetricRequest struct {
+	Type        string      `json:"type"`                  // Type of the metric (counter, gauge, histogram, summary).
+	Name        string      `json:"name"`                  // Unique name of the metric.
+	Description string      `json:"description,omitempty"` // Description of the metric (optional for push).
+	Labels      []string    `json:"labels,omitempty"`      // Labels associated with the metric.
+	Range       *ValueRange `json:"range,omitempty"`       // Values accepted by updates (optional for init, ignored for push).
+	Gauge       struct {
+		Value float64 `json:"value,omitempty"` // Value for gauge metric updates.
+	} `json:"gauge"` // Gauge-specific configuration.
+	Histogram struct {
+		Buckets       []float64 `json:"buckets,omitempty"`       // Bucket boundaries for histogram initialization.
+		ObservedValue float64   `json:"observed_value,omitzero"` // Observed value for histogram updates.
+	} `json:"histogram"` // Histogram-specific configuration.
+	Summary struct {
+		Objectives    map[string]float64 `json:"objectives,omitempty"`    // Quantile objectives for summary initialization.
+		MaxAge        int64              `json:"max_age,omitempty"`       // Maximum age for summary observations.
+		ObservedValue float64            `json:"observed_value,omitzero"` // Observed value for summary updates.
+	} `json:"summary"` // Summary-specific configuration.
+}
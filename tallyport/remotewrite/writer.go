@@ -0,0 +1,487 @@
+// Package remotewrite ships snapshots of a Prometheus registry to remote write endpoints and
+// converts gathered metric families into remote write series.
+package remotewrite
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"tallyport/config"
+	"tallyport/prompb"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/rs/zerolog"
+)
+
+// Defaults used when the matching remote_write_config field is not set.
+const (
+	remoteWriteDefaultInterval      = 15 * time.Second
+	remoteWriteDefaultTimeout       = 30 * time.Second
+	remoteWriteDefaultShards        = 1
+	remoteWriteDefaultQueueSize     = 10000
+	remoteWriteDefaultBatchSize     = 2000
+	remoteWriteDefaultBatchDeadline = 5 * time.Second
+	remoteWriteDefaultMaxRetries    = 5
+	remoteWriteDefaultMinBackoff    = 30 * time.Millisecond
+	remoteWriteDefaultMaxBackoff    = 5 * time.Second
+)
+
+// queuedSeries is a series waiting in a shard queue together with the metadata of its family.
+type queuedSeries struct {
+	series   prompb.TimeSeries
+	metadata prompb.MetricMetadata
+}
+
+// recoverableError marks a failed send that is worth retrying: network errors, 429 and 5xx.
+type recoverableError struct {
+	error
+	retryAfter time.Duration
+}
+
+// RemoteWriter periodically snapshots a Prometheus gatherer and ships the samples to a
+// remote write endpoint. Series are spread over shards by label hash, so a series is always
+// sent in order by the same shard, and every shard has its own bounded queue and sender.
+// When a queue is full the newest samples are dropped and counted instead of blocking
+// the snapshot loop.
+type RemoteWriter struct {
+	client         *http.Client
+	url            string
+	headers        map[string]string
+	externalLabels []prompb.Label
+	gatherer       prometheus.Gatherer
+	logger         zerolog.Logger
+	interval       time.Duration
+	batchSize      int
+	batchDeadline  time.Duration
+	maxRetries     int
+	minBackoff     time.Duration
+	maxBackoff     time.Duration
+	shards         []chan queuedSeries
+	done           chan struct{}
+	wg             sync.WaitGroup
+
+	samplesSent    prometheus.Counter
+	samplesFailed  prometheus.Counter
+	samplesDropped prometheus.Counter
+	retries        prometheus.Counter
+	queueLength    *prometheus.GaugeVec
+	sendDuration   prometheus.Histogram
+}
+
+// NewRemoteWriter creates a RemoteWriter from remote_write_config and registers its own
+// metrics with reg. The writer snapshots gatherer and does nothing until Start is called.
+//
+// Parameters:
+//   - cfg: Server configuration, of which remote_write_config is used.
+//   - gatherer: Metrics that are snapshotted and sent, usually reg itself.
+//   - reg: Prometheus registry that receives the writer metrics.
+//   - logger: Logger used to report failed sends.
+//
+// Returns:
+//   - *RemoteWriter: The configured writer.
+//   - An error if the writer metrics cannot be registered.
+func NewRemoteWriter(cfg config.TallyPortConfig, gatherer prometheus.Gatherer, reg prometheus.Registerer, logger zerolog.Logger) (*RemoteWriter, error) {
+	rwc := cfg.RemoteWriteConfig
+
+	rw := &RemoteWriter{
+		client:        &http.Client{Timeout: config.MillisecondsOr(rwc.Timeout, remoteWriteDefaultTimeout)},
+		url:           rwc.URL,
+		headers:       rwc.Headers,
+		gatherer:      gatherer,
+		logger:        logger,
+		interval:      config.MillisecondsOr(rwc.Interval, remoteWriteDefaultInterval),
+		batchSize:     rwc.BatchSize,
+		batchDeadline: config.MillisecondsOr(rwc.BatchDeadline, remoteWriteDefaultBatchDeadline),
+		maxRetries:    rwc.MaxRetries,
+		minBackoff:    config.MillisecondsOr(rwc.MinBackoff, remoteWriteDefaultMinBackoff),
+		maxBackoff:    config.MillisecondsOr(rwc.MaxBackoff, remoteWriteDefaultMaxBackoff),
+		done:          make(chan struct{}),
+		samplesSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "remote_write",
+			Name:      "samples_sent_total",
+			Help:      "Samples successfully sent to the remote write endpoint",
+		}),
+		samplesFailed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "remote_write",
+			Name:      "samples_failed_total",
+			Help:      "Samples that could not be sent after all retries",
+		}),
+		samplesDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "remote_write",
+			Name:      "samples_dropped_total",
+			Help:      "Samples dropped because a shard queue was full",
+		}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "remote_write",
+			Name:      "retries_total",
+			Help:      "Send attempts retried after a recoverable error",
+		}),
+		queueLength: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "remote_write",
+			Name:      "queue_length",
+			Help:      "Series waiting to be sent per shard",
+		}, []string{"shard"}),
+		sendDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: "__tallyport__",
+			Subsystem: "remote_write",
+			Name:      "send_duration_seconds",
+			Help:      "Duration of remote write requests in seconds",
+			Buckets:   prometheus.DefBuckets,
+		}),
+	}
+
+	if rw.batchSize <= 0 {
+		rw.batchSize = remoteWriteDefaultBatchSize
+	}
+	if rw.maxRetries <= 0 {
+		rw.maxRetries = remoteWriteDefaultMaxRetries
+	}
+
+	shards := rwc.Shards
+	if shards <= 0 {
+		shards = remoteWriteDefaultShards
+	}
+	queueSize := rwc.QueueSize
+	if queueSize <= 0 {
+		queueSize = remoteWriteDefaultQueueSize
+	}
+	rw.shards = make([]chan queuedSeries, shards)
+	for i := range rw.shards {
+		rw.shards[i] = make(chan queuedSeries, queueSize)
+	}
+
+	for name, value := range rwc.ExternalLabels {
+		rw.externalLabels = append(rw.externalLabels, prompb.Label{Name: name, Value: value})
+	}
+
+	for _, collector := range []prometheus.Collector{
+		rw.samplesSent, rw.samplesFailed, rw.samplesDropped, rw.retries, rw.queueLength, rw.sendDuration,
+	} {
+		if err := reg.Register(collector); err != nil {
+			return nil, fmt.Errorf("failed to register remote write metric: %w", err)
+		}
+	}
+
+	return rw, nil
+}
+
+// Start launches the snapshot loop and one sender per shard.
+func (rw *RemoteWriter) Start() {
+	for i, queue := range rw.shards {
+		rw.wg.Add(1)
+		go func() {
+			defer rw.wg.Done()
+			rw.runShard(strconv.Itoa(i), queue)
+		}()
+	}
+
+	rw.wg.Add(1)
+	go func() {
+		defer rw.wg.Done()
+		rw.runSnapshots()
+	}()
+}
+
+// Stop ends the snapshot loop, flushes what is already queued and waits for the shards to finish.
+// Sends still retrying are abandoned after their current attempt.
+func (rw *RemoteWriter) Stop() {
+	close(rw.done)
+	rw.wg.Wait()
+}
+
+func (rw *RemoteWriter) runSnapshots() {
+	ticker := time.NewTicker(rw.interval)
+	defer ticker.Stop()
+	defer func() {
+		for _, queue := range rw.shards {
+			close(queue)
+		}
+	}()
+
+	for {
+		select {
+		case <-ticker.C:
+			rw.snapshot()
+		case <-rw.done:
+			return
+		}
+	}
+}
+
+// snapshot gathers the registry once and spreads the resulting series over the shard queues.
+func (rw *RemoteWriter) snapshot() {
+	families, err := rw.gatherer.Gather()
+	if err != nil {
+		// Gather returns whatever it could collect alongside the error.
+		rw.logger.Warn().Err(err).Msg("remote write snapshot is incomplete")
+	}
+
+	timestamp := time.Now().UnixMilli()
+	for _, family := range families {
+		metadata := FamilyMetadata(family)
+		for _, series := range FamilySeries(family, timestamp, rw.externalLabels) {
+			shard := rw.shardFor(series)
+			select {
+			case rw.shards[shard] <- queuedSeries{series: series, metadata: metadata}:
+			default:
+				rw.samplesDropped.Add(float64(len(series.Samples)))
+			}
+		}
+	}
+
+	for i, queue := range rw.shards {
+		rw.queueLength.WithLabelValues(strconv.Itoa(i)).Set(float64(len(queue)))
+	}
+}
+
+func (rw *RemoteWriter) shardFor(series prompb.TimeSeries) int {
+	hash := fnv.New64a()
+	for _, label := range series.Labels {
+		hash.Write([]byte(label.Name))
+		hash.Write([]byte{0xff})
+		hash.Write([]byte(label.Value))
+		hash.Write([]byte{0xff})
+	}
+	return int(hash.Sum64() % uint64(len(rw.shards)))
+}
+
+// runShard batches the series of one queue and sends a batch when it is full or when
+// batch_send_deadline has passed since the last send. It returns once the queue is closed
+// and drained.
+func (rw *RemoteWriter) runShard(shard string, queue chan queuedSeries) {
+	batch := make([]queuedSeries, 0, rw.batchSize)
+	ticker := time.NewTicker(rw.batchDeadline)
+	defer ticker.Stop()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		rw.sendBatch(batch)
+		batch = batch[:0]
+		rw.queueLength.WithLabelValues(shard).Set(float64(len(queue)))
+	}
+
+	for {
+		select {
+		case item, ok := <-queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, item)
+			if len(batch) >= rw.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (rw *RemoteWriter) sendBatch(batch []queuedSeries) {
+	request := prompb.WriteRequest{Timeseries: make([]prompb.TimeSeries, 0, len(batch))}
+	seen := make(map[string]struct{})
+	samples := 0
+	for _, item := range batch {
+		request.Timeseries = append(request.Timeseries, item.series)
+		samples += len(item.series.Samples)
+		if _, ok := seen[item.metadata.MetricFamilyName]; !ok {
+			seen[item.metadata.MetricFamilyName] = struct{}{}
+			request.Metadata = append(request.Metadata, item.metadata)
+		}
+	}
+
+	body := snappy.Encode(nil, request.Marshal())
+	if err := rw.sendWithRetry(body); err != nil {
+		rw.samplesFailed.Add(float64(samples))
+		rw.logger.Error().Err(err).Int("samples", samples).Msg("remote write failed")
+		return
+	}
+	rw.samplesSent.Add(float64(samples))
+}
+
+// sendWithRetry posts body and retries recoverable errors with exponential backoff and full
+// jitter, honouring Retry-After on 429 responses.
+func (rw *RemoteWriter) sendWithRetry(body []byte) error {
+	backoff := rw.minBackoff
+	for attempt := 0; ; attempt++ {
+		err := rw.send(body)
+		if err == nil {
+			return nil
+		}
+
+		var recoverable recoverableError
+		if !errors.As(err, &recoverable) || attempt >= rw.maxRetries {
+			return err
+		}
+
+		wait := time.Duration(rand.Int64N(int64(backoff) + 1))
+		if recoverable.retryAfter > 0 {
+			wait = recoverable.retryAfter
+		}
+		backoff = min(backoff*2, rw.maxBackoff)
+
+		rw.retries.Inc()
+		select {
+		case <-time.After(wait):
+		case <-rw.done:
+			return fmt.Errorf("shutting down while retrying: %w", err)
+		}
+	}
+}
+
+func (rw *RemoteWriter) send(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, rw.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for key, value := range rw.headers {
+		req.Header.Set(key, value)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "tallyport")
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	start := time.Now()
+	res, err := rw.client.Do(req)
+	rw.sendDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return recoverableError{error: err}
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 == 2 {
+		io.Copy(io.Discard, res.Body)
+		return nil
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+	err = fmt.Errorf("server returned HTTP status %s: %s", res.Status, bytes.TrimSpace(message))
+	if res.StatusCode == http.StatusTooManyRequests || res.StatusCode/100 == 5 {
+		retryAfter := time.Duration(0)
+		if seconds, parseErr := strconv.Atoi(res.Header.Get("Retry-After")); parseErr == nil && seconds > 0 {
+			retryAfter = time.Duration(seconds) * time.Second
+		}
+		return recoverableError{error: err, retryAfter: retryAfter}
+	}
+	return err
+}
+
+// FamilyMetadata describes a gathered metric family for the remote write metadata field.
+func FamilyMetadata(family *dto.MetricFamily) prompb.MetricMetadata {
+	metadata := prompb.MetricMetadata{
+		MetricFamilyName: family.GetName(),
+		Help:             family.GetHelp(),
+		Unit:             family.GetUnit(),
+	}
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		metadata.Type = prompb.MetricTypeCounter
+	case dto.MetricType_GAUGE:
+		metadata.Type = prompb.MetricTypeGauge
+	case dto.MetricType_HISTOGRAM:
+		metadata.Type = prompb.MetricTypeHistogram
+	case dto.MetricType_GAUGE_HISTOGRAM:
+		metadata.Type = prompb.MetricTypeGaugeHistogram
+	case dto.MetricType_SUMMARY:
+		metadata.Type = prompb.MetricTypeSummary
+	default:
+		metadata.Type = prompb.MetricTypeUnknown
+	}
+	return metadata
+}
+
+// FamilySeries flattens a gathered metric family into remote write series, following the
+// text exposition naming: histograms become _bucket, _sum and _count series and summaries
+// become quantile, _sum and _count series.
+func FamilySeries(family *dto.MetricFamily, timestamp int64, externalLabels []prompb.Label) []prompb.TimeSeries {
+	name := family.GetName()
+	var out []prompb.TimeSeries
+
+	add := func(metric *dto.Metric, seriesName string, value float64, extra ...prompb.Label) {
+		labels := make([]prompb.Label, 0, len(metric.GetLabel())+len(externalLabels)+len(extra)+1)
+		labels = append(labels, prompb.Label{Name: "__name__", Value: seriesName})
+		present := make(map[string]struct{}, len(metric.GetLabel()))
+		for _, pair := range metric.GetLabel() {
+			labels = append(labels, prompb.Label{Name: pair.GetName(), Value: pair.GetValue()})
+			present[pair.GetName()] = struct{}{}
+		}
+		labels = append(labels, extra...)
+		// External labels never override labels set on the series itself.
+		for _, label := range externalLabels {
+			if _, ok := present[label.Name]; !ok {
+				labels = append(labels, label)
+			}
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+		out = append(out, prompb.TimeSeries{
+			Labels:  labels,
+			Samples: []prompb.Sample{{Value: value, Timestamp: timestamp}},
+		})
+	}
+
+	for _, metric := range family.GetMetric() {
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			add(metric, name, metric.GetCounter().GetValue())
+		case dto.MetricType_GAUGE:
+			add(metric, name, metric.GetGauge().GetValue())
+		case dto.MetricType_UNTYPED:
+			add(metric, name, metric.GetUntyped().GetValue())
+		case dto.MetricType_HISTOGRAM, dto.MetricType_GAUGE_HISTOGRAM:
+			histogram := metric.GetHistogram()
+			hasInf := false
+			for _, bucket := range histogram.GetBucket() {
+				if math.IsInf(bucket.GetUpperBound(), +1) {
+					hasInf = true
+				}
+				add(metric, name+"_bucket", float64(bucket.GetCumulativeCount()),
+					prompb.Label{Name: "le", Value: formatFloat(bucket.GetUpperBound())})
+			}
+			if !hasInf {
+				add(metric, name+"_bucket", float64(histogram.GetSampleCount()),
+					prompb.Label{Name: "le", Value: "+Inf"})
+			}
+			add(metric, name+"_sum", histogram.GetSampleSum())
+			add(metric, name+"_count", float64(histogram.GetSampleCount()))
+		case dto.MetricType_SUMMARY:
+			summary := metric.GetSummary()
+			for _, quantile := range summary.GetQuantile() {
+				add(metric, name, quantile.GetValue(),
+					prompb.Label{Name: "quantile", Value: formatFloat(quantile.GetQuantile())})
+			}
+			add(metric, name+"_sum", summary.GetSampleSum())
+			add(metric, name+"_count", float64(summary.GetSampleCount()))
+		}
+	}
+	return out
+}
+
+func formatFloat(value float64) string {
+	if math.IsInf(value, +1) {
+		return "+Inf"
+	}
+	if math.IsInf(value, -1) {
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
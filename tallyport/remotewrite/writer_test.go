@@ -0,0 +1,284 @@
+package remotewrite
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"tallyport/config"
+	"tallyport/prompb"
+	"testing"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+)
+
+// receiver is a stand-in remote write endpoint that decodes every request it is sent and
+// answers with the status codes queued in replies, then with 204.
+type receiver struct {
+	mu       sync.Mutex
+	requests []prompb.WriteRequest
+	replies  []int
+	attempts atomic.Int64
+	server   *httptest.Server
+	t        *testing.T
+}
+
+func newReceiver(t *testing.T, replies ...int) *receiver {
+	t.Helper()
+	rcv := &receiver{replies: replies, t: t}
+	rcv.server = httptest.NewServer(http.HandlerFunc(rcv.serve))
+	t.Cleanup(rcv.server.Close)
+	return rcv
+}
+
+func (rcv *receiver) serve(res http.ResponseWriter, req *http.Request) {
+	rcv.attempts.Add(1)
+	if got := req.Header.Get("Content-Encoding"); got != "snappy" {
+		rcv.t.Errorf("Content-Encoding = %q, want snappy", got)
+	}
+	if got := req.Header.Get("Content-Type"); got != "application/x-protobuf" {
+		rcv.t.Errorf("Content-Type = %q, want application/x-protobuf", got)
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	if len(rcv.replies) > 0 {
+		status := rcv.replies[0]
+		rcv.replies = rcv.replies[1:]
+		if status == http.StatusTooManyRequests {
+			res.Header().Set("Retry-After", "1")
+		}
+		http.Error(res, http.StatusText(status), status)
+		return
+	}
+
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		rcv.t.Errorf("read body: %v", err)
+		return
+	}
+	raw, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		rcv.t.Errorf("snappy decode: %v", err)
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var request prompb.WriteRequest
+	if err := request.Unmarshal(raw); err != nil {
+		rcv.t.Errorf("unmarshal write request: %v", err)
+		http.Error(res, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rcv.requests = append(rcv.requests, request)
+	res.WriteHeader(http.StatusNoContent)
+}
+
+func (rcv *receiver) received() []prompb.WriteRequest {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return append([]prompb.WriteRequest(nil), rcv.requests...)
+}
+
+// newTestWriter creates a writer sending to url that snapshots a registry holding one gauge
+// with the given number of series. The snapshot interval is long enough for tests to take
+// snapshots themselves.
+func newTestWriter(t *testing.T, url string, series int, configure func(*config.TallyPortConfig)) *RemoteWriter {
+	t.Helper()
+	gatherer := prometheus.NewRegistry()
+	gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "app_battery", Help: "Battery level"}, []string{"device"})
+	gatherer.MustRegister(gauge)
+	for i := range series {
+		gauge.WithLabelValues("device-" + strconv.Itoa(i)).Set(float64(i))
+	}
+
+	var cfg config.TallyPortConfig
+	cfg.RemoteWriteConfig.URL = url
+	cfg.RemoteWriteConfig.Interval = int64(time.Hour / time.Millisecond)
+	cfg.RemoteWriteConfig.MinBackoff = 1
+	cfg.RemoteWriteConfig.MaxBackoff = 5
+	if configure != nil {
+		configure(&cfg)
+	}
+
+	rw, err := NewRemoteWriter(cfg, gatherer, prometheus.NewRegistry(), zerolog.Nop())
+	if err != nil {
+		t.Fatalf("NewRemoteWriter: %v", err)
+	}
+	return rw
+}
+
+// queued takes one snapshot and returns the series it queued for sending.
+func queued(rw *RemoteWriter) []queuedSeries {
+	rw.snapshot()
+	var items []queuedSeries
+	for _, queue := range rw.shards {
+		for len(queue) > 0 {
+			items = append(items, <-queue)
+		}
+	}
+	return items
+}
+
+func deviceOf(series prompb.TimeSeries) string {
+	for _, label := range series.Labels {
+		if label.Name == "device" {
+			return label.Value
+		}
+	}
+	return ""
+}
+
+func TestRemoteWriterShardsSeriesByLabels(t *testing.T) {
+	rcv := newReceiver(t)
+	rw := newTestWriter(t, rcv.server.URL, 40, func(cfg *config.TallyPortConfig) {
+		cfg.RemoteWriteConfig.Shards = 4
+		cfg.RemoteWriteConfig.BatchSize = 3
+	})
+
+	rw.snapshot()
+	used := 0
+	for _, queue := range rw.shards {
+		if len(queue) > 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		t.Fatalf("40 series were queued on %d shard(s), want them spread over several", used)
+	}
+
+	rw.Start()
+	rw.Stop()
+
+	seen := make(map[string]int)
+	for _, request := range rcv.received() {
+		if len(request.Timeseries) > 3 {
+			t.Errorf("request carries %d series, want at most max_samples_per_send 3", len(request.Timeseries))
+		}
+		shard := rw.shardFor(request.Timeseries[0])
+		for _, series := range request.Timeseries {
+			if got := rw.shardFor(series); got != shard {
+				t.Errorf("series %s of shard %d was sent in a batch of shard %d", deviceOf(series), got, shard)
+			}
+			seen[deviceOf(series)]++
+		}
+		if len(request.Metadata) != 1 || request.Metadata[0].MetricFamilyName != "app_battery" ||
+			request.Metadata[0].Type != prompb.MetricTypeGauge {
+			t.Errorf("metadata = %+v, want the app_battery gauge", request.Metadata)
+		}
+	}
+	if len(seen) != 40 {
+		t.Fatalf("received %d distinct series, want 40", len(seen))
+	}
+	for device, count := range seen {
+		if count != 1 {
+			t.Errorf("series %s received %d times, want once", device, count)
+		}
+	}
+	if got := testutil.ToFloat64(rw.samplesSent); got != 40 {
+		t.Errorf("samples sent = %g, want 40", got)
+	}
+}
+
+func TestRemoteWriterRetriesServerErrors(t *testing.T) {
+	rcv := newReceiver(t, http.StatusInternalServerError, http.StatusServiceUnavailable)
+	rw := newTestWriter(t, rcv.server.URL, 2, nil)
+
+	rw.sendBatch(queued(rw))
+
+	if got := rcv.attempts.Load(); got != 3 {
+		t.Errorf("attempts = %d, want 3", got)
+	}
+	if got := len(rcv.received()); got != 1 {
+		t.Fatalf("accepted requests = %d, want 1", got)
+	}
+	if got := testutil.ToFloat64(rw.retries); got != 2 {
+		t.Errorf("retries = %g, want 2", got)
+	}
+	if got := testutil.ToFloat64(rw.samplesSent); got != 2 {
+		t.Errorf("samples sent = %g, want 2", got)
+	}
+	if got := testutil.ToFloat64(rw.samplesFailed); got != 0 {
+		t.Errorf("samples failed = %g, want 0", got)
+	}
+}
+
+func TestRemoteWriterGivesUpAfterMaxRetries(t *testing.T) {
+	rcv := newReceiver(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	rw := newTestWriter(t, rcv.server.URL, 2, func(cfg *config.TallyPortConfig) {
+		cfg.RemoteWriteConfig.MaxRetries = 2
+	})
+
+	rw.sendBatch(queued(rw))
+
+	if got := rcv.attempts.Load(); got != 3 {
+		t.Errorf("attempts = %d, want the first one and 2 retries", got)
+	}
+	if got := testutil.ToFloat64(rw.samplesFailed); got != 2 {
+		t.Errorf("samples failed = %g, want 2", got)
+	}
+}
+
+func TestRemoteWriterDoesNotRetryClientErrors(t *testing.T) {
+	rcv := newReceiver(t, http.StatusBadRequest)
+	rw := newTestWriter(t, rcv.server.URL, 2, nil)
+
+	rw.sendBatch(queued(rw))
+
+	if got := rcv.attempts.Load(); got != 1 {
+		t.Errorf("attempts = %d, want 1", got)
+	}
+	if got := testutil.ToFloat64(rw.samplesFailed); got != 2 {
+		t.Errorf("samples failed = %g, want 2", got)
+	}
+}
+
+func TestRemoteWriterHonoursRetryAfter(t *testing.T) {
+	rcv := newReceiver(t, http.StatusTooManyRequests)
+	rw := newTestWriter(t, rcv.server.URL, 1, nil)
+
+	start := time.Now()
+	rw.sendBatch(queued(rw))
+	elapsed := time.Since(start)
+
+	// The backoff is at most 5ms, so only Retry-After can explain the wait.
+	if elapsed < time.Second {
+		t.Errorf("retried after %s, want to wait the 1s of Retry-After", elapsed)
+	}
+	if got := rcv.attempts.Load(); got != 2 {
+		t.Errorf("attempts = %d, want 2", got)
+	}
+	if got := testutil.ToFloat64(rw.samplesSent); got != 1 {
+		t.Errorf("samples sent = %g, want 1", got)
+	}
+}
+
+func TestRemoteWriterDropsNewestWhenQueueIsFull(t *testing.T) {
+	rcv := newReceiver(t)
+	rw := newTestWriter(t, rcv.server.URL, 5, func(cfg *config.TallyPortConfig) {
+		cfg.RemoteWriteConfig.QueueSize = 2
+	})
+
+	items := queued(rw)
+
+	if len(items) != 2 {
+		t.Fatalf("queued %d series, want queue_size 2", len(items))
+	}
+	// Series are gathered sorted by label value, so the first two are the oldest in the snapshot.
+	for i, want := range []string{"device-0", "device-1"} {
+		if got := deviceOf(items[i].series); got != want {
+			t.Errorf("queued series %d = %s, want %s", i, got, want)
+		}
+	}
+	if got := testutil.ToFloat64(rw.samplesDropped); got != 3 {
+		t.Errorf("samples dropped = %g, want 3", got)
+	}
+	if got := testutil.ToFloat64(rw.queueLength.WithLabelValues("0")); got != 2 {
+		t.Errorf("queue length = %g, want 2", got)
+	}
+}
@@ -260,6 +260,44 @@ def test_push_invalid_metric(server, clean_metric):
     assert data["status"] == 400
     assert "not found" in data["reason"].lower()
 
+def test_ingest_text_exposition(server):
+    name = f"test_ingested_{int(time.time() * 1000)}"
+    body = (
+        f"# HELP {name}_total Ingested counter\n"
+        f"# TYPE {name}_total counter\n"
+        f'{name}_total{{queue="a"}} 5\n'
+    )
+    response = requests.post(
+        f"{BASE_URL}/ingest?instance=pytest",
+        data=body,
+        headers={"Content-Type": "text/plain; version=0.0.4"},
+    )
+    assert response.status_code == 204
+
+    response = requests.get(f"{BASE_URL}/metrics")
+    assert f'{name}_total{{instance="pytest",queue="a"}} 5' in response.text
+
+def test_definitions_describe_and_delete(server, clean_metric):
+    clean_metric["type"] = "gauge"
+    name = clean_metric["name"]
+    response = requests.post(f"{BASE_URL}/init", json=clean_metric)
+    assert response.status_code == 201
+
+    response = requests.get(f"{BASE_URL}/definitions")
+    assert response.status_code == 200
+    assert name in [metric["name"] for metric in response.json()["metrics"]]
+
+    response = requests.get(f"{BASE_URL}/definitions/{name}")
+    assert response.status_code == 200
+    metric = response.json()["metrics"][0]
+    assert metric["type"] == "gauge"
+    assert metric["labels"] == ["bucket1", "bucket2"]
+
+    response = requests.delete(f"{BASE_URL}/definitions/{name}")
+    assert response.status_code == 200
+    response = requests.get(f"{BASE_URL}/definitions/{name}")
+    assert response.status_code == 404
+
 def test_metrics_endpoint(server):
     response = requests.get(f"{BASE_URL}/metrics")
     assert response.status_code == 200
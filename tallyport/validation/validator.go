@@ -1,8 +1,11 @@
-package main
+// Package validation provides field-level validation of request structs, collecting every
+// failure per field so they can be reported together.
+package validation
 
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"reflect"
 	"slices"
 	"strings"
@@ -43,22 +46,29 @@ func NewValidator[T any](target T) *Validator[T] {
 	}
 }
 
-// ValidateField adds validation for a specific field
+// ValidateField adds validation for a specific field. Fields of nested structs are named by
+// their path, e.g. "Gauge.Value"; pointers along the path are followed.
 func (v *Validator[T]) ValidateField(fieldName string, validators ...ValidatorFunc) *Validator[T] {
-	val := reflect.ValueOf(v.target)
-	if val.Kind() == reflect.Ptr {
-		val = val.Elem()
-	}
+	field := reflect.ValueOf(v.target)
+	for _, name := range strings.Split(fieldName, ".") {
+		if field.Kind() == reflect.Ptr {
+			if field.IsNil() {
+				v.errors[fieldName] = append(v.errors[fieldName], fmt.Errorf("field %s is nil", fieldName))
+				return v
+			}
+			field = field.Elem()
+		}
 
-	if val.Kind() != reflect.Struct {
-		v.errors[fieldName] = append(v.errors[fieldName], fmt.Errorf("target is not a struct"))
-		return v
-	}
+		if field.Kind() != reflect.Struct {
+			v.errors[fieldName] = append(v.errors[fieldName], fmt.Errorf("target is not a struct"))
+			return v
+		}
 
-	field := val.FieldByName(fieldName)
-	if !field.IsValid() {
-		v.errors[fieldName] = append(v.errors[fieldName], fmt.Errorf("field %s not found", fieldName))
-		return v
+		field = field.FieldByName(name)
+		if !field.IsValid() {
+			v.errors[fieldName] = append(v.errors[fieldName], fmt.Errorf("field %s not found", fieldName))
+			return v
+		}
 	}
 
 	for _, validator := range validators {
@@ -143,3 +153,37 @@ func IsSupported(values ...string) ValidatorFunc {
 		return nil
 	}
 }
+
+// IsFinite rejects NaN and infinite numbers. Nil pointers are accepted.
+func IsFinite(value any) error {
+	switch v := value.(type) {
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return fmt.Errorf("value must be a finite number, got %v", v)
+		}
+	case *float64:
+		if v != nil {
+			return IsFinite(*v)
+		}
+	default:
+		return fmt.Errorf("unsupported type for IsFinite")
+	}
+	return nil
+}
+
+// InRange rejects numbers below min or above max. A nil bound leaves that side open.
+func InRange(min, max *float64) ValidatorFunc {
+	return func(value any) error {
+		v, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("unsupported type for InRange")
+		}
+		if min != nil && v < *min {
+			return fmt.Errorf("value %v is below the minimum of %v", v, *min)
+		}
+		if max != nil && v > *max {
+			return fmt.Errorf("value %v is above the maximum of %v", v, *max)
+		}
+		return nil
+	}
+}